@@ -58,5 +58,23 @@ func main() {
 	Store(result, ReturnIndex(0))
 	MOVB(operand.Imm(1), ok.Addr)
 	RET()
+
+	// Plain Go cannot express a prefetch, so we use a tiny helper.
+	// The call costs a few ns, so callers only use it when they expect a cache miss.
+	TEXT("prefetch", NOSPLIT, "func(addr uintptr)")
+	Doc("prefetch hints that the cache line containing addr will be read soon.",
+		"It never faults, even for an invalid addr.")
+	addr := Load(Param("addr"), GP64())
+	PREFETCHT0(operand.Mem{Base: addr})
+	RET()
+
+	TEXT("prefetchGroupSlots", NOSPLIT, "func(addr uintptr)")
+	Doc("prefetchGroupSlots hints that the 16 slots of a group starting at addr will be read soon.",
+		"This is 4 cache lines. Like prefetch, it never faults.")
+	addr = Load(Param("addr"), GP64())
+	for i := 0; i < 4; i++ {
+		PREFETCHT0(operand.Mem{Base: addr, Disp: 64 * i})
+	}
+	RET()
 	Generate()
 }
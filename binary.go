@@ -0,0 +1,378 @@
+package swisstable
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Binary serialization.
+//
+// MarshalBinary writes a fixed size header followed by one of two payloads:
+//
+//	layout:  the control bytes of current, followed by its slots.
+//	entries: the live key/values, in no particular order.
+//
+// The layout kind lets UnmarshalBinary rebuild the table by copying the
+// control bytes and slots rather than inserting each key, but that is only valid
+// if the receiving Map hashes keys exactly as the original Map did.
+// We check that by storing a fingerprint of the hash function (the hashes of a few
+// fixed keys using the stored seed), and if the receiver's hash function
+// produces a different fingerprint, we fall back to re-inserting each key/value.
+// Note that the default runtime hash is only stable within a process,
+// so across processes a layout is normally re-inserted.
+// Because the data is untrusted, we also check the copied table with the same
+// checks as CheckInvariants, and re-insert if a key is not where a lookup would find it.
+//
+// While growing, the table layout is split between old and current,
+// so we write the entries kind, which always re-inserts on load.
+//
+// All integers are little endian. The header is a multiple of 16 bytes
+// so that the slots following the control bytes stay 16-byte aligned
+// relative to the start of the data, which helps if it is mapped into memory.
+//
+// Header:
+//
+//	offset  size  field
+//	0       4     magic "SWTB"
+//	4       2     version
+//	6       1     kind (binaryLayout or binaryEntries)
+//	7       1     reserved, zero
+//	8       8     hash fingerprint
+//	16      8     seed
+//	24      8     table size (len(control) of current, ignored on load for entries)
+//	32      8     count
+//	40      8     delete count (layout only)
+//
+// Each slot is 16 bytes: the key, followed by the value.
+//
+// Version 1 used 0xFF for EMPTY, 0x80 for DELETED, and the h2 with the high bit clear for STORED
+// control bytes. UnmarshalBinary converts version 1 layouts, but OpenMapped requires
+// version 2 because it uses the control bytes in place.
+
+const (
+	binaryMagic   = "SWTB"
+	binaryVersion = 2
+	// binaryVersionV1 is the previous version, with a different control byte encoding.
+	binaryVersionV1 = 1
+
+	binaryLayout  = 1
+	binaryEntries = 2
+
+	binaryHeaderSize = 48
+	binarySlotSize   = 16
+)
+
+// binaryHeader is the decoded form of the serialization header.
+type binaryHeader struct {
+	version     uint16
+	kind        uint8
+	fingerprint uint64
+	seed        uint64
+	tableSize   uint64
+	count       uint64
+	deleteCount uint64
+}
+
+func (hdr *binaryHeader) put(b []byte) {
+	copy(b, binaryMagic)
+	binary.LittleEndian.PutUint16(b[4:], hdr.version)
+	b[6] = hdr.kind
+	b[7] = 0
+	binary.LittleEndian.PutUint64(b[8:], hdr.fingerprint)
+	binary.LittleEndian.PutUint64(b[16:], hdr.seed)
+	binary.LittleEndian.PutUint64(b[24:], hdr.tableSize)
+	binary.LittleEndian.PutUint64(b[32:], hdr.count)
+	binary.LittleEndian.PutUint64(b[40:], hdr.deleteCount)
+}
+
+// parseBinaryHeader decodes and validates the header at the start of data.
+func parseBinaryHeader(data []byte) (binaryHeader, error) {
+	var hdr binaryHeader
+	if len(data) < binaryHeaderSize {
+		return hdr, fmt.Errorf("swisstable: binary data too short (%d bytes)", len(data))
+	}
+	if string(data[:4]) != binaryMagic {
+		return hdr, fmt.Errorf("swisstable: binary data has bad magic %q", data[:4])
+	}
+	hdr.version = binary.LittleEndian.Uint16(data[4:])
+	hdr.kind = data[6]
+	hdr.fingerprint = binary.LittleEndian.Uint64(data[8:])
+	hdr.seed = binary.LittleEndian.Uint64(data[16:])
+	hdr.tableSize = binary.LittleEndian.Uint64(data[24:])
+	hdr.count = binary.LittleEndian.Uint64(data[32:])
+	hdr.deleteCount = binary.LittleEndian.Uint64(data[40:])
+
+	if hdr.version != binaryVersion && hdr.version != binaryVersionV1 {
+		return hdr, fmt.Errorf("swisstable: unsupported binary version %d", hdr.version)
+	}
+
+	// The data is untrusted, so the size of the table we allocate must be tied
+	// to the length of data. For a layout, the payload holds the whole table,
+	// and we check its length below. For entries, the payload only holds count
+	// slots, so UnmarshalBinary ignores the table size and sizes the table from count.
+	var want uint64
+	switch hdr.kind {
+	case binaryLayout:
+		// Limiting the table size also avoids overflow when computing the payload size.
+		if hdr.tableSize < 16 || hdr.tableSize > 1<<48 || hdr.tableSize&(hdr.tableSize-1) != 0 {
+			return hdr, fmt.Errorf("swisstable: invalid table size %d", hdr.tableSize)
+		}
+		// We always keep at least one EMPTY slot so probing terminates.
+		if hdr.count+hdr.deleteCount >= hdr.tableSize || hdr.count >= hdr.tableSize {
+			return hdr, fmt.Errorf("swisstable: count %d and delete count %d too large for table size %d",
+				hdr.count, hdr.deleteCount, hdr.tableSize)
+		}
+		want = binaryHeaderSize + hdr.tableSize*(1+binarySlotSize)
+	case binaryEntries:
+		if hdr.deleteCount != 0 {
+			return hdr, fmt.Errorf("swisstable: unexpected delete count %d for entries", hdr.deleteCount)
+		}
+		// Avoid overflow below. A count this large could never match len(data) anyway.
+		if hdr.count > 1<<48 {
+			return hdr, fmt.Errorf("swisstable: count %d too large", hdr.count)
+		}
+		want = binaryHeaderSize + hdr.count*binarySlotSize
+	default:
+		return hdr, fmt.Errorf("swisstable: unknown binary kind %d", hdr.kind)
+	}
+	if uint64(len(data)) != want {
+		return hdr, fmt.Errorf("swisstable: binary data is %d bytes, want %d", len(data), want)
+	}
+	return hdr, nil
+}
+
+// controlFromV1 returns a copy of control bytes from version 1, converted to the current encoding.
+// Invalid version 1 control bytes are converted to invalid control bytes.
+func controlFromV1(control []byte) []byte {
+	converted := make([]byte, len(control))
+	for i, c := range control {
+		switch {
+		case c == 0xFF:
+			converted[i] = emptySentinel
+		case c == 0x80:
+			converted[i] = deletedSentinel
+		case c&0x80 == 0:
+			converted[i] = c | 0x80
+		default:
+			converted[i] = c &^ 0x80
+		}
+	}
+	return converted
+}
+
+// hashFingerprint summarizes how hashFunc hashes keys with seed.
+// Two hash functions with the same fingerprint are very likely to place keys identically.
+// A nil hashFunc is the default hash function that a zero Map will use.
+func hashFingerprint(hashFunc hashFunc, seed uintptr) uint64 {
+	if hashFunc == nil {
+		hashFunc = hashUint64
+	}
+	var fp uint64
+	for _, k := range [...]Key{0, 1, -1, 42, 1 << 20, 1 << 40, 0x5bd1e9955bd1e995} {
+		fp = mix64(fp ^ hashFunc(k, seed))
+	}
+	return fp
+}
+
+func putSlot(b []byte, kv KV) {
+	binary.LittleEndian.PutUint64(b, uint64(kv.Key))
+	binary.LittleEndian.PutUint64(b[8:], uint64(kv.Value))
+}
+
+func getSlot(b []byte) KV {
+	return KV{
+		Key:   Key(binary.LittleEndian.Uint64(b)),
+		Value: Value(binary.LittleEndian.Uint64(b[8:])),
+	}
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+// If m is not growing, the encoding preserves the table layout, which
+// allows UnmarshalBinary to load it without re-inserting each key.
+// That only happens if the receiving Map hashes keys the same way. The default
+// runtime hash differs in each process, so data written by a Map with default options
+// is always re-inserted when loaded in another process. To keep the fast path across
+// processes, create both Maps with PortableHash.
+func (m *Map) MarshalBinary() ([]byte, error) {
+	// Like Get, we are a reader, so we could be racing with a writer.
+	if m.flags&hashWriting != 0 {
+		fatal("concurrent map read and map write")
+	}
+	if m.current.chunks == nil {
+		// A zero Map does not have a table layout yet.
+		return m.marshalEntries(), nil
+	}
+	if m.old == nil {
+		hdr := m.layoutHeader()
+		tableSize := m.current.size()
+		data := make([]byte, binaryHeaderSize+tableSize*(1+binarySlotSize))
+		hdr.put(data)
+		b := data[binaryHeaderSize+tableSize:]
+		pos := 0
+		for ci := range m.current.chunks {
+			control := m.layoutControl(ci)
+			copy(data[binaryHeaderSize+pos:], control)
+			for i, c := range control {
+				// Leave the slots for EMPTY and DELETED as zeros, rather than writing
+				// whatever stale key/value might be there.
+				if isStored(c) {
+					putSlot(b[(pos+i)*binarySlotSize:], *m.current.chunks[ci].slot(uint64(i)))
+				}
+			}
+			pos += len(control)
+		}
+		return data, nil
+	}
+
+	// We are growing.
+	return m.marshalEntries(), nil
+}
+
+// layoutHeader returns the header for the layout kind.
+// It expects m is not growing.
+func (m *Map) layoutHeader() binaryHeader {
+	return binaryHeader{
+		version:     binaryVersion,
+		kind:        binaryLayout,
+		fingerprint: hashFingerprint(m.hashFunc, m.seed),
+		seed:        uint64(m.seed),
+		tableSize:   uint64(m.current.size()),
+		count:       uint64(m.elemCount),
+		deleteCount: uint64(m.current.deleteCount),
+	}
+}
+
+// marshalEntries returns the binary encoding of m using the entries kind.
+func (m *Map) marshalEntries() []byte {
+	hdr := binaryHeader{
+		version:     binaryVersion,
+		kind:        binaryEntries,
+		fingerprint: hashFingerprint(m.hashFunc, m.seed),
+		seed:        uint64(m.seed),
+		tableSize:   uint64(m.current.size()),
+		count:       uint64(m.elemCount),
+	}
+	data := make([]byte, binaryHeaderSize+m.elemCount*binarySlotSize)
+	hdr.put(data)
+	b := data[binaryHeaderSize:]
+	m.Range(func(k Key, v Value) bool {
+		putSlot(b, KV{Key: k, Value: v})
+		b = b[binarySlotSize:]
+		return true
+	})
+	return data
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// It replaces the contents of m. Options such as the hash function are kept.
+// m may also be a zero Map, such as one allocated by a decoder,
+// in which case it uses the default hash function. If m's hash function
+// matches the hash function that wrote data, m also adopts the seed from
+// data and loads the table layout directly, after checking that each key is
+// where a lookup will find it. Otherwise, each key/value is re-inserted.
+//
+// If data is invalid, UnmarshalBinary returns an error, and m might
+// be left holding some of the key/values from data.
+func (m *Map) UnmarshalBinary(data []byte) error {
+	hdr, err := parseBinaryHeader(data)
+	if err != nil {
+		return err
+	}
+
+	m.beginWrite()
+	defer m.endWrite()
+	m.initDefaults()
+
+	// Compare against the hash function we will use after reset.
+	hashFunc := m.hashFunc
+	if m.baseHashFunc != nil {
+		hashFunc = m.baseHashFunc
+	}
+
+	tableSize := int(hdr.tableSize)
+	payload := data[binaryHeaderSize:]
+	if hdr.kind == binaryLayout && hdr.version == binaryVersionV1 {
+		// Convert the control bytes to our current encoding, without modifying data.
+		payload = append(controlFromV1(payload[:tableSize]), payload[tableSize:]...)
+	}
+	switch {
+	case hdr.kind == binaryLayout && hashFingerprint(hashFunc, uintptr(hdr.seed)) == hdr.fingerprint:
+		// Fast path. Use the layout as is, if it is valid for our hash function.
+		control, b := payload[:tableSize], payload[tableSize:]
+		var stored, deleted int
+		for _, c := range control {
+			switch {
+			case c == emptySentinel:
+			case c == deletedSentinel:
+				deleted++
+			case isStored(c):
+				stored++
+			default:
+				return fmt.Errorf("swisstable: invalid control byte %#x", c)
+			}
+		}
+		if uint64(stored) != hdr.count || uint64(deleted) != hdr.deleteCount {
+			return fmt.Errorf("swisstable: control bytes have %d stored and %d deleted, want %d and %d",
+				stored, deleted, hdr.count, hdr.deleteCount)
+		}
+
+		m.seed = uintptr(hdr.seed)
+		m.reset(tableSize)
+		for i, c := range control {
+			// Skip EMPTY so that we only allocate the chunks that are used.
+			if c == emptySentinel {
+				continue
+			}
+			group, offset := uint64(i/16), i%16
+			m.current.setControl(group, offset, c)
+			if isStored(c) {
+				*m.current.slot(group, offset) = getSlot(b[i*binarySlotSize:])
+			}
+		}
+		m.current.deleteCount = deleted
+		m.elemCount = stored
+
+		// The data is untrusted, so check that a lookup finds each key where it is stored,
+		// and that keys are unique. Otherwise, Get could miss keys and Set could add duplicates.
+		// If the layout is not valid, we re-insert its key/values.
+		if _, err := checkTable("current", &m.current, func(k Key) uint64 { return m.hashFunc(k, m.seed) }); err != nil {
+			m.insertLayout(control, b)
+		} else if m.small {
+			m.fromLayout()
+		}
+
+	case hdr.kind == binaryLayout:
+		// Slow path. Re-insert each stored key/value using our hash function and seed.
+		m.insertLayout(payload[:tableSize], payload[tableSize:])
+
+	default:
+		// Entries. Pre-size for count, which parseBinaryHeader checked against the length
+		// of data, rather than trusting the table size in the header, and re-insert.
+		m.reset(calcTableSize(int(hdr.count)))
+		for i := 0; i < int(hdr.count); i++ {
+			kv := getSlot(payload[i*binarySlotSize:])
+			m.set(kv.Key, kv.Value, 1, true)
+		}
+	}
+
+	if m.swmr {
+		m.publish()
+	}
+	if uint64(m.elemCount) != hdr.count {
+		// Most likely duplicate keys.
+		return fmt.Errorf("swisstable: loaded %d key/values, want %d", m.elemCount, hdr.count)
+	}
+	return nil
+}
+
+// insertLayout replaces the contents of m by re-inserting each stored key/value
+// of a layout with m's hash function and seed.
+func (m *Map) insertLayout(control, slots []byte) {
+	m.reset(len(control))
+	for i, c := range control {
+		if isStored(c) {
+			kv := getSlot(slots[i*binarySlotSize:])
+			m.set(kv.Key, kv.Value, 1, true)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package swisstable
+
+import (
+	"encoding"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = (*Map)(nil)
+	_ encoding.BinaryUnmarshaler = (*Map)(nil)
+)
+
+func TestMap_MarshalBinary(t *testing.T) {
+	tests := []struct {
+		name       string
+		build      func() *Map
+		receiver   func() *Map
+		wantKind   uint8
+		wantLayout bool // expect the receiver to have the identical layout
+	}{
+		{
+			name: "same hash, with deletes",
+			build: func() *Map {
+				m := New(100)
+				for k := Key(0); k < 100; k++ {
+					m.Set(k, Value(k*10))
+				}
+				for k := Key(0); k < 100; k += 3 {
+					m.Delete(k)
+				}
+				return m
+			},
+			receiver:   func() *Map { return New(0) },
+			wantKind:   binaryLayout,
+			wantLayout: true,
+		},
+		{
+			name: "same weak hash",
+			build: func() *Map {
+				m := New(0, WithHashFunc(zeroHash))
+				for k := Key(0); k < 10; k++ {
+					m.Set(k, Value(k))
+				}
+				m.Delete(3)
+				return m
+			},
+			receiver:   func() *Map { return New(0, WithHashFunc(zeroHash)) },
+			wantKind:   binaryLayout,
+			wantLayout: true,
+		},
+		{
+			// Unlike the default hash, PortableHash keeps the layout across processes.
+			name: "portable hash",
+			build: func() *Map {
+				m := New(100, PortableHash())
+				for k := Key(0); k < 100; k++ {
+					m.Set(k, Value(k))
+				}
+				return m
+			},
+			receiver:   func() *Map { return New(0, PortableHash()) },
+			wantKind:   binaryLayout,
+			wantLayout: true,
+		},
+		{
+			name: "different hash",
+			build: func() *Map {
+				m := New(0, WithHashFunc(identityHash))
+				for k := Key(0); k < 100; k++ {
+					m.Set(k, Value(k))
+				}
+				return m
+			},
+			receiver: func() *Map { return New(1000) },
+			wantKind: binaryLayout,
+		},
+		{
+			name: "growing",
+			build: func() *Map {
+				m := New(20_000) // resize threshold of 26624
+				for k := Key(0); k < 26_625; k++ {
+					m.Set(k, Value(k))
+				}
+				if m.old == nil {
+					panic("expected to be growing")
+				}
+				return m
+			},
+			receiver: func() *Map { return New(0) },
+			wantKind: binaryEntries,
+		},
+		{
+			name: "after flood rehash",
+			build: func() *Map {
+				m := New(1024, WithHashFunc(identityHash))
+				for i := 0; i < 1000; i++ {
+					m.Set(Key(i)<<20, Value(i))
+				}
+				m.finishGrowForTest()
+				if m.floodRehashes == 0 {
+					panic("expected a flood rehash")
+				}
+				return m
+			},
+			receiver: func() *Map { return New(0, WithHashFunc(identityHash)) },
+			wantKind: binaryLayout,
+		},
+		{
+			name:       "empty",
+			build:      func() *Map { return New(0) },
+			receiver:   func() *Map { return New(0) },
+			wantKind:   binaryLayout,
+			wantLayout: true,
+		},
+		{
+			name: "single writer receiver",
+			build: func() *Map {
+				m := New(0)
+				for k := Key(0); k < 50; k++ {
+					m.Set(k, Value(k))
+				}
+				return m
+			},
+			receiver:   func() *Map { return New(0, SingleWriter()) },
+			wantKind:   binaryLayout,
+			wantLayout: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.build()
+			want := make(map[Key]Value)
+			m.Range(func(k Key, v Value) bool {
+				want[k] = v
+				return true
+			})
+
+			data, err := m.MarshalBinary()
+			if err != nil {
+				t.Fatalf("Map.MarshalBinary() error: %v", err)
+			}
+			if data[6] != tt.wantKind {
+				t.Errorf("Map.MarshalBinary() kind = %d, want %d", data[6], tt.wantKind)
+			}
+
+			m2 := tt.receiver()
+			m2.Set(-1, -1) // should be replaced
+			if err := m2.UnmarshalBinary(data); err != nil {
+				t.Fatalf("Map.UnmarshalBinary() error: %v", err)
+			}
+
+			if m2.Len() != len(want) {
+				t.Errorf("Map.Len() = %d, want %d", m2.Len(), len(want))
+			}
+			for k, v := range want {
+				got, ok := m2.Get(k)
+				if !ok || got != v {
+					t.Errorf("Map.Get(%v) = %v, %v, want %v, true", k, got, ok, v)
+				}
+			}
+			if _, ok := m2.Get(-1); ok {
+				t.Errorf("Map.Get(-1) found key that should have been replaced")
+			}
+			got := make(map[Key]Value)
+			m2.Range(func(k Key, v Value) bool {
+				got[k] = v
+				return true
+			})
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Map.Range() after UnmarshalBinary mismatch (-want +got):\n%s", diff)
+			}
+
+			if tt.wantLayout {
+				if m2.seed != m.seed {
+					t.Errorf("seed = %v, want %v", m2.seed, m.seed)
+				}
+				if diff := cmp.Diff(tableControl(&m.current), tableControl(&m2.current)); diff != "" {
+					t.Errorf("control bytes mismatch (-want +got):\n%s", diff)
+				}
+				if m2.current.deleteCount != m.current.deleteCount {
+					t.Errorf("deleteCount = %d, want %d", m2.current.deleteCount, m.current.deleteCount)
+				}
+			}
+
+			// The loaded map should keep working, including growing.
+			for k := Key(1_000_000); k < 1_000_000+1000; k++ {
+				m2.Set(k, Value(k))
+			}
+			for k, v := range want {
+				if got, ok := m2.Get(k); !ok || got != v {
+					t.Fatalf("Map.Get(%v) after more Sets = %v, %v, want %v, true", k, got, ok, v)
+				}
+			}
+			if m2.Len() != len(want)+1000 {
+				t.Errorf("Map.Len() after more Sets = %d, want %d", m2.Len(), len(want)+1000)
+			}
+		})
+	}
+}
+
+// finishGrowForTest completes any in-progress grow.
+func (m *Map) finishGrowForTest() {
+	if m.old != nil {
+		m.beginWrite()
+		m.finishGrow()
+		m.endWrite()
+	}
+}
+
+func TestMap_UnmarshalBinaryErrors(t *testing.T) {
+	m := New(0)
+	for k := Key(0); k < 10; k++ {
+		m.Set(k, Value(k))
+	}
+	valid, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// modify returns a copy of valid after applying f.
+	modify := func(f func(b []byte) []byte) []byte {
+		b := append([]byte(nil), valid...)
+		return f(b)
+	}
+	firstStored := func(b []byte) int {
+		for i, c := range b[binaryHeaderSize : binaryHeaderSize+16] {
+			if isStored(c) {
+				return binaryHeaderSize + i
+			}
+		}
+		panic("no stored control byte")
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"empty", nil, "too short"},
+		{"bad magic", modify(func(b []byte) []byte { b[0] = 'X'; return b }), "bad magic"},
+		{"bad version", modify(func(b []byte) []byte { b[4] = 99; return b }), "unsupported binary version"},
+		{"bad kind", modify(func(b []byte) []byte { b[6] = 99; return b }), "unknown binary kind"},
+		{"truncated", valid[:len(valid)-1], "want"},
+		{"bad table size", modify(func(b []byte) []byte {
+			binary.LittleEndian.PutUint64(b[24:], 24)
+			return b
+		}), "invalid table size"},
+		{"count too large", modify(func(b []byte) []byte {
+			binary.LittleEndian.PutUint64(b[32:], 16)
+			return b
+		}), "too large"},
+		{"count mismatch", modify(func(b []byte) []byte {
+			binary.LittleEndian.PutUint64(b[32:], 11)
+			return b
+		}), "stored"},
+		{"bad control byte", modify(func(b []byte) []byte {
+			b[firstStored(b)] = 0x01
+			return b
+		}), "invalid control byte"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m2 := New(0)
+			err := m2.UnmarshalBinary(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Map.UnmarshalBinary() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMap_UnmarshalBinaryHugeTableSize(t *testing.T) {
+	// The table size in the header is untrusted. For entries, we size from the count instead,
+	// and for a layout, the payload must hold the whole table.
+	tests := []struct {
+		name      string
+		kind      uint8
+		tableSize uint64
+		wantErr   string
+	}{
+		{"entries, 1<<40", binaryEntries, 1 << 40, ""},
+		{"entries, 1<<48", binaryEntries, 1 << 48, ""},
+		{"entries, 1<<63", binaryEntries, 1 << 63, ""},
+		{"layout, 1<<40", binaryLayout, 1 << 40, "want"},
+		{"layout, 1<<63", binaryLayout, 1 << 63, "invalid table size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := binaryHeader{version: binaryVersion, kind: tt.kind, tableSize: tt.tableSize, count: 1}
+			data := make([]byte, binaryHeaderSize+binarySlotSize)
+			hdr.put(data)
+			putSlot(data[binaryHeaderSize:], KV{Key: 1, Value: 2})
+
+			m := New(0)
+			err := m.UnmarshalBinary(data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Map.UnmarshalBinary() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Map.UnmarshalBinary() error: %v", err)
+			}
+			if m.current.size() != 16 {
+				t.Errorf("table size = %d, want 16", m.current.size())
+			}
+			if v, ok := m.Get(1); !ok || v != 2 {
+				t.Errorf("Map.Get(1) = %d, %v, want 2, true", v, ok)
+			}
+		})
+	}
+}
+
+func TestMap_UnmarshalBinaryDuplicates(t *testing.T) {
+	// Entries with duplicate keys are reported as an error.
+	hdr := binaryHeader{
+		version:   binaryVersion,
+		kind:      binaryEntries,
+		tableSize: 16,
+		count:     2,
+	}
+	data := make([]byte, binaryHeaderSize+2*binarySlotSize)
+	hdr.put(data)
+	putSlot(data[binaryHeaderSize:], KV{Key: 1, Value: 1})
+	putSlot(data[binaryHeaderSize+binarySlotSize:], KV{Key: 1, Value: 2})
+
+	m := New(0)
+	err := m.UnmarshalBinary(data)
+	if err == nil || !strings.Contains(err.Error(), "loaded 1 key/values, want 2") {
+		t.Errorf("Map.UnmarshalBinary() error = %v, want duplicate key error", err)
+	}
+}
+
+func TestMap_UnmarshalBinaryV1(t *testing.T) {
+	// Build a version 1 layout from a current layout by converting the control bytes back.
+	m := New(0, WithSeed(1))
+	for k := Key(0); k < 100; k++ {
+		m.Set(k, Value(k*2))
+	}
+	for k := Key(0); k < 100; k += 3 {
+		m.Delete(k)
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Map.MarshalBinary() error: %v", err)
+	}
+	binary.LittleEndian.PutUint16(data[4:], binaryVersionV1)
+	tableSize := m.current.size()
+	for i, c := range data[binaryHeaderSize : binaryHeaderSize+tableSize] {
+		switch {
+		case c == emptySentinel:
+			c = 0xFF
+		case c == deletedSentinel:
+			c = 0x80
+		default:
+			c &^= 0x80
+		}
+		data[binaryHeaderSize+i] = c
+	}
+
+	// Both the fast path and the re-insert path convert the control bytes.
+	for _, seed := range []uintptr{1, 2} {
+		got := New(0, WithSeed(seed))
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("Map.UnmarshalBinary() error: %v", err)
+		}
+		if got.Len() != m.Len() {
+			t.Errorf("Map.Len() = %d, want %d", got.Len(), m.Len())
+		}
+		for k := Key(0); k < 100; k++ {
+			want, wantOk := m.Get(k)
+			if v, ok := got.Get(k); v != want || ok != wantOk {
+				t.Errorf("Map.Get(%d) = %d, %v, want %d, %v", k, v, ok, want, wantOk)
+			}
+		}
+	}
+}
+
+func TestMap_UnmarshalBinaryBadPlacement(t *testing.T) {
+	// A layout with the right hash fingerprint but keys that are not where a lookup
+	// would find them must not be adopted as is.
+	m := New(100, WithHashFunc(identityHash))
+	for k := Key(0); k < 40; k++ {
+		m.Set(k, Value(k))
+	}
+	valid, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableSize := m.current.size()
+	control := func(b []byte, i int) *byte { return &b[binaryHeaderSize+i] }
+	slot := func(b []byte, i int) []byte { return b[binaryHeaderSize+tableSize+i*binarySlotSize:] }
+	storedAt := func(b []byte, k Key) int {
+		for i := 0; i < tableSize; i++ {
+			if isStored(*control(b, i)) && getSlot(slot(b, i)).Key == k {
+				return i
+			}
+		}
+		panic("key not stored")
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(b []byte)
+		want    map[Key]Value
+		wantErr string
+	}{
+		{
+			// Key 1 replaces key 0 in group 0, which is not in key 1's probe chain.
+			name: "wrong group",
+			modify: func(b []byte) {
+				i, j := storedAt(b, 0), storedAt(b, 1)
+				*control(b, i) = *control(b, j)
+				putSlot(slot(b, i), KV{Key: 1, Value: 1})
+				*control(b, j) = emptySentinel
+				binary.LittleEndian.PutUint64(b[32:], 39)
+			},
+			want: func() map[Key]Value {
+				want := make(map[Key]Value)
+				for k := Key(1); k < 40; k++ {
+					want[k] = Value(k)
+				}
+				return want
+			}(),
+		},
+		{
+			// Key 2 becomes a second copy of key 3, with the h2 of key 2.
+			name: "duplicate key",
+			modify: func(b []byte) {
+				putSlot(slot(b, storedAt(b, 2)), KV{Key: 3, Value: 3})
+			},
+			wantErr: "loaded 39 key/values, want 40",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), valid...)
+			tt.modify(data)
+			got := New(0, WithHashFunc(identityHash))
+			err := got.UnmarshalBinary(data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Map.UnmarshalBinary() error = %v, want error containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Map.UnmarshalBinary() error: %v", err)
+			}
+			if err := got.CheckInvariants(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				return
+			}
+			if diff := cmp.Diff(tt.want, contents(got)); diff != "" {
+				t.Errorf("contents mismatch (-want +got):\n%s", diff)
+			}
+			for k, v := range tt.want {
+				if gotV, ok := got.Get(k); !ok || gotV != v {
+					t.Errorf("Map.Get(%d) = %d, %v, want %d, true", k, gotV, ok, v)
+				}
+			}
+		})
+	}
+}
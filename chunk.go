@@ -0,0 +1,152 @@
+package swisstable
+
+import "unsafe"
+
+// Segmented tables.
+//
+// A fixedTable stores its control bytes and slots in fixed-size chunks, indexed by group,
+// rather than in one contiguous allocation for each. For a huge map, this avoids
+// single allocations of hundreds of MiB (including when growing doubles the table size),
+// which otherwise requires the runtime to find huge spans and means a presized
+// map pays for zeroing its full size up front.
+//
+// Tables with at most maxChunkGroups groups use a single chunk covering the whole table,
+// which is allocated immediately. Larger tables use chunks of maxChunkGroups groups, which are
+// allocated lazily on the first write to the chunk. Until then, a chunk shares the read-only
+// emptyChunkControl and has nil slots, which means lookups need no extra checks for
+// unallocated chunks (because they find only EMPTY control bytes, and never look at the slots).
+//
+// Because keys are spread across groups by the hash, inserting new keys allocates chunks quickly,
+// but growth is still spread across multiple smaller allocations.
+// TODO: could release chunks of old as they are fully evacuated while growing,
+// though iterators can still be using old.
+
+// maxChunkShift is log2 of maxChunkGroups.
+const maxChunkShift = 12
+
+// maxChunkGroups is the number of groups per chunk for tables with multiple chunks.
+// This is 65536 slots per chunk, or 1MiB of slots and 64KiB of control bytes.
+const maxChunkGroups = 1 << maxChunkShift
+
+// tableChunk holds the control bytes and slots for a contiguous range of groups in a fixedTable.
+// We use unsafe pointers rather than slices so that finding a group's control bytes and slots
+// costs a single extra load of the chunk (which is usually cached) compared to a single
+// contiguous table, without any bounds checks. The length of each is the table's chunkSize.
+// The pointers keep the underlying allocations alive.
+type tableChunk struct {
+	control unsafe.Pointer // *[chunkSize]byte
+	slots   unsafe.Pointer // *[chunkSize]KV, or nil if not yet allocated
+}
+
+// emptyChunkControl is shared by unallocated chunks. Its zeroed control bytes are all EMPTY.
+// It must never be written.
+var emptyChunkControl = make([]byte, maxChunkGroups*16)
+
+// lazyChunk returns a chunk that is not yet allocated.
+func lazyChunk() tableChunk {
+	return tableChunk{control: unsafe.Pointer(&emptyChunkControl[0])}
+}
+
+// allocated reports whether c has its own control bytes and slots.
+func (c *tableChunk) allocated() bool {
+	return c.slots != nil
+}
+
+// alloc allocates the control bytes and slots for c, which has chunkSize slots.
+// It is rarely called, so we keep it out of line.
+//
+//go:noinline
+func (c *tableChunk) alloc(chunkSize int) {
+	// The zeroed control bytes are all EMPTY.
+	control := make([]byte, chunkSize)
+	slots := make([]KV, chunkSize)
+	*c = tableChunk{control: unsafe.Pointer(&control[0]), slots: unsafe.Pointer(&slots[0])}
+}
+
+// groupControl returns the 16 control bytes for the group starting at pos within c.
+func (c *tableChunk) groupControl(pos uint64) []byte {
+	return (*[16]byte)(unsafe.Add(c.control, pos))[:]
+}
+
+// controlAt returns the control byte at i within c.
+func (c *tableChunk) controlAt(i uint64) *byte {
+	return (*byte)(unsafe.Add(c.control, i))
+}
+
+// slot returns the slot at i within c.
+func (c *tableChunk) slot(i uint64) *KV {
+	return (*KV)(unsafe.Add(c.slots, i*uint64(unsafe.Sizeof(KV{}))))
+}
+
+// allocChunk allocates the control bytes and slots for chunk c of t,
+// using t's Allocator if it has one.
+func (t *fixedTable) allocChunk(c *tableChunk) {
+	if t.mem != nil {
+		c.allocIn(t.chunkSize(), t.mem)
+		return
+	}
+	c.alloc(t.chunkSize())
+}
+
+// locate returns the chunk holding group, along with the position of
+// the first slot of group within that chunk.
+func (t *fixedTable) locate(group uint64) (*tableChunk, uint64) {
+	return &t.chunks[group>>t.chunkShift], (group & t.chunkGroupMask) * 16
+}
+
+// groupControl returns the 16 control bytes for group.
+func (t *fixedTable) groupControl(group uint64) []byte {
+	c, pos := t.locate(group)
+	return c.groupControl(pos)
+}
+
+// slot returns the slot at offset within group.
+func (t *fixedTable) slot(group uint64, offset int) *KV {
+	c, pos := t.locate(group)
+	return c.slot(pos + uint64(offset))
+}
+
+// setControl sets the control byte at offset within group,
+// allocating the chunk holding group if needed.
+func (t *fixedTable) setControl(group uint64, offset int, b byte) {
+	c, pos := t.locate(group)
+	if !c.allocated() {
+		t.allocChunk(c)
+	}
+	*c.controlAt(pos + uint64(offset)) = b
+}
+
+// allocChunks allocates any chunks of t that are not yet allocated.
+func (t *fixedTable) allocChunks() {
+	for i := range t.chunks {
+		if c := &t.chunks[i]; !c.allocated() {
+			t.allocChunk(c)
+		}
+	}
+}
+
+// chunkControl returns the control bytes of chunk i.
+func (t *fixedTable) chunkControl(i int) []byte {
+	return unsafe.Slice((*byte)(t.chunks[i].control), t.chunkSize())
+}
+
+// chunkSlots returns the slots of chunk i, which must be allocated.
+func (t *fixedTable) chunkSlots(i int) []KV {
+	return unsafe.Slice((*KV)(t.chunks[i].slots), t.chunkSize())
+}
+
+// chunkSize returns the number of slots per chunk.
+func (t *fixedTable) chunkSize() int {
+	return int(t.chunkGroupMask+1) * 16
+}
+
+// size returns the number of slots in t.
+func (t *fixedTable) size() int {
+	return int(t.groups()) * 16
+}
+
+// groups returns the number of groups in t.
+// The zero fixedTable of a zero Map has no chunks, and hence no groups.
+func (t *fixedTable) groups() uint64 {
+	return uint64(len(t.chunks)) << t.chunkShift
+}
@@ -0,0 +1,198 @@
+package swisstable
+
+import (
+	"testing"
+)
+
+// tableControl returns a copy of the control bytes of t as a single slice.
+func tableControl(t *fixedTable) []byte {
+	var control []byte
+	for i := range t.chunks {
+		control = append(control, t.chunkControl(i)...)
+	}
+	return control
+}
+
+// tableSlots returns a copy of the slots of t as a single slice,
+// with zero key/values for chunks that are not yet allocated.
+func tableSlots(t *fixedTable) []KV {
+	var slots []KV
+	for i := range t.chunks {
+		if t.chunks[i].allocated() {
+			slots = append(slots, t.chunkSlots(i)...)
+		} else {
+			slots = append(slots, make([]KV, t.chunkSize())...)
+		}
+	}
+	return slots
+}
+
+// allocatedChunks returns the number of allocated chunks in t.
+func allocatedChunks(t *fixedTable) int {
+	n := 0
+	for i := range t.chunks {
+		if t.chunks[i].allocated() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestNewFixedTable_Chunks(t *testing.T) {
+	tests := []struct {
+		tableSize     int
+		wantChunks    int
+		wantAllocated int
+	}{
+		{16, 1, 1},
+		{maxChunkGroups * 16, 1, 1},
+		{maxChunkGroups * 32, 2, 0},
+		{maxChunkGroups * 16 * 64, 64, 0},
+	}
+	for _, tt := range tests {
+		ft := newFixedTable(tt.tableSize)
+		if len(ft.chunks) != tt.wantChunks {
+			t.Errorf("newFixedTable(%d) has %d chunks, want %d", tt.tableSize, len(ft.chunks), tt.wantChunks)
+		}
+		if got := allocatedChunks(ft); got != tt.wantAllocated {
+			t.Errorf("newFixedTable(%d) has %d allocated chunks, want %d", tt.tableSize, got, tt.wantAllocated)
+		}
+		if ft.size() != tt.tableSize || len(tableControl(ft)) != tt.tableSize {
+			t.Errorf("newFixedTable(%d) size = %d with %d control bytes", tt.tableSize, ft.size(), len(tableControl(ft)))
+		}
+		for i, c := range tableControl(ft) {
+			if c != emptySentinel {
+				t.Fatalf("newFixedTable(%d) control byte %d = %#x, want EMPTY", tt.tableSize, i, c)
+			}
+		}
+		// Each group should map to its own control bytes and slots.
+		for _, g := range []uint64{0, ft.groupMask / 2, ft.groupMask} {
+			ft.setControl(g, 3, 0x11)
+			*ft.slot(g, 3) = KV{Key: Key(g), Value: 1}
+			control, slots := tableControl(ft), tableSlots(ft)
+			if control[g*16+3] != 0x11 || slots[g*16+3] != (KV{Key: Key(g), Value: 1}) {
+				t.Errorf("newFixedTable(%d) set of group %d did not land at position %d", tt.tableSize, g, g*16+3)
+			}
+		}
+	}
+	for i, c := range emptyChunkControl {
+		if c != emptySentinel {
+			t.Fatalf("emptyChunkControl[%d] = %#x, want EMPTY", i, c)
+		}
+	}
+}
+
+func TestMap_LazyChunks(t *testing.T) {
+	// A presized map only allocates the chunks it uses.
+	m := New(maxChunkGroups * 16 * 2) // 4 chunks
+	if got := len(m.current.chunks); got != 4 {
+		t.Fatalf("got %d chunks, want 4", got)
+	}
+	if got := allocatedChunks(&m.current); got != 0 {
+		t.Errorf("new map has %d allocated chunks, want 0", got)
+	}
+	if got, want := m.MemoryUsage().Total, chunkHeaderBytes(&m.current); got != want {
+		t.Errorf("new map MemoryUsage().Total = %d, want %d", got, want)
+	}
+	m.Set(1, 1)
+	if got := allocatedChunks(&m.current); got != 1 {
+		t.Errorf("map with one key has %d allocated chunks, want 1", got)
+	}
+	if got, want := m.MemoryUsage().Total, maxChunkGroups*16*17+chunkHeaderBytes(&m.current); got != want {
+		t.Errorf("map with one key MemoryUsage().Total = %d, want %d", got, want)
+	}
+	for k := Key(0); k < 1000; k++ {
+		if v, ok := m.Get(k); ok != (k == 1) || (ok && v != 1) {
+			t.Fatalf("Map.Get(%v) = %v, %v", k, v, ok)
+		}
+	}
+
+	// Fill, delete, and grow across multiple chunks.
+	const n = 400_000
+	for k := Key(0); k < n; k++ {
+		m.Set(k, Value(k))
+	}
+	for k := Key(0); k < n; k += 3 {
+		m.Delete(k)
+	}
+	if len(m.current.chunks) != 8 {
+		t.Errorf("got %d chunks after growing, want 8", len(m.current.chunks))
+	}
+	want := n - (n+2)/3
+	if m.Len() != want {
+		t.Errorf("Map.Len() = %d, want %d", m.Len(), want)
+	}
+	for k := Key(0); k < n; k++ {
+		v, ok := m.Get(k)
+		if ok != (k%3 != 0) || (ok && v != Value(k)) {
+			t.Fatalf("Map.Get(%v) = %v, %v", k, v, ok)
+		}
+	}
+	got := 0
+	m.Range(func(k Key, v Value) bool {
+		if k%3 == 0 || v != Value(k) {
+			t.Fatalf("Map.Range() emitted %v, %v", k, v)
+		}
+		got++
+		return true
+	})
+	if got != want {
+		t.Errorf("Map.Range() emitted %d key/values, want %d", got, want)
+	}
+}
+
+func TestMap_LazyChunksNeverWritten(t *testing.T) {
+	// Deletes and grows that reach chunks that were never written must leave the
+	// shared emptyChunkControl all EMPTY, which CheckInvariants checks.
+	m := New(maxChunkGroups*16*2, WithHashFunc(identityHash), WithSeed(42)) // 4 chunks
+	for k := Key(0); k < 100_000; k++ {
+		m.Delete(k)
+	}
+	if err := m.CheckInvariants(); err != nil {
+		t.Fatalf("after deleting missing keys: %v", err)
+	}
+
+	// With identityHash, these keys all share group 0 and the same h2, which starts
+	// a rehash into a new table of the same size. Moving groups from old then walks
+	// the chunks of old that were never written.
+	key := func(i int) Key { return Key(i) << 20 }
+	sawUnallocatedOld := false
+	for i := 0; i < 1000; i++ {
+		m.Set(key(i), Value(i))
+		if m.old != nil && allocatedChunks(m.old) < len(m.old.chunks) {
+			sawUnallocatedOld = true
+		}
+		if i%50 == 0 {
+			if err := m.CheckInvariants(); err != nil {
+				t.Fatalf("after Set of %d keys: %v", i+1, err)
+			}
+		}
+	}
+	if m.floodRehashes == 0 || !sawUnallocatedOld {
+		t.Fatalf("got %d flood rehashes, and saw unallocated chunks in old %v; want both", m.floodRehashes, sawUnallocatedOld)
+	}
+	for i := 0; i < 1000; i += 2 {
+		m.Delete(key(i))
+		m.Delete(key(i) + 1) // missing
+	}
+	if err := m.CheckInvariants(); err != nil {
+		t.Fatalf("after deletes: %v", err)
+	}
+	if m.Len() != 500 {
+		t.Errorf("Map.Len() = %d, want 500", m.Len())
+	}
+}
+
+func TestMap_LazyChunksSingleWriter(t *testing.T) {
+	// In SWMR mode, readers must not see chunks being allocated, so all chunks are allocated up front.
+	m := New(maxChunkGroups*16*2, SingleWriter())
+	if got, want := allocatedChunks(&m.current), len(m.current.chunks); got != want {
+		t.Errorf("got %d allocated chunks, want %d", got, want)
+	}
+	for k := Key(0); k < 500_000; k++ {
+		m.Set(k, Value(k))
+		if m.old != nil && allocatedChunks(&m.current) != len(m.current.chunks) {
+			t.Fatalf("growing map has unallocated chunks")
+		}
+	}
+}
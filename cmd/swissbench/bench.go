@@ -0,0 +1,263 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/thepudds/swisstable"
+)
+
+// The benchmark families mirror the paired _Std and _Swiss benchmarks in map_test.go.
+// Each implementation has its own function so that both use direct calls
+// on the concrete map type, as in map_test.go.
+
+// family is a benchmark family, with a benchmark for each implementation for a given set of keys.
+// The number of keys is the map size.
+type family struct {
+	name  string
+	std   func(keys []int64) func(b *testing.B)
+	swiss func(keys []int64) func(b *testing.B)
+	// cold families are run once per count with -benchtime=1x. See coldMemFlag.
+	cold bool
+}
+
+var families = []family{
+	{name: "FillGrow", std: fillGrowStd, swiss: fillGrowSwiss},
+	{name: "FillPresize", std: fillPresizeStd, swiss: fillPresizeSwiss},
+	{name: "GetHitHot", std: getHitHotStd, swiss: getHitHotSwiss},
+	{name: "GetMissHot", std: getMissHotStd, swiss: getMissHotSwiss},
+	{name: "GetAllStartCold", std: getAllStartColdStd, swiss: getAllStartColdSwiss, cold: true},
+	{name: "Range", std: rangeStd, swiss: rangeSwiss},
+}
+
+var (
+	sinkInt   int64
+	sinkValue swisstable.Value
+	sinkBool  bool
+)
+
+func fillGrowStd(keys []int64) func(b *testing.B) {
+	return func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m := make(map[int64]int64, 10)
+			for _, k := range keys {
+				m[k] = k
+			}
+		}
+	}
+}
+
+func fillGrowSwiss(keys []int64) func(b *testing.B) {
+	return func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m := swisstable.New(10)
+			for _, k := range keys {
+				m.Set(swisstable.Key(k), swisstable.Value(k))
+			}
+		}
+	}
+}
+
+func fillPresizeStd(keys []int64) func(b *testing.B) {
+	return func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m := make(map[int64]int64, len(keys))
+			for _, k := range keys {
+				m[k] = k
+			}
+		}
+	}
+}
+
+func fillPresizeSwiss(keys []int64) func(b *testing.B) {
+	return func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m := swisstable.New(len(keys))
+			for _, k := range keys {
+				m.Set(swisstable.Key(k), swisstable.Value(k))
+			}
+		}
+	}
+}
+
+const (
+	hotKeyCount   = 20
+	lookupEachKey = 50
+)
+
+// hotGets returns hotKeyCount keys picked by key, each repeated lookupEachKey times, then shuffled.
+func hotGets(key func(i int) int64) []int64 {
+	var gets []int64
+	for i := 0; i < hotKeyCount; i++ {
+		k := key(i)
+		for j := 0; j < lookupEachKey; j++ {
+			gets = append(gets, k)
+		}
+	}
+	rand.Shuffle(len(gets), func(i, j int) {
+		gets[i], gets[j] = gets[j], gets[i]
+	})
+	return gets
+}
+
+func hitKey(keys []int64) func(i int) int64 {
+	return func(i int) int64 { return keys[rand.Intn(len(keys))] }
+}
+
+func missKey(i int) int64 {
+	return int64(i + (1 << 40))
+}
+
+func getHotStd(keys []int64, key func(i int) int64) func(b *testing.B) {
+	return func(b *testing.B) {
+		m := make(map[int64]int64)
+		for _, k := range keys {
+			m[k] = k
+		}
+		gets := hotGets(key)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, key := range gets {
+				sinkInt, sinkBool = m[key]
+			}
+		}
+	}
+}
+
+func getHotSwiss(keys []int64, key func(i int) int64) func(b *testing.B) {
+	return func(b *testing.B) {
+		m := swisstable.New(len(keys))
+		for _, k := range keys {
+			m.Set(swisstable.Key(k), swisstable.Value(k))
+		}
+		gets := hotGets(key)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, key := range gets {
+				sinkValue, sinkBool = m.Get(swisstable.Key(key))
+			}
+		}
+	}
+}
+
+func getHitHotStd(keys []int64) func(b *testing.B)    { return getHotStd(keys, hitKey(keys)) }
+func getHitHotSwiss(keys []int64) func(b *testing.B)  { return getHotSwiss(keys, hitKey(keys)) }
+func getMissHotStd(keys []int64) func(b *testing.B)   { return getHotStd(keys, missKey) }
+func getMissHotSwiss(keys []int64) func(b *testing.B) { return getHotSwiss(keys, missKey) }
+
+// coldMapCount returns how many maps of size to create so that they
+// use at least coldMemFlag MB, which should be much larger than the L3 cache.
+// We don't include overhead so that the count of maps is the same for both implementations.
+func coldMapCount(size int) int {
+	return int(math.Ceil(*coldMemFlag * (1 << 20) / (float64(size) * 16)))
+}
+
+// shuffled returns a shuffled copy of keys.
+// We look up shuffled keys after filling the maps so that we don't favor early entrants in a given bucket.
+func shuffled(keys []int64) []int64 {
+	keys = append([]int64(nil), keys...)
+	rand.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	return keys
+}
+
+func getAllStartColdStd(keys []int64) func(b *testing.B) {
+	return func(b *testing.B) {
+		maps := make([]map[int64]int64, coldMapCount(len(keys)))
+		for i := range maps {
+			m := make(map[int64]int64, len(keys))
+			for _, k := range keys {
+				m[k] = k
+			}
+			maps[i] = m
+		}
+		gets := shuffled(keys)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, m := range maps {
+				for _, k := range gets {
+					sinkInt, sinkBool = m[k]
+				}
+			}
+		}
+	}
+}
+
+func getAllStartColdSwiss(keys []int64) func(b *testing.B) {
+	return func(b *testing.B) {
+		maps := make([]*swisstable.Map, coldMapCount(len(keys)))
+		for i := range maps {
+			m := swisstable.New(len(keys))
+			for _, k := range keys {
+				m.Set(swisstable.Key(k), swisstable.Value(k))
+			}
+			maps[i] = m
+		}
+		gets := shuffled(keys)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, m := range maps {
+				for _, k := range gets {
+					sinkValue, sinkBool = m.Get(swisstable.Key(k))
+				}
+			}
+		}
+	}
+}
+
+//go:noinline
+func iterStd(m map[int64]int64) int64 {
+	var ret int64
+	for _, a := range m {
+		ret += a
+	}
+	return ret
+}
+
+//go:noinline
+func iterSwiss(m *swisstable.Map) int64 {
+	var ret int64
+	m.Range(func(key swisstable.Key, value swisstable.Value) bool {
+		ret += int64(value)
+		return true
+	})
+	return ret
+}
+
+func rangeStd(keys []int64) func(b *testing.B) {
+	return func(b *testing.B) {
+		m := make(map[int64]int64)
+		for _, k := range keys {
+			m[k] = k
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			sinkInt += iterStd(m)
+		}
+	}
+}
+
+func rangeSwiss(keys []int64) func(b *testing.B) {
+	return func(b *testing.B) {
+		m := swisstable.New(10)
+		for _, k := range keys {
+			m.Set(swisstable.Key(k), swisstable.Value(k))
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			sinkInt += iterSwiss(m)
+		}
+	}
+}
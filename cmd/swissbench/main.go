@@ -0,0 +1,235 @@
+// Command swissbench runs the swisstable benchmark suite against the runtime map.
+//
+// It runs the FillGrow, FillPresize, GetHitHot, GetMissHot, GetAllStartCold and Range
+// benchmark families for the runtime map (std) and swisstable.Map (swiss) over a set of
+// map sizes, and writes std.txt and swiss.txt in the standard benchmark format, along
+// with a JSON summary. The two text files use the same benchmark names, so they can be
+// compared with benchstat to produce a table like the one in the README:
+//
+//	swissbench -sizes almostgrow -count 10 -o results
+//	benchstat results/std.txt results/swiss.txt
+//
+// The size sets are almostgrow (just below and above the grow points for 1K, 1M and 8M
+// tables), coarse (1K to 100M in large steps), fine (400K to 2.4M in 50K steps),
+// and sweep (800K to 4.4M in 1% steps, plus the grow points).
+// The larger sets can take hours and need several GB of memory. The output files are
+// written once all the benchmarks finish, and progress is reported on stderr.
+//
+// By default, the maps hold the sequential keys 0 through size-1. The -keys flag selects
+// other key distributions (see internal/keydist), in which case the distribution
+// is part of the benchmark name, such as FillGrow/uniform/664.
+//
+// The GetAllStartCold family always runs with a benchtime of 1x, and creates enough maps
+// to use -coldmem MB so that the maps are cold at the start.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/thepudds/swisstable/internal/keydist"
+)
+
+var (
+	benchFlag     = flag.String("bench", ".", "regexp selecting benchmark families to run")
+	sizesFlag     = flag.String("sizes", "almostgrow", "map size set: almostgrow, coarse, fine, or sweep")
+	keysFlag      = flag.String("keys", "sequential", "comma separated key distributions: sequential, uniform, or clustered")
+	implFlag      = flag.String("impl", "std,swiss", "comma separated implementations to run: std, swiss")
+	countFlag     = flag.Int("count", 1, "run each benchmark n times")
+	benchtimeFlag = flag.String("benchtime", "1s", "run each benchmark for duration d or Nx times, except cold benchmarks")
+	coldMemFlag   = flag.Float64("coldmem", 512, "memory in MB to use for cold benchmarks. should be substantially larger than L3 cache.")
+	outFlag       = flag.String("o", ".", "output directory for std.txt, swiss.txt and summary.json")
+)
+
+func main() {
+	testing.Init()
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "swissbench:", err)
+		os.Exit(1)
+	}
+}
+
+// summary is the JSON summary written to summary.json.
+type summary struct {
+	GoVersion  string   `json:"goVersion"`
+	GOOS       string   `json:"goos"`
+	GOARCH     string   `json:"goarch"`
+	GOMAXPROCS int      `json:"gomaxprocs"`
+	Sizes      string   `json:"sizes"`
+	Keys       string   `json:"keys"`
+	Count      int      `json:"count"`
+	Benchtime  string   `json:"benchtime"`
+	Results    []result `json:"results"`
+}
+
+// result holds the results for one benchmark family and map size.
+type result struct {
+	// Name is the benchmark name used in the text output, without the Benchmark prefix
+	// or GOMAXPROCS suffix, such as FillGrow/664.
+	Name   string      `json:"name"`
+	Family string      `json:"family"`
+	Keys   string      `json:"keys"`
+	Size   int         `json:"size"`
+	Std    *implResult `json:"std,omitempty"`
+	Swiss  *implResult `json:"swiss,omitempty"`
+	// Delta is the percent change in median time/op from std to swiss.
+	// It is only set if both implementations ran.
+	Delta *float64 `json:"deltaPercent,omitempty"`
+}
+
+// implResult holds the results for one implementation.
+type implResult struct {
+	NsPerOp       []float64 `json:"nsPerOp"`
+	MedianNsPerOp float64   `json:"medianNsPerOp"`
+	BytesPerOp    int64     `json:"bytesPerOp"`
+	AllocsPerOp   int64     `json:"allocsPerOp"`
+}
+
+func run() error {
+	re, err := regexp.Compile(*benchFlag)
+	if err != nil {
+		return fmt.Errorf("bad -bench: %v", err)
+	}
+	sizes, err := sizeSet(*sizesFlag)
+	if err != nil {
+		return err
+	}
+	var dists []keydist.Dist
+	for _, name := range strings.Split(*keysFlag, ",") {
+		switch name {
+		case "sequential":
+			dists = append(dists, keydist.Sequential(0, 1))
+		case "uniform":
+			dists = append(dists, keydist.Uniform())
+		case "clustered":
+			dists = append(dists, keydist.Clustered(64))
+		default:
+			return fmt.Errorf("unknown key distribution %q", name)
+		}
+	}
+	var runStd, runSwiss bool
+	for _, impl := range strings.Split(*implFlag, ",") {
+		switch impl {
+		case "std":
+			runStd = true
+		case "swiss":
+			runSwiss = true
+		default:
+			return fmt.Errorf("unknown implementation %q", impl)
+		}
+	}
+	if *countFlag < 1 {
+		return fmt.Errorf("bad -count %d", *countFlag)
+	}
+	if err := os.MkdirAll(*outFlag, 0o755); err != nil {
+		return err
+	}
+
+	// The text output is collected in memory and written along with summary.json at the end.
+	var stdOut, swissOut bytes.Buffer
+	writeHeader(&stdOut)
+	writeHeader(&swissOut)
+
+	s := summary{
+		GoVersion:  runtime.Version(),
+		GOOS:       runtime.GOOS,
+		GOARCH:     runtime.GOARCH,
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Sizes:      *sizesFlag,
+		Keys:       *keysFlag,
+		Count:      *countFlag,
+		Benchtime:  *benchtimeFlag,
+	}
+	for _, fam := range families {
+		if !re.MatchString(fam.name) {
+			continue
+		}
+		benchtime := *benchtimeFlag
+		if fam.cold {
+			benchtime = "1x"
+		}
+		if err := flag.Set("test.benchtime", benchtime); err != nil {
+			return fmt.Errorf("bad -benchtime: %v", err)
+		}
+		for _, dist := range dists {
+			for _, size := range sizes {
+				keys := dist.Keys(size, 1)
+				name := fmt.Sprintf("%s/%d", fam.name, size)
+				if len(dists) > 1 || dist.Name != "sequential" {
+					name = fmt.Sprintf("%s/%s/%d", fam.name, dist.Name, size)
+				}
+				r := result{Name: name, Family: fam.name, Keys: dist.Name, Size: size}
+				// Alternate between implementations so that any drift in the machine's
+				// performance affects both similarly.
+				for i := 0; i < *countFlag; i++ {
+					if runStd {
+						r.Std = record(r.Std, &stdOut, r.Name, testing.Benchmark(fam.std(keys)))
+					}
+					if runSwiss {
+						r.Swiss = record(r.Swiss, &swissOut, r.Name, testing.Benchmark(fam.swiss(keys)))
+					}
+				}
+				if r.Std != nil && r.Swiss != nil && r.Std.MedianNsPerOp != 0 {
+					delta := (r.Swiss.MedianNsPerOp/r.Std.MedianNsPerOp - 1) * 100
+					r.Delta = &delta
+				}
+				fmt.Fprintf(os.Stderr, "%s done\n", r.Name)
+				s.Results = append(s.Results, r)
+			}
+		}
+	}
+
+	if runStd {
+		if err := os.WriteFile(filepath.Join(*outFlag, "std.txt"), stdOut.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+	if runSwiss {
+		if err := os.WriteFile(filepath.Join(*outFlag, "swiss.txt"), swissOut.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(*outFlag, "summary.json"), append(data, '\n'), 0o644)
+}
+
+// writeHeader writes the header lines used by benchstat to b.
+func writeHeader(b *bytes.Buffer) {
+	fmt.Fprintf(b, "goos: %s\ngoarch: %s\npkg: github.com/thepudds/swisstable\n", runtime.GOOS, runtime.GOARCH)
+}
+
+// record writes br to b in the standard benchmark format and adds it to ir, which may be nil.
+func record(ir *implResult, b *bytes.Buffer, name string, br testing.BenchmarkResult) *implResult {
+	fmt.Fprintf(b, "Benchmark%s-%d\t%s\t%s\n", name, runtime.GOMAXPROCS(0), br.String(), br.MemString())
+	if ir == nil {
+		ir = &implResult{}
+	}
+	ir.NsPerOp = append(ir.NsPerOp, float64(br.T.Nanoseconds())/float64(br.N))
+	ir.MedianNsPerOp = median(ir.NsPerOp)
+	ir.BytesPerOp = br.AllocedBytesPerOp()
+	ir.AllocsPerOp = br.AllocsPerOp()
+	return ir
+}
+
+func median(xs []float64) float64 {
+	sorted := append([]float64(nil), xs...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// The size sets match the helpers of the same names in map_test.go.
+
+// coarseMapSizes returns map sizes with large steps from 1K to 100M elements.
+func coarseMapSizes() []int {
+	const (
+		mapSizeCoarseLow    = 1_000
+		mapSizeCoarseHigh   = 100_000_000 // 16 bytes * 1e8 = 1.6 GB of data, plus overhead
+		mapSizeCoarseFactor = 1.75
+	)
+
+	var sizes []int
+	mapSize := mapSizeCoarseLow
+	for {
+		mapSize = min(mapSize, mapSizeCoarseHigh)
+		sizes = append(sizes, mapSize)
+		if mapSize == mapSizeCoarseHigh {
+			break
+		}
+		mapSize = int(float64(mapSize) * mapSizeCoarseFactor)
+	}
+	return sizes
+}
+
+// almostGrowPointMapSizes returns map sizes 20% below and above
+// the grow point for each power of 2 table size in pow2s.
+func almostGrowPointMapSizes(pow2s []int) []int {
+	var sizes []int
+	for _, size := range pow2s {
+		if size&(size-1) != 0 || size == 0 {
+			panic(fmt.Sprintf("size %d is not power of 2", size))
+		}
+		growPoint := (size * 13 / 2 / 8) + 1 // TODO: centralize
+
+		sizes = append(sizes, int(0.8*float64(growPoint)), int(1.2*float64(growPoint)))
+	}
+	return sizes
+}
+
+// fineMapSizes returns map sizes with smaller steps from 400K elements to 2.4M elements.
+func fineMapSizes() []int {
+	const (
+		mapSizeFineLow  = 400_000
+		mapSizeFineHigh = 2_400_000
+		mapSizeFineStep = 50_000
+	)
+
+	var sizes []int
+	mapSize := mapSizeFineLow
+	for {
+		mapSize = min(mapSize, mapSizeFineHigh)
+		sizes = append(sizes, mapSize)
+		if mapSize == mapSizeFineHigh {
+			break
+		}
+		mapSize += mapSizeFineStep
+	}
+	return sizes
+}
+
+// sweepMapSizes returns map sizes with 1% steps from 800K to 4.4M elements,
+// plus the sizes around each point where the map grows.
+func sweepMapSizes() []int {
+	const (
+		mapSizeSweepLow    = 800_000
+		mapSizeSweepHigh   = 4_400_000
+		mapSizeSweepFactor = 1.01
+	)
+
+	var sizes []int
+	mapSize := mapSizeSweepLow
+	for {
+		mapSize = min(mapSize, mapSizeSweepHigh)
+		sizes = append(sizes, mapSize)
+		if mapSize == mapSizeSweepHigh {
+			break
+		}
+		nextMapSize := int(float64(mapSize) * mapSizeSweepFactor)
+
+		// Include the expected worst case for memory usage at the size just before a resize,
+		// along with the points immediately around it.
+		nextWorstCase := (roundPow2(mapSize) * 13 / 2 / 8) + 1
+		if mapSize < nextWorstCase && nextWorstCase < nextMapSize {
+			sizes = append(sizes, nextWorstCase-1, nextWorstCase, nextWorstCase+1)
+		}
+		mapSize = nextMapSize
+	}
+	return sizes
+}
+
+// sizeSet returns the map sizes for the named size set.
+func sizeSet(name string) ([]int, error) {
+	switch name {
+	case "almostgrow":
+		return almostGrowPointMapSizes([]int{1 << 10, 1 << 20, 1 << 23}), nil
+	case "coarse":
+		return coarseMapSizes(), nil
+	case "fine":
+		return fineMapSizes(), nil
+	case "sweep":
+		return sweepMapSizes(), nil
+	default:
+		return nil, fmt.Errorf("unknown size set %q", name)
+	}
+}
+
+func roundPow2(n int) int {
+	if n == 0 {
+		return 0
+	}
+	return 1 << (64 - bits.LeadingZeros64(uint64(n-1)))
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
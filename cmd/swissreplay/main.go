@@ -0,0 +1,552 @@
+// Command swissreplay replays a trace recorded by swisstable.Recorder, and reports
+// the first divergence between the recorded results and the replays.
+//
+// It replays the trace against a fresh swisstable.Map with the recorded seed, hash mode
+// and table size, against a runtime map, and against a swisstabletest.Vmap, which
+// validates each operation and each Range as it goes. It then compares the result of
+// each Get across the recording and the replays, the number of keys seen by each Range
+// that did not stop early or modify the map, and the final contents.
+//
+// Example:
+//
+//	swissreplay -dump crash.trace
+//
+// Operations done inside a Range callback are replayed in the callback with the same index,
+// or after the Range if a replay sees fewer keys. With the runtime hash, a replay uses the
+// recorded seed but a different per-process hash, so the order of keys in a Range, and
+// therefore which key is at a recorded index, can differ from the recording.
+// Concurrent Ranges, which can only read, are replayed one at a time, each nested in the
+// callback that was running when it started.
+// A trace recorded with PortableHash replays with the same table layout.
+// A trace recorded with a custom hash function is replayed with the runtime hash.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/thepudds/swisstable"
+	"github.com/thepudds/swisstable/internal/trace"
+	"github.com/thepudds/swisstable/swisstabletest"
+)
+
+var dumpFlag = flag.Bool("dump", false, "print the trace before replaying it")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: swissreplay [-dump] trace")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	ok, err := run(flag.Arg(0), os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "swissreplay:", err)
+		os.Exit(1)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// step is a recorded operation. Range operations have nested steps.
+type step struct {
+	// index is the position of the event in the trace, for reporting.
+	index int
+	ev    trace.Event
+	rng   *rangeStep
+}
+
+// rangeStep is a recorded Range.
+type rangeStep struct {
+	id uint64
+	at []*rangeAt
+	// n is the number of callbacks in the recording.
+	n       uint64
+	stopped bool
+	// end is the index of the OpRangeEnd or OpRangeStop event.
+	end int
+}
+
+// rangeAt holds the operations done in one Range callback.
+type rangeAt struct {
+	index uint64
+	steps []step
+}
+
+// writes reports whether any callback modified the map, including in nested Ranges.
+func (r *rangeStep) writes() bool {
+	for _, at := range r.at {
+		for _, s := range at.steps {
+			if s.ev.Op == trace.OpSet || s.ev.Op == trace.OpDelete || (s.rng != nil && s.rng.writes()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parse reads the events from r and builds the tree of steps.
+func parse(r *trace.Reader) ([]trace.Event, []step, error) {
+	var events []trace.Event
+	for {
+		e, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("event %d: %v", len(events), err)
+		}
+		events = append(events, e)
+	}
+
+	// The events of a Range normally nest, but concurrent Ranges can interleave.
+	// Those are read-only, so we can replay each of them nested where it started.
+	// cur is where we add steps, and open holds the Ranges that have not ended.
+	type openRange struct {
+		rng    *rangeStep
+		parent *openRange // nil for the top level
+		ended  bool
+	}
+	var top []step
+	cur := &top
+	open := make(map[uint64]*openRange)
+	var in *openRange // the Range that cur is in, or nil
+	for i, e := range events {
+		switch e.Op {
+		case trace.OpRangeStart:
+			if open[e.Range] != nil {
+				return nil, nil, fmt.Errorf("event %d: Range #%d started twice", i, e.Range)
+			}
+			s := step{index: i, ev: e, rng: &rangeStep{id: e.Range}}
+			*cur = append(*cur, s)
+			open[e.Range] = &openRange{rng: s.rng, parent: in}
+		case trace.OpRangeAt:
+			o := open[e.Range]
+			if o == nil {
+				return nil, nil, fmt.Errorf("event %d: %v outside of Range #%d", i, e.Op, e.Range)
+			}
+			at := &rangeAt{index: e.N}
+			o.rng.at = append(o.rng.at, at)
+			cur, in = &at.steps, o
+		case trace.OpRangeEnd, trace.OpRangeStop:
+			o := open[e.Range]
+			if o == nil {
+				return nil, nil, fmt.Errorf("event %d: %v outside of Range #%d", i, e.Op, e.Range)
+			}
+			o.rng.n = e.N
+			o.rng.stopped = e.Op == trace.OpRangeStop
+			o.rng.end = i
+			o.ended = true
+			delete(open, e.Range)
+			if in == o {
+				// Continue in the innermost enclosing Range that has not ended.
+				in = o.parent
+				for in != nil && in.ended {
+					in = in.parent
+				}
+				cur = &top
+				if in != nil {
+					cur = &in.rng.at[len(in.rng.at)-1].steps
+				}
+			}
+		default:
+			*cur = append(*cur, step{index: i, ev: e})
+		}
+	}
+	if len(open) > 0 {
+		return nil, nil, fmt.Errorf("event %d: %d Ranges do not end", len(events), len(open))
+	}
+	return events, top, nil
+}
+
+// getResult is the result of a Get.
+type getResult struct {
+	v  swisstable.Value
+	ok bool
+}
+
+func (g getResult) String() string {
+	if !g.ok {
+		return "miss"
+	}
+	return fmt.Sprint(g.v)
+}
+
+// kv is the set of operations a replay applies outside of Range.
+// *swisstable.Map, stdMap and vmapKV implement it.
+type kv interface {
+	Get(k swisstable.Key) (v swisstable.Value, ok bool)
+	Set(k swisstable.Key, v swisstable.Value)
+	Delete(k swisstable.Key)
+	Free()
+}
+
+// replayer replays steps against one implementation.
+type replayer struct {
+	name string
+	kv   kv
+	// m is used for Range, unless vm is set.
+	m  swisstabletest.Map
+	vm *swisstabletest.Vmap
+
+	// gets holds the result of each Get, by event index.
+	gets map[int]getResult
+	// counts holds the number of keys seen by each Range, by the index of its end event.
+	counts map[int]uint64
+	// cur is the index of the event being replayed.
+	cur int
+	// panicked is the index of the event that panicked, or -1, and panicMsg its value.
+	panicked int
+	panicMsg interface{}
+}
+
+func newReplayer(name string, kv kv, m swisstabletest.Map, vm *swisstabletest.Vmap) *replayer {
+	return &replayer{name: name, kv: kv, m: m, vm: vm, gets: make(map[int]getResult), counts: make(map[int]uint64), panicked: -1}
+}
+
+// replay runs steps, and recovers from a panic, such as a validation failure in a Vmap.
+func (r *replayer) replay(steps []step) {
+	defer func() {
+		if e := recover(); e != nil {
+			r.panicked, r.panicMsg = r.cur, e
+		}
+	}()
+	r.run(steps)
+}
+
+func (r *replayer) run(steps []step) {
+	for _, s := range steps {
+		r.cur = s.index
+		k := swisstable.Key(s.ev.Key)
+		switch s.ev.Op {
+		case trace.OpGet, trace.OpGetHit:
+			v, ok := r.kv.Get(k)
+			r.gets[s.index] = getResult{v, ok}
+		case trace.OpSet:
+			r.kv.Set(k, swisstable.Value(s.ev.Value))
+		case trace.OpDelete:
+			r.kv.Delete(k)
+		case trace.OpFree:
+			r.kv.Free()
+		case trace.OpRangeStart:
+			if r.vm != nil {
+				r.runVmapRange(s.rng)
+			} else {
+				r.runRange(s.rng)
+			}
+		}
+	}
+}
+
+// runRange runs a Range, running the nested steps in the callback with the
+// recorded index, or after the Range if there are fewer callbacks.
+func (r *replayer) runRange(rng *rangeStep) {
+	pending := rng.at
+	var i uint64
+	r.m.Range(func(k swisstable.Key, v swisstable.Value) bool {
+		for len(pending) > 0 && pending[0].index == i {
+			r.run(pending[0].steps)
+			pending = pending[1:]
+		}
+		i++
+		return !rng.stopped || i < rng.n
+	})
+	for _, at := range pending {
+		r.run(at.steps)
+	}
+	r.cur = rng.end
+	r.counts[rng.end] = i
+}
+
+// runVmapRange runs a Range with the Vmap. Vmap.Range validates the keys seen while
+// applying Get, Set and Delete at given indexes, but cannot express a nested Range,
+// an early stop, a Set of a value other than the key, or an index above
+// swisstabletest.MaxRangeIndex. For such a Range, we validate a plain Range,
+// and then run the nested steps after it.
+func (r *replayer) runVmapRange(rng *rangeStep) {
+	var ops []swisstabletest.Op
+	simple := !rng.stopped
+	for _, at := range rng.at {
+		for _, s := range at.steps {
+			op := swisstabletest.Op{Key: swisstable.Key(s.ev.Key), RangeIndex: uint16(at.index)}
+			switch s.ev.Op {
+			case trace.OpGet, trace.OpGetHit:
+				op.OpType = swisstabletest.GetOp
+			case trace.OpSet:
+				op.OpType = swisstabletest.SetOp
+				simple = simple && s.ev.Value == s.ev.Key
+			case trace.OpDelete:
+				op.OpType = swisstabletest.DeleteOp
+			default:
+				simple = false
+			}
+			simple = simple && at.index <= swisstabletest.MaxRangeIndex
+			ops = append(ops, op)
+		}
+	}
+	if simple {
+		r.vm.Range(ops)
+		// Vmap.Range does not report the results of its Gets, so we do not record them.
+		return
+	}
+	r.vm.Range(nil)
+	for _, at := range rng.at {
+		r.run(at.steps)
+	}
+}
+
+// stdMap is a runtime map that implements swisstabletest.Map.
+type stdMap map[swisstable.Key]swisstable.Value
+
+func (m stdMap) Get(k swisstable.Key) (swisstable.Value, bool) {
+	v, ok := m[k]
+	return v, ok
+}
+
+func (m stdMap) Set(k swisstable.Key, v swisstable.Value) { m[k] = v }
+
+func (m stdMap) Delete(k swisstable.Key) { delete(m, k) }
+
+func (m stdMap) Free() {
+	for k := range m {
+		delete(m, k)
+	}
+}
+
+func (m stdMap) Len() int { return len(m) }
+
+func (m stdMap) Range(f func(key swisstable.Key, value swisstable.Value) bool) {
+	for k, v := range m {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// vmapKV adds Free to a Vmap. It deletes each key, which the Vmap validates.
+type vmapKV struct {
+	*swisstabletest.Vmap
+}
+
+func (vm vmapKV) Free() {
+	var keys []swisstable.Key
+	for k := range vm.Mirror() {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		vm.Delete(k)
+	}
+}
+
+// maxTableSize bounds the table size in a trace header. It is far larger than
+// any map we expect to record, and keeps a corrupt header from overflowing the
+// capacity we pass to New or allocating a huge table up front.
+const maxTableSize = 1 << 32
+
+// newSwissMap returns an empty Map matching hdr.
+func newSwissMap(hdr trace.Header) (*swisstable.Map, error) {
+	if hdr.TableSize > maxTableSize {
+		return nil, fmt.Errorf("trace header has table size %d, more than the maximum of %d", hdr.TableSize, uint64(maxTableSize))
+	}
+	opts := []swisstable.Option{swisstable.WithSeed(uintptr(hdr.Seed))}
+	if hdr.Hash == trace.HashPortable {
+		opts = append(opts, swisstable.PortableHash())
+	}
+	// New sizes the table at capacity / (13/16), rounded up to a power of 2.
+	return swisstable.New(int(hdr.TableSize*13/16), opts...), nil
+}
+
+// divergence describes a mismatch found while comparing replays.
+type divergence struct {
+	index int
+	msg   string
+}
+
+func run(path string, w io.Writer) (ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	tr := trace.NewReader(f)
+	hdr, err := tr.ReadHeader()
+	if err != nil {
+		return false, err
+	}
+	events, steps, err := parse(tr)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintf(w, "trace: %d events, seed %d, %v hash, table size %d\n", len(events), hdr.Seed, hdr.Hash, hdr.TableSize)
+	if hdr.Hash == trace.HashCustom {
+		fmt.Fprintln(w, "warning: the trace was recorded with a custom hash function; replaying with the runtime hash")
+	}
+	if *dumpFlag {
+		dump(w, events)
+	}
+
+	swiss, err := newSwissMap(hdr)
+	if err != nil {
+		return false, err
+	}
+	vmMap, err := newSwissMap(hdr)
+	if err != nil {
+		return false, err
+	}
+	std := make(stdMap)
+	vm := swisstabletest.New(vmMap)
+	replayers := []*replayer{
+		newReplayer("swisstable", swiss, swiss, nil),
+		newReplayer("runtime map", std, std, nil),
+		newReplayer("Vmap", vmapKV{vm}, nil, vm),
+	}
+	for _, r := range replayers {
+		r.replay(steps)
+	}
+
+	var divs []divergence
+	for _, r := range replayers {
+		if r.panicked >= 0 {
+			divs = append(divs, divergence{r.panicked, fmt.Sprintf("%s panicked: %v", r.name, r.panicMsg)})
+		}
+	}
+	divs = append(divs, compareGets(events, replayers)...)
+	divs = append(divs, compareRanges(steps, replayers[:2])...)
+	if len(divs) == 0 {
+		if d := compareContents(swiss, std); d != "" {
+			divs = append(divs, divergence{len(events), d})
+		}
+	}
+
+	if len(divs) == 0 {
+		fmt.Fprintf(w, "ok: replayed %d events with no divergence; final length %d\n", len(events), swiss.Len())
+		return true, nil
+	}
+	sort.SliceStable(divs, func(i, j int) bool { return divs[i].index < divs[j].index })
+	d := divs[0]
+	if d.index < len(events) {
+		fmt.Fprintf(w, "divergence at event %d %v: %s\n", d.index, events[d.index], d.msg)
+		printContext(w, events, d.index)
+	} else {
+		fmt.Fprintf(w, "divergence at end of trace: %s\n", d.msg)
+	}
+	if len(divs) > 1 {
+		fmt.Fprintf(w, "%d more divergences\n", len(divs)-1)
+	}
+	return false, nil
+}
+
+// compareGets compares the recorded result of each Get with the replays.
+func compareGets(events []trace.Event, replayers []*replayer) []divergence {
+	var divs []divergence
+	for i, e := range events {
+		if e.Op != trace.OpGet && e.Op != trace.OpGetHit {
+			continue
+		}
+		want := getResult{swisstable.Value(e.Value), e.Op == trace.OpGetHit}
+		var diffs []string
+		for _, r := range replayers {
+			got, ok := r.gets[i]
+			if ok && got != want {
+				diffs = append(diffs, fmt.Sprintf("%s = %v", r.name, got))
+			}
+		}
+		if len(diffs) > 0 {
+			divs = append(divs, divergence{i, fmt.Sprintf("recorded %v, %s", want, strings.Join(diffs, ", "))})
+		}
+	}
+	return divs
+}
+
+// compareRanges compares the number of keys seen by each Range that ran to completion
+// without modifying the map, which must match the number of keys in the map.
+func compareRanges(steps []step, replayers []*replayer) []divergence {
+	var divs []divergence
+	var walk func(steps []step)
+	walk = func(steps []step) {
+		for _, s := range steps {
+			if s.rng == nil {
+				continue
+			}
+			for _, at := range s.rng.at {
+				walk(at.steps)
+			}
+			if s.rng.stopped || s.rng.writes() {
+				continue
+			}
+			var diffs []string
+			for _, r := range replayers {
+				got, ok := r.counts[s.rng.end]
+				if ok && got != s.rng.n {
+					diffs = append(diffs, fmt.Sprintf("%s saw %d", r.name, got))
+				}
+			}
+			if len(diffs) > 0 {
+				divs = append(divs, divergence{s.rng.end, fmt.Sprintf("recorded Range saw %d keys, %s", s.rng.n, strings.Join(diffs, ", "))})
+			}
+		}
+	}
+	walk(steps)
+	return divs
+}
+
+// compareContents compares the final contents of the swisstable and runtime map replays.
+func compareContents(swiss *swisstable.Map, std stdMap) string {
+	if swiss.Len() != len(std) {
+		return fmt.Sprintf("swisstable has %d keys, runtime map has %d", swiss.Len(), len(std))
+	}
+	var msg string
+	swiss.Range(func(k swisstable.Key, v swisstable.Value) bool {
+		if want, ok := std[k]; !ok || v != want {
+			msg = fmt.Sprintf("swisstable has key %d = %d, runtime map has %v", k, v, getResult{want, ok})
+			return false
+		}
+		return true
+	})
+	return msg
+}
+
+// dump prints events, indenting the operations inside Ranges.
+func dump(w io.Writer, events []trace.Event) {
+	depth := 0
+	for i, e := range events {
+		switch e.Op {
+		case trace.OpRangeEnd, trace.OpRangeStop:
+			depth--
+		}
+		indent := strings.Repeat("    ", depth)
+		if e.Op == trace.OpRangeAt {
+			indent = indent[2:]
+		}
+		fmt.Fprintf(w, "%6d  %s%v\n", i, indent, e)
+		if e.Op == trace.OpRangeStart {
+			depth++
+		}
+	}
+}
+
+// printContext prints the events leading up to index.
+func printContext(w io.Writer, events []trace.Event, index int) {
+	const before = 5
+	start := index - before
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i <= index; i++ {
+		marker := " "
+		if i == index {
+			marker = ">"
+		}
+		fmt.Fprintf(w, "%s %6d  %v\n", marker, i, events[i])
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/thepudds/swisstable"
+	"github.com/thepudds/swisstable/internal/trace"
+)
+
+func TestRun(t *testing.T) {
+	var rec bytes.Buffer
+	r := swisstable.NewRecorder(&rec)
+	m := swisstable.New(0, swisstable.Record(r), swisstable.PortableHash())
+	for k := swisstable.Key(0); k < 100; k++ {
+		m.Set(k, swisstable.Value(k*10))
+	}
+	for k := swisstable.Key(0); k < 100; k += 3 {
+		m.Delete(k)
+	}
+	m.Get(1)
+	m.Get(3)
+
+	// A Range with a nested Range and a Set in its callbacks.
+	var i int
+	m.Range(func(k swisstable.Key, v swisstable.Value) bool {
+		switch i {
+		case 0:
+			m.Range(func(k swisstable.Key, v swisstable.Value) bool {
+				m.Get(k)
+				return true
+			})
+		case 5:
+			m.Set(1000, 1)
+		}
+		i++
+		return true
+	})
+	// A stopped Range.
+	m.Range(func(k swisstable.Key, v swisstable.Value) bool {
+		m.Delete(k)
+		return false
+	})
+
+	// Two concurrent Ranges with Gets.
+	aInRange, release := make(chan bool), make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		first := true
+		m.Range(func(k swisstable.Key, v swisstable.Value) bool {
+			if first {
+				first = false
+				close(aInRange)
+				<-release
+			}
+			m.Get(k)
+			return true
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		<-aInRange
+		m.Range(func(k swisstable.Key, v swisstable.Value) bool {
+			m.Get(k + 1)
+			return true
+		})
+		close(release)
+	}()
+	wg.Wait()
+	if err := r.Flush(); err != nil {
+		t.Fatalf("Recorder.Flush() error: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "trace")
+	if err := os.WriteFile(path, rec.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	ok, err := run(path, &out)
+	if err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	if !ok || !strings.Contains(out.String(), "ok: replayed") {
+		t.Errorf("run() = false, output:\n%s", out.String())
+	}
+}
+
+func TestRun_Divergence(t *testing.T) {
+	var buf bytes.Buffer
+	w := trace.NewWriter(&buf)
+	w.WriteHeader(trace.Header{Seed: 1, Hash: trace.HashPortable, TableSize: 16})
+	w.WriteEvent(trace.Event{Op: trace.OpSet, Key: 1, Value: 10})
+	w.WriteEvent(trace.Event{Op: trace.OpGetHit, Key: 1, Value: 20})
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "trace")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	ok, err := run(path, &out)
+	if err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	if ok || !strings.Contains(out.String(), "divergence at event 1") {
+		t.Errorf("run() = %v, want a divergence at event 1, output:\n%s", ok, out.String())
+	}
+}
+
+func TestNewSwissMap_TableSize(t *testing.T) {
+	if _, err := newSwissMap(trace.Header{TableSize: maxTableSize + 1}); err == nil {
+		t.Errorf("newSwissMap() with table size %d did not return an error", uint64(maxTableSize+1))
+	}
+}
+
+func TestRun_Free(t *testing.T) {
+	var rec bytes.Buffer
+	r := swisstable.NewRecorder(&rec)
+	m := swisstable.New(0, swisstable.Record(r), swisstable.PortableHash())
+	for k := swisstable.Key(0); k < 100; k++ {
+		m.Set(k, swisstable.Value(k))
+	}
+	m.Free()
+	m.Set(1000, 1)
+	m.Get(1)
+	m.Get(1000)
+	if err := r.Flush(); err != nil {
+		t.Fatalf("Recorder.Flush() error: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "trace")
+	if err := os.WriteFile(path, rec.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	ok, err := run(path, &out)
+	if err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	if !ok || !strings.Contains(out.String(), "final length 1") {
+		t.Errorf("run() = %v, want ok with final length 1, output:\n%s", ok, out.String())
+	}
+}
+
+func TestParse_InterleavedRanges(t *testing.T) {
+	// Range 1 ends while Range 2, which started in one of its callbacks, is still running.
+	// Range 2 stays nested in Range 1, and the Set after both end is at the top level.
+	events := []trace.Event{
+		{Op: trace.OpRangeStart, Range: 1},
+		{Op: trace.OpRangeAt, Range: 1, N: 0},
+		{Op: trace.OpRangeStart, Range: 2},
+		{Op: trace.OpRangeAt, Range: 2, N: 0},
+		{Op: trace.OpGet, Key: 1},
+		{Op: trace.OpRangeEnd, Range: 1, N: 1},
+		{Op: trace.OpRangeAt, Range: 2, N: 1},
+		{Op: trace.OpGet, Key: 2},
+		{Op: trace.OpRangeEnd, Range: 2, N: 2},
+		{Op: trace.OpSet, Key: 3, Value: 3},
+	}
+	var buf bytes.Buffer
+	w := trace.NewWriter(&buf)
+	w.WriteHeader(trace.Header{})
+	for _, e := range events {
+		w.WriteEvent(e)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tr := trace.NewReader(&buf)
+	if _, err := tr.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	_, steps, err := parse(tr)
+	if err != nil {
+		t.Fatalf("parse() error: %v", err)
+	}
+	if len(steps) != 2 || steps[0].rng == nil || steps[1].ev.Op != trace.OpSet {
+		t.Fatalf("parse() returned %d top level steps, want Range #1 and Set", len(steps))
+	}
+	r1 := steps[0].rng
+	if len(r1.at) != 1 || len(r1.at[0].steps) != 1 || r1.at[0].steps[0].rng == nil {
+		t.Fatalf("Range #1 does not have Range #2 nested in its first callback")
+	}
+	r2 := r1.at[0].steps[0].rng
+	if r2.id != 2 || len(r2.at) != 2 || r2.n != 2 || r1.n != 1 {
+		t.Errorf("Range #2 has id %d, %d callbacks with steps and n %d; Range #1 has n %d. want 2, 2, 2 and 1",
+			r2.id, len(r2.at), r2.n, r1.n)
+	}
+}
@@ -0,0 +1,172 @@
+// Command swissrepro converts a failing Fuzz_NewVmap_Chain corpus entry into a
+// standalone regression test.
+//
+// It decodes the fzgen chain in the corpus file with swisstabletest.DecodeChain,
+// expanding bulk operations into individual steps, minimizes the steps that still fail,
+// and writes a Test function with explicit NewVmap, Set, Delete, Get and Range calls.
+// When fuzzing finds a failure, the go command writes the input to testdata/fuzz/Fuzz_NewVmap_Chain
+// and prints its name, which we use in place of <id> here:
+//
+//	cd swisstabletest
+//	go test -run=NONE -fuzz=Fuzz_NewVmap_Chain
+//	go run ../cmd/swissrepro -name TestVmap_GrowDuringRange testdata/fuzz/Fuzz_NewVmap_Chain/<id> >> vmap_test.go
+//
+// By default the test is written for package swisstabletest. With -pkg, it uses qualified
+// names, for example for an external swisstabletest_test package.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/thepudds/swisstable/swisstabletest"
+)
+
+var (
+	nameFlag     = flag.String("name", "", "name of the test function (default derived from the corpus file name)")
+	pkgFlag      = flag.String("pkg", "swisstabletest", "package the test will be in")
+	minimizeFlag = flag.Bool("minimize", true, "minimize the failing steps")
+	outFlag      = flag.String("o", "", "output file (default stdout)")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: swissrepro [flags] corpusfile")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, "swissrepro:", err)
+		os.Exit(1)
+	}
+}
+
+func run(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data, err := parseCorpus(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	newMap := func(capacity byte) swisstabletest.Map {
+		return swisstabletest.NewVmap(capacity, nil).Map()
+	}
+	r := swisstabletest.DecodeChain(data, newMap)
+	if r.Failure == nil {
+		return fmt.Errorf("%s: chain of %d steps does not fail", path, len(r.Steps))
+	}
+	if *minimizeFlag {
+		decoded := len(r.Steps)
+		r.Minimize(newMap)
+		fmt.Fprintf(os.Stderr, "swissrepro: minimized %d steps to %d\n", decoded, len(r.Steps))
+	}
+
+	name := *nameFlag
+	if name == "" {
+		base := filepath.Base(path)
+		if len(base) > 8 {
+			base = base[:8]
+		}
+		name = "TestChain_" + base
+	}
+	src, err := generate(name, path, *pkgFlag != "swisstabletest", r)
+	if err != nil {
+		return err
+	}
+
+	if *outFlag == "" {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+	return os.WriteFile(*outFlag, src, 0o666) // checks the error from Close
+}
+
+// parseCorpus returns the []byte value from a file in the Go fuzzing corpus format.
+func parseCorpus(b []byte) ([]byte, error) {
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "go test fuzz v1" {
+		return nil, fmt.Errorf("not a go test fuzz v1 corpus file")
+	}
+	var values []string
+	for _, line := range lines[1:] {
+		if line = strings.TrimSpace(line); line != "" {
+			values = append(values, line)
+		}
+	}
+	if len(values) != 1 {
+		return nil, fmt.Errorf("got %d values, want 1", len(values))
+	}
+	v := values[0]
+	if !strings.HasPrefix(v, "[]byte(") || !strings.HasSuffix(v, ")") {
+		return nil, fmt.Errorf("value %.40q is not a []byte", v)
+	}
+	s, err := strconv.Unquote(v[len("[]byte(") : len(v)-1])
+	if err != nil {
+		return nil, fmt.Errorf("value %.40q: %v", v, err)
+	}
+	return []byte(s), nil
+}
+
+var opNames = map[swisstabletest.OpType]string{
+	swisstabletest.GetOp:    "GetOp",
+	swisstabletest.SetOp:    "SetOp",
+	swisstabletest.DeleteOp: "DeleteOp",
+	swisstabletest.LenOp:    "LenOp",
+}
+
+// generate returns the formatted source of a test function running the steps in r.
+func generate(name, path string, qualified bool, r *swisstabletest.Repro) ([]byte, error) {
+	q := ""
+	if qualified {
+		q = "swisstabletest."
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// %s is a regression test converted from the fuzzing corpus entry\n// %s.\n", name, filepath.ToSlash(path))
+	fmt.Fprintf(&b, "// It failed with:\n//\n")
+	for _, line := range strings.Split(fmt.Sprint(r.Failure), "\n") {
+		fmt.Fprintf(&b, "//\t%s\n", line)
+	}
+	fmt.Fprintf(&b, "func %s(t *testing.T) {\n", name)
+	fmt.Fprintf(&b, "vm := %sNewVmap(%d, nil)\n", q, r.Capacity)
+	for _, s := range r.Steps {
+		switch s.OpType {
+		case swisstabletest.GetOp:
+			fmt.Fprintf(&b, "vm.Get(%d)\n", s.Key)
+		case swisstabletest.SetOp:
+			fmt.Fprintf(&b, "vm.Set(%d, %d)\n", s.Key, s.Value)
+		case swisstabletest.DeleteOp:
+			fmt.Fprintf(&b, "vm.Delete(%d)\n", s.Key)
+		case swisstabletest.LenOp:
+			fmt.Fprintf(&b, "vm.Len()\n")
+		case swisstabletest.RangeOp:
+			if len(s.Ops) == 0 {
+				fmt.Fprintf(&b, "vm.Range(nil)\n")
+				continue
+			}
+			fmt.Fprintf(&b, "vm.Range([]%sOp{\n", q)
+			for _, op := range s.Ops {
+				if op.OpType == swisstabletest.LenOp {
+					fmt.Fprintf(&b, "{OpType: %s%s, RangeIndex: %d},\n", q, opNames[op.OpType], op.RangeIndex)
+				} else {
+					fmt.Fprintf(&b, "{OpType: %s%s, Key: %d, RangeIndex: %d},\n", q, opNames[op.OpType], op.Key, op.RangeIndex)
+				}
+			}
+			fmt.Fprintf(&b, "})\n")
+		}
+	}
+	fmt.Fprintf(&b, "vm.Check()\n}\n")
+	return format.Source(b.Bytes())
+}
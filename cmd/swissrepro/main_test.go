@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/thepudds/swisstable/swisstabletest"
+)
+
+func TestGenerate(t *testing.T) {
+	names := map[swisstabletest.OpType]string{
+		swisstabletest.GetOp:    "Get",
+		swisstabletest.SetOp:    "Set",
+		swisstabletest.DeleteOp: "Delete",
+		swisstabletest.LenOp:    "Len",
+		swisstabletest.RangeOp:  "Range",
+	}
+
+	// Decode a small chain that has each kind of step, including a Range with operations.
+	newMap := func(capacity byte) swisstabletest.Map {
+		return swisstabletest.NewVmap(capacity, nil).Map()
+	}
+	rng := rand.New(rand.NewSource(1))
+	var r *swisstabletest.Repro
+	for i := 0; i < 1000 && r == nil; i++ {
+		data := make([]byte, 20+rng.Intn(100))
+		rng.Read(data)
+		d := swisstabletest.DecodeChain(data, newMap)
+		kinds := make(map[swisstabletest.OpType]bool)
+		for _, s := range d.Steps {
+			if s.OpType != swisstabletest.RangeOp || len(s.Ops) > 0 {
+				kinds[s.OpType] = true
+			}
+		}
+		if len(kinds) == len(names) {
+			r = d
+		}
+	}
+	if r == nil {
+		t.Fatal("no decoded chain has each kind of step")
+	}
+	r.Failure = errors.New("first line\nsecond line")
+
+	want := map[string]int{"NewVmap": 1, "Check": 1}
+	for _, s := range r.Steps {
+		want[names[s.OpType]]++
+	}
+
+	for _, qualified := range []bool{false, true} {
+		src, err := generate("TestChain_example", "testdata/fuzz/Fuzz_NewVmap_Chain/example", qualified, r)
+		if err != nil {
+			t.Fatalf("generate(qualified %v) error: %v", qualified, err)
+		}
+		file := "package p\n\nimport \"testing\"\n\n" + string(src)
+		f, err := parser.ParseFile(token.NewFileSet(), "chain_test.go", file, parser.ParseComments)
+		if err != nil {
+			t.Fatalf("generate(qualified %v) output does not parse: %v\n%s", qualified, err, src)
+		}
+		if len(f.Decls) != 2 {
+			t.Fatalf("generate(qualified %v) output has %d declarations, want 1 func", qualified, len(f.Decls)-1)
+		}
+		fn, ok := f.Decls[1].(*ast.FuncDecl)
+		if !ok || fn.Name.Name != "TestChain_example" {
+			t.Fatalf("generate(qualified %v) output does not declare func TestChain_example:\n%s", qualified, src)
+		}
+		if doc := fn.Doc.Text(); !strings.Contains(doc, "first line\n") || !strings.Contains(doc, "second line\n") {
+			t.Errorf("generate(qualified %v) doc comment = %q, want the failure", qualified, doc)
+		}
+
+		got := make(map[string]int)
+		var sawQualified bool
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				if sel, ok := n.Fun.(*ast.SelectorExpr); ok {
+					got[sel.Sel.Name]++
+				} else if id, ok := n.Fun.(*ast.Ident); ok {
+					got[id.Name]++
+				}
+			case *ast.SelectorExpr:
+				if id, ok := n.X.(*ast.Ident); ok && id.Name == "swisstabletest" {
+					sawQualified = true
+				}
+			}
+			return true
+		})
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("generate(qualified %v) calls mismatch (-want +got):\n%s", qualified, diff)
+		}
+		if sawQualified != qualified {
+			t.Errorf("generate(qualified %v) output uses qualified names %v:\n%s", qualified, sawQualified, src)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+
+	"github.com/thepudds/swisstable"
+)
+
+// Layout of the SVG, in pixels.
+const (
+	cellWidth   = 56
+	cellHeight  = 34
+	labelWidth  = 220
+	arrowMargin = 40
+	tableGap    = 40
+)
+
+// svgTable is a table laid out for rendering.
+type svgTable struct {
+	Name   string
+	Width  int
+	Height int
+	Groups []svgGroup
+	Arrows []svgArrow
+}
+
+type svgGroup struct {
+	Label string
+	Y     int
+	Cells []svgCell
+}
+
+type svgCell struct {
+	X, Y  int
+	Class string
+	Title string
+	Text  string
+	Sub   string
+}
+
+// svgArrow connects the natural group of a displaced key to where it is stored.
+type svgArrow struct {
+	X1, Y1, X2, Y2 int
+}
+
+func layoutTable(t *swisstable.DebugTable) svgTable {
+	st := svgTable{
+		Name:   t.Name,
+		Width:  arrowMargin + labelWidth + 16*cellWidth + 10,
+		Height: len(t.Groups)*cellHeight + 10,
+	}
+	groupY := func(g int) int { return g*cellHeight + 5 }
+	for _, g := range t.Groups {
+		label := fmt.Sprintf("group %d", g.Index)
+		if flags := g.Flags(); len(flags) > 0 {
+			label += " [" + strings.Join(flags, " ") + "]"
+		}
+		sg := svgGroup{Label: label, Y: groupY(g.Index)}
+		for offset, s := range g.Slots {
+			c := svgCell{
+				X:     arrowMargin + labelWidth + offset*cellWidth,
+				Y:     groupY(g.Index),
+				Class: s.State.String(),
+				Title: fmt.Sprintf("group %d offset %d control %08b %s", g.Index, offset, s.Control, s.State),
+			}
+			switch s.State {
+			case swisstable.SlotStored:
+				c.Text = fmt.Sprint(s.Key)
+				c.Sub = fmt.Sprintf("h2 %02x", s.H2)
+				c.Title += fmt.Sprintf(" key %v value %v", s.Key, s.Value)
+				if s.ProbeLength > 0 {
+					c.Class = "displaced"
+					c.Sub = fmt.Sprintf("+%d from %d", s.ProbeLength, s.NaturalGroup)
+					c.Title += fmt.Sprintf(" displaced from group %d (probe length %d)", s.NaturalGroup, s.ProbeLength)
+					st.Arrows = append(st.Arrows, svgArrow{
+						X1: arrowMargin - 5, Y1: groupY(s.NaturalGroup) + cellHeight/2,
+						X2: c.X, Y2: c.Y + cellHeight/2,
+					})
+				}
+			case swisstable.SlotDeleted:
+				c.Text = "DEL"
+			}
+			sg.Cells = append(sg.Cells, c)
+		}
+		st.Groups = append(st.Groups, sg)
+	}
+	return st
+}
+
+type page struct {
+	Info   swisstable.DebugInfo
+	Tables []svgTable
+}
+
+func writeHTML(w io.Writer, info swisstable.DebugInfo) error {
+	p := page{Info: info}
+	p.Tables = append(p.Tables, layoutTable(&info.Current))
+	if info.Old != nil {
+		p.Tables = append(p.Tables, layoutTable(info.Old))
+	}
+	return pageTemplate.Execute(w, p)
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>swissviz</title>
+<style>
+body { font-family: sans-serif; margin: 20px; }
+svg { display: block; margin-bottom: ` + fmt.Sprint(tableGap) + `px; }
+text { font-family: monospace; font-size: 11px; }
+rect.empty { fill: #f0f0f0; stroke: #ccc; }
+rect.deleted { fill: #f4b6b6; stroke: #c66; }
+rect.stored { fill: #b9e3b9; stroke: #6a6; }
+rect.displaced { fill: #f7dd8f; stroke: #c93; }
+line.probe { stroke: #c93; stroke-width: 1; marker-end: url(#arrow); opacity: 0.6; }
+.legend span { display: inline-block; padding: 2px 8px; margin-right: 8px; border: 1px solid #999; }
+</style>
+</head>
+<body>
+<h1>swisstable layout</h1>
+<p>len: {{.Info.Len}} &nbsp; growing: {{.Info.Growing}} &nbsp; small: {{.Info.Small}} &nbsp; sweep cursor: {{.Info.SweepCursor}}</p>
+<p class="legend">
+<span style="background:#f0f0f0">empty</span>
+<span style="background:#f4b6b6">deleted (tombstone)</span>
+<span style="background:#b9e3b9">stored in natural group</span>
+<span style="background:#f7dd8f">displaced (arrow from natural group)</span>
+</p>
+{{range .Tables}}
+<h2>{{.Name}} ({{len .Groups}} groups)</h2>
+<svg width="{{.Width}}" height="{{.Height}}" xmlns="http://www.w3.org/2000/svg">
+<defs><marker id="arrow" markerWidth="6" markerHeight="6" refX="5" refY="3" orient="auto"><path d="M0,0 L6,3 L0,6 z" fill="#c93"/></marker></defs>
+{{range .Groups}}<text x="` + fmt.Sprint(arrowMargin) + `" y="{{.Y}}" dy="20">{{.Label}}</text>
+{{range .Cells}}<g><title>{{.Title}}</title><rect class="{{.Class}}" x="{{.X}}" y="{{.Y}}" width="` + fmt.Sprint(cellWidth-2) + `" height="` + fmt.Sprint(cellHeight-2) + `"/><text x="{{.X}}" y="{{.Y}}" dx="3" dy="13">{{.Text}}</text><text x="{{.X}}" y="{{.Y}}" dx="3" dy="27" fill="#555">{{.Sub}}</text></g>
+{{end}}{{end}}{{range .Arrows}}<line class="probe" x1="{{.X1}}" y1="{{.Y1}}" x2="{{.X2}}" y2="{{.Y2}}"/>
+{{end}}</svg>
+{{end}}
+</body>
+</html>
+`))
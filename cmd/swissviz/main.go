@@ -0,0 +1,97 @@
+// Command swissviz renders the internal layout of a swisstable.Map,
+// including control bytes, group occupancy, probe chains, tombstones,
+// and the per-group growth status flags while growing.
+//
+// It builds a Map by inserting keys, optionally deleting some of them,
+// and then writes the layout as text or as a standalone HTML page with SVG.
+//
+// Example:
+//
+//	swissviz -cap 8 -n 40 -hash identity -del 3 -format html -o layout.html
+//
+// Using a weak hash function (identity or zero) makes the placement of keys predictable,
+// which is useful for investigating fuzz failures and for teaching.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/thepudds/swisstable"
+)
+
+var (
+	capFlag    = flag.Int("cap", 8, "capacity hint for New")
+	nFlag      = flag.Int("n", 20, "number of keys to insert")
+	startFlag  = flag.Int64("start", 0, "first key to insert")
+	strideFlag = flag.Int64("stride", 1, "stride between inserted keys")
+	delFlag    = flag.Int("del", 0, "if non-zero, delete every Nth inserted key after inserting")
+	hashFlag   = flag.String("hash", "runtime", "hash function: runtime, identity, or zero")
+	seedFlag   = flag.Uint64("seed", 0, "hash seed (0 picks a random seed for the runtime hash)")
+	formatFlag = flag.String("format", "text", "output format: text or html")
+	outFlag    = flag.String("o", "", "output file (default stdout)")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "swissviz:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var opts []swisstable.Option
+	switch *hashFlag {
+	case "runtime":
+	case "identity":
+		opts = append(opts, swisstable.WithHashFunc(func(k swisstable.Key, seed uintptr) uint64 {
+			return uint64(k)
+		}))
+	case "zero":
+		opts = append(opts, swisstable.WithHashFunc(func(k swisstable.Key, seed uintptr) uint64 {
+			return 0
+		}))
+	default:
+		return fmt.Errorf("unknown hash function %q", *hashFlag)
+	}
+	if *seedFlag != 0 {
+		opts = append(opts, swisstable.WithSeed(uintptr(*seedFlag)))
+	}
+
+	m := swisstable.New(*capFlag, opts...)
+	var keys []swisstable.Key
+	for i := 0; i < *nFlag; i++ {
+		k := swisstable.Key(*startFlag + int64(i)**strideFlag)
+		m.Set(k, swisstable.Value(k))
+		keys = append(keys, k)
+	}
+	if *delFlag > 0 {
+		for i := 0; i < len(keys); i += *delFlag {
+			m.Delete(keys[i])
+		}
+	}
+
+	var b bytes.Buffer
+	switch *formatFlag {
+	case "text":
+		if err := m.DebugDump(&b); err != nil {
+			return err
+		}
+	case "html":
+		if err := writeHTML(&b, m.DebugInfo()); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *formatFlag)
+	}
+
+	if *outFlag == "" {
+		_, err := os.Stdout.Write(b.Bytes())
+		return err
+	}
+	// WriteFile reports an error from closing the file, such as a failed write of buffered data.
+	return os.WriteFile(*outFlag, b.Bytes(), 0o666)
+}
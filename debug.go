@@ -0,0 +1,201 @@
+package swisstable
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WithHashFunc returns an Option that replaces the hash function used by the Map.
+// It is intended for testing and debugging, such as using a weak hash function
+// to make the placement of keys predictable.
+func WithHashFunc(f func(k Key, seed uintptr) uint64) Option {
+	return func(m *Map) {
+		m.hashFunc = f
+	}
+}
+
+// WithSeed returns an Option that sets the hash seed used by the Map.
+// It is intended for testing and debugging, such as making iteration order
+// or the placement of keys reproducible.
+func WithSeed(seed uintptr) Option {
+	return func(m *Map) {
+		m.seed = seed
+	}
+}
+
+// SlotState describes the contents of a position in a table.
+type SlotState byte
+
+const (
+	SlotEmpty SlotState = iota
+	SlotDeleted
+	SlotStored
+)
+
+func (s SlotState) String() string {
+	switch s {
+	case SlotEmpty:
+		return "empty"
+	case SlotDeleted:
+		return "deleted"
+	case SlotStored:
+		return "stored"
+	default:
+		return fmt.Sprintf("SlotState(%d)", byte(s))
+	}
+}
+
+// DebugSlot describes one position in a table.
+type DebugSlot struct {
+	State   SlotState
+	Control byte
+	// Key and Value are only meaningful if State is SlotStored.
+	Key   Key
+	Value Value
+	// NaturalGroup is the group the key hashes to, and ProbeLength is how
+	// many probes beyond the natural group the key is stored.
+	// H2 is the 7-bit hash of the key that the hashed layout keeps in the control byte.
+	// It is computed from the key, so it is also set in small mode, where Control does not hold it.
+	// They are only meaningful if State is SlotStored.
+	NaturalGroup int
+	ProbeLength  int
+	H2           byte
+}
+
+// DebugGroup describes one group in a table.
+type DebugGroup struct {
+	Index int
+	Slots [16]DebugSlot
+
+	// The growth status flags are only set for groups in the old table while growing.
+	// Note that CurHasDisplaced describes groups in the current table
+	// whose index maps to this old group.
+	Evacuated       bool
+	ChainEvacuated  bool
+	CurHasDisplaced bool
+}
+
+// Flags returns the names of the growth status flags set for g.
+func (g *DebugGroup) Flags() []string {
+	var flags []string
+	if g.Evacuated {
+		flags = append(flags, "evacuated")
+	}
+	if g.ChainEvacuated {
+		flags = append(flags, "chain-evacuated")
+	}
+	if g.CurHasDisplaced {
+		flags = append(flags, "cur-has-displaced")
+	}
+	return flags
+}
+
+// DebugTable describes a table.
+type DebugTable struct {
+	Name        string
+	DeleteCount int
+	Groups      []DebugGroup
+}
+
+// DebugInfo is a detailed snapshot of the internal layout of a Map.
+type DebugInfo struct {
+	Len     int
+	Growing bool
+	// Small reports whether the map is in small mode, where the control byte of a stored
+	// slot does not hold the key's h2. See small.go.
+	Small       bool
+	SweepCursor int
+	Current     DebugTable
+	// Old is nil unless Growing.
+	Old *DebugTable
+}
+
+// DebugInfo returns a detailed snapshot of the internal layout of m,
+// including control bytes, slots, probe lengths, and growth status.
+// It is intended for debugging and visualization, and rehashes every key.
+func (m *Map) DebugInfo() DebugInfo {
+	info := DebugInfo{
+		Len:         m.elemCount,
+		Growing:     m.old != nil,
+		Small:       m.small,
+		SweepCursor: int(m.sweepCursor),
+		Current:     m.debugTable("current", &m.current, m.hashFunc, nil),
+	}
+	if m.old != nil {
+		old := m.debugTable("old", m.old, m.oldHashFunc, m.growStatus)
+		info.Old = &old
+	}
+	return info
+}
+
+func (m *Map) debugTable(name string, t *fixedTable, hashFunc hashFunc, growStatus growStatus) DebugTable {
+	dt := DebugTable{
+		Name:        name,
+		DeleteCount: t.deleteCount,
+		Groups:      make([]DebugGroup, t.groups()),
+	}
+	for g := range dt.Groups {
+		dg := &dt.Groups[g]
+		dg.Index = g
+		if growStatus != nil {
+			dg.Evacuated = growStatus.isEvacuated(uint64(g))
+			dg.ChainEvacuated = growStatus.isChainEvacuated(uint64(g))
+			dg.CurHasDisplaced = growStatus.curHasDisplaced(uint64(g))
+		}
+		control := t.groupControl(uint64(g))
+		for offset := range dg.Slots {
+			ds := &dg.Slots[offset]
+			ds.Control = control[offset]
+			switch {
+			case control[offset] == emptySentinel:
+				ds.State = SlotEmpty
+			case control[offset] == deletedSentinel:
+				ds.State = SlotDeleted
+			default:
+				ds.State = SlotStored
+				kv := t.slot(uint64(g), offset)
+				ds.Key = kv.Key
+				ds.Value = kv.Value
+				h := hashFunc(ds.Key, m.seed)
+				ds.NaturalGroup = int(h & t.groupMask)
+				ds.H2 = t.h2(h) &^ 0x80
+				ds.ProbeLength = t.probeLength(h, uint64(g))
+			}
+		}
+	}
+	return dt
+}
+
+// DebugDump writes a human readable description of the internal layout of m to w.
+func (m *Map) DebugDump(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	info := m.DebugInfo()
+	fmt.Fprintf(bw, "len: %d growing: %v small: %v sweep cursor: %d\n", info.Len, info.Growing, info.Small, info.SweepCursor)
+	tables := []*DebugTable{&info.Current}
+	if info.Old != nil {
+		tables = append(tables, info.Old)
+	}
+	for _, t := range tables {
+		fmt.Fprintf(bw, "\n=== %s (%d groups, %d deleted) ===\n", t.Name, len(t.Groups), t.DeleteCount)
+		for _, g := range t.Groups {
+			fmt.Fprintf(bw, "\n%s group %d", t.Name, g.Index)
+			if flags := g.Flags(); len(flags) > 0 {
+				fmt.Fprintf(bw, " [%s]", strings.Join(flags, " "))
+			}
+			fmt.Fprintln(bw, "\n-----")
+			for offset, s := range g.Slots {
+				fmt.Fprintf(bw, "%2d %08b %-7s", offset, s.Control, s.State)
+				if s.State == SlotStored {
+					fmt.Fprintf(bw, " key: %v value: %v", s.Key, s.Value)
+					if s.ProbeLength > 0 {
+						fmt.Fprintf(bw, " (displaced from group %d, probe length %d)", s.NaturalGroup, s.ProbeLength)
+					}
+				}
+				fmt.Fprintln(bw)
+			}
+		}
+	}
+	return bw.Flush()
+}
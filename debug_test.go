@@ -0,0 +1,108 @@
+package swisstable
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMap_DebugDump(t *testing.T) {
+	m := New(16, WithHashFunc(zeroHash)) // 32 slots, 2 groups
+	for k := Key(0); k < 20; k++ {
+		m.Set(k, Value(k))
+	}
+	m.Delete(3)
+
+	var buf bytes.Buffer
+	if err := m.DebugDump(&buf); err != nil {
+		t.Fatalf("Map.DebugDump() error = %v", err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		"len: 19 growing: false",
+		"=== current (2 groups, 1 deleted) ===",
+		" 3 01111111 deleted",
+		" 0 10000000 stored  key: 16 value: 16 (displaced from group 0, probe length 1)",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Map.DebugDump() missing %q, got:\n%s", want, got)
+		}
+	}
+}
+
+func TestMap_DebugInfoGrowing(t *testing.T) {
+	m := New(20_000) // 32768 slots, resize threshold of 26624
+	// Continue a little past the start of growth so that some groups are ChainEvacuated
+	// regardless of the seed, but not so far that we finish growing.
+	for k := Key(0); k < 26_700; k++ {
+		m.Set(k, Value(k))
+	}
+
+	info := m.DebugInfo()
+	if !info.Growing || info.Old == nil {
+		t.Fatalf("Map.DebugInfo() Growing = %v, want true", info.Growing)
+	}
+	var stored, evacuated, chainEvacuated int
+	for _, table := range []*DebugTable{&info.Current, info.Old} {
+		for _, g := range table.Groups {
+			for _, s := range g.Slots {
+				if s.State == SlotStored {
+					stored++
+				}
+			}
+		}
+	}
+	for _, g := range info.Old.Groups {
+		if g.Evacuated {
+			evacuated++
+			// Evacuated groups in old have been copied to current, so don't double count.
+			for _, s := range g.Slots {
+				if s.State == SlotStored {
+					stored--
+				}
+			}
+		}
+		if g.ChainEvacuated {
+			chainEvacuated++
+		}
+	}
+	if stored != info.Len {
+		t.Errorf("Map.DebugInfo() has %d live stored slots, want %d", stored, info.Len)
+	}
+	if evacuated == 0 || chainEvacuated == 0 || evacuated == len(info.Old.Groups) {
+		t.Errorf("Map.DebugInfo() has %d evacuated and %d chain evacuated of %d old groups, want some but not all",
+			evacuated, chainEvacuated, len(info.Old.Groups))
+	}
+}
+
+func TestMap_DebugInfoH2(t *testing.T) {
+	small := New(0, WithSeed(7))
+	hashed := New(0, WithSeed(7), SingleWriter())
+	for k := Key(0); k < 10; k++ {
+		small.Set(k, Value(k))
+		hashed.Set(k, Value(k))
+	}
+	smallInfo, hashedInfo := small.DebugInfo(), hashed.DebugInfo()
+	if !smallInfo.Small || hashedInfo.Small {
+		t.Fatalf("Map.DebugInfo() Small = %v and %v, want true and false", smallInfo.Small, hashedInfo.Small)
+	}
+
+	// h2 maps each key to its 7-bit hash in the hashed layout.
+	h2 := make(map[Key]byte)
+	for _, s := range hashedInfo.Current.Groups[0].Slots {
+		if s.State == SlotStored {
+			if s.H2 != s.Control&^0x80 {
+				t.Errorf("hashed Map.DebugInfo() key %v: H2 %02x, control %08b", s.Key, s.H2, s.Control)
+			}
+			h2[s.Key] = s.H2
+		}
+	}
+	for _, s := range smallInfo.Current.Groups[0].Slots {
+		if s.State == SlotStored && s.H2 != h2[s.Key] {
+			t.Errorf("small Map.DebugInfo() key %v: H2 %02x, want %02x", s.Key, s.H2, h2[s.Key])
+		}
+	}
+	if len(h2) != 10 {
+		t.Errorf("hashed Map.DebugInfo() has %d stored slots, want 10", len(h2))
+	}
+}
@@ -0,0 +1,157 @@
+package swisstable
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// JSON and gob encoding.
+//
+// For JSON, a Map is encoded as an object with the keys as decimal strings,
+// which matches how encoding/json encodes a map[int64]int64. By default,
+// the keys are written in iteration order. The SortedJSON option
+// makes the output deterministic by writing the keys in increasing numeric order
+// (unlike encoding/json, which sorts map keys as strings), which costs an extra
+// allocation and a sort.
+//
+// For gob, a Map is encoded using the entries kind of the binary format
+// (see binary.go). The table layout is not useful with the default runtime hash
+// in another process, and the entries are more compact than the layout.
+
+// SortedJSON returns an Option that makes MarshalJSON write keys in increasing order.
+func SortedJSON() Option {
+	return func(m *Map) {
+		m.sortedJSON = true
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m *Map) MarshalJSON() ([]byte, error) {
+	// Like Get, we are a reader, so we could be racing with a writer.
+	if m.flags&hashWriting != 0 {
+		fatal("concurrent map read and map write")
+	}
+	// Roughly 12 bytes per key/value for small numbers.
+	b := make([]byte, 0, 2+m.elemCount*12)
+	b = append(b, '{')
+	first := true
+	appendKV := func(k Key, v Value) {
+		if !first {
+			b = append(b, ',')
+		}
+		first = false
+		b = append(b, '"')
+		b = strconv.AppendInt(b, int64(k), 10)
+		b = append(b, '"', ':')
+		b = strconv.AppendInt(b, int64(v), 10)
+	}
+
+	if m.sortedJSON {
+		kvs := make([]KV, 0, m.elemCount)
+		m.Range(func(k Key, v Value) bool {
+			kvs = append(kvs, KV{Key: k, Value: v})
+			return true
+		})
+		sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+		for _, kv := range kvs {
+			appendKV(kv.Key, kv.Value)
+		}
+	} else {
+		m.Range(func(k Key, v Value) bool {
+			appendKV(k, v)
+			return true
+		})
+	}
+	b = append(b, '}')
+	return b, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It replaces the contents of m with the key/values in data.
+// Like encoding/json with a map[int64]int64, keys must be strings
+// containing integers, and for duplicate keys, the last value wins.
+// m may also be a zero Map, such as one allocated by a decoder.
+func (m *Map) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("swisstable: %v", err)
+	}
+	if tok == nil {
+		// By convention, null is a no-op.
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("swisstable: cannot unmarshal JSON %v into Map", tok)
+	}
+
+	// Decode everything first, which lets us size the table from the element count
+	// and leaves m unchanged if data is invalid.
+	var kvs []KV
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("swisstable: %v", err)
+		}
+		ks := tok.(string) // object keys are always strings
+		k, err := strconv.ParseInt(ks, 10, 64)
+		if err != nil {
+			return fmt.Errorf("swisstable: invalid JSON key %q: %v", ks, err)
+		}
+
+		tok, err = dec.Token()
+		if err != nil {
+			return fmt.Errorf("swisstable: %v", err)
+		}
+		n, ok := tok.(json.Number)
+		if !ok {
+			return fmt.Errorf("swisstable: invalid JSON value %v for key %q", tok, ks)
+		}
+		v, err := strconv.ParseInt(string(n), 10, 64)
+		if err != nil {
+			return fmt.Errorf("swisstable: invalid JSON value %v for key %q: %v", n, ks, err)
+		}
+		kvs = append(kvs, KV{Key: Key(k), Value: Value(v)})
+	}
+	if _, err := dec.Token(); err != nil {
+		// The closing '}'.
+		return fmt.Errorf("swisstable: %v", err)
+	}
+
+	m.load(kvs)
+	return nil
+}
+
+// GobEncode implements gob.GobEncoder.
+func (m *Map) GobEncode() ([]byte, error) {
+	if m.flags&hashWriting != 0 {
+		fatal("concurrent map read and map write")
+	}
+	return m.marshalEntries(), nil
+}
+
+// GobDecode implements gob.GobDecoder.
+// It replaces the contents of m, and m may also be a zero Map.
+func (m *Map) GobDecode(data []byte) error {
+	return m.UnmarshalBinary(data)
+}
+
+// load replaces the contents of m with kvs, sizing the table for len(kvs).
+// For duplicate keys, the last value wins.
+func (m *Map) load(kvs []KV) {
+	m.beginWrite()
+	defer m.endWrite()
+	m.initDefaults()
+	m.reset(calcTableSize(len(kvs)))
+	for _, kv := range kvs {
+		m.set(kv.Key, kv.Value, 1, true)
+	}
+	if m.swmr {
+		m.publish()
+	}
+}
@@ -0,0 +1,194 @@
+package swisstable
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var (
+	_ json.Marshaler   = (*Map)(nil)
+	_ json.Unmarshaler = (*Map)(nil)
+	_ gob.GobEncoder   = (*Map)(nil)
+	_ gob.GobDecoder   = (*Map)(nil)
+)
+
+// contents returns the key/values in m as a runtime map.
+func contents(m *Map) map[Key]Value {
+	got := make(map[Key]Value)
+	m.Range(func(k Key, v Value) bool {
+		got[k] = v
+		return true
+	})
+	return got
+}
+
+func TestMap_JSON(t *testing.T) {
+	tests := []struct {
+		name string
+		kvs  []KV
+	}{
+		{"empty", nil},
+		{"one", []KV{{Key: 1, Value: 2}}},
+		{"negative and extremes", []KV{
+			{Key: -1, Value: -100},
+			{Key: 0, Value: 0},
+			{Key: 9223372036854775807, Value: -9223372036854775808},
+			{Key: -9223372036854775808, Value: 9223372036854775807},
+		}},
+		{"many", func() []KV {
+			var kvs []KV
+			for k := Key(0); k < 1000; k++ {
+				kvs = append(kvs, KV{Key: k * 7, Value: Value(k)})
+			}
+			return kvs
+		}()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(0)
+			std := make(map[int64]int64)
+			for _, kv := range tt.kvs {
+				m.Set(kv.Key, kv.Value)
+				std[int64(kv.Key)] = int64(kv.Value)
+			}
+
+			// With SortedJSON, keys are in increasing numeric order.
+			// (encoding/json instead sorts map keys as strings).
+			sortedKVs := append([]KV(nil), tt.kvs...)
+			sort.Slice(sortedKVs, func(i, j int) bool { return sortedKVs[i].Key < sortedKVs[j].Key })
+			var parts []string
+			for _, kv := range sortedKVs {
+				parts = append(parts, fmt.Sprintf("%q:%d", fmt.Sprint(kv.Key), kv.Value))
+			}
+			wantJSON := "{" + strings.Join(parts, ",") + "}"
+			sorted := New(0, SortedJSON())
+			for _, kv := range tt.kvs {
+				sorted.Set(kv.Key, kv.Value)
+			}
+			gotJSON, err := json.Marshal(sorted)
+			if err != nil {
+				t.Fatalf("json.Marshal() error: %v", err)
+			}
+			if string(gotJSON) != wantJSON {
+				t.Errorf("json.Marshal() with SortedJSON = %.200s, want %.200s", gotJSON, wantJSON)
+			}
+
+			// Without sorting, the output should still decode to the same runtime map.
+			unsortedJSON, err := json.Marshal(m)
+			if err != nil {
+				t.Fatalf("json.Marshal() error: %v", err)
+			}
+			gotStd := make(map[int64]int64)
+			if err := json.Unmarshal(unsortedJSON, &gotStd); err != nil {
+				t.Fatalf("json.Unmarshal() into runtime map error: %v", err)
+			}
+			if diff := cmp.Diff(std, gotStd); diff != "" {
+				t.Errorf("json.Marshal() mismatch (-want +got):\n%s", diff)
+			}
+
+			// Round trip, including into a zero Map allocated by encoding/json.
+			var wrapper struct{ M *Map }
+			if err := json.Unmarshal([]byte(`{"M":`+string(unsortedJSON)+`}`), &wrapper); err != nil {
+				t.Fatalf("json.Unmarshal() error: %v", err)
+			}
+			if diff := cmp.Diff(contents(m), contents(wrapper.M)); diff != "" {
+				t.Errorf("json.Unmarshal() mismatch (-want +got):\n%s", diff)
+			}
+			if wrapper.M.Len() != len(tt.kvs) {
+				t.Errorf("Map.Len() = %d, want %d", wrapper.M.Len(), len(tt.kvs))
+			}
+			if want := calcTableSize(len(tt.kvs)); wrapper.M.current.size() != want {
+				t.Errorf("table size = %d, want %d", wrapper.M.current.size(), want)
+			}
+			// The decoded Map keeps working.
+			wrapper.M.Set(12345678, 1)
+			if v, ok := wrapper.M.Get(12345678); !ok || v != 1 {
+				t.Errorf("Map.Get() after Set = %v, %v, want 1, true", v, ok)
+			}
+		})
+	}
+}
+
+func TestMap_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[Key]Value
+		wantErr string
+	}{
+		{name: "duplicate keys", data: `{"1":1,"2":2,"1":3}`, want: map[Key]Value{1: 3, 2: 2}},
+		{name: "whitespace", data: " { \"-5\" : 7 } ", want: map[Key]Value{-5: 7}},
+		{name: "null", data: `null`, want: map[Key]Value{100: 100}}, // unchanged
+		{name: "not an object", data: `[1,2]`, wantErr: "cannot unmarshal"},
+		{name: "bad key", data: `{"a":1}`, wantErr: "invalid JSON key"},
+		{name: "key out of range", data: `{"9223372036854775808":1}`, wantErr: "invalid JSON key"},
+		{name: "float value", data: `{"1":1.5}`, wantErr: "invalid JSON value"},
+		{name: "string value", data: `{"1":"1"}`, wantErr: "invalid JSON value"},
+		{name: "truncated", data: `{"1":1`, wantErr: "swisstable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(0)
+			m.Set(100, 100)
+			err := m.UnmarshalJSON([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Map.UnmarshalJSON() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				// Invalid data leaves the Map unchanged.
+				tt.want = map[Key]Value{100: 100}
+			} else if err != nil {
+				t.Fatalf("Map.UnmarshalJSON() error: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, contents(m)); diff != "" {
+				t.Errorf("Map.UnmarshalJSON() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMap_Gob(t *testing.T) {
+	type wrapper struct {
+		Name string
+		M    *Map
+	}
+
+	m := New(0)
+	for k := Key(0); k < 5000; k++ {
+		m.Set(k, Value(-k))
+	}
+	for k := Key(0); k < 5000; k += 2 {
+		m.Delete(k)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(wrapper{Name: "test", M: m}); err != nil {
+		t.Fatalf("gob Encode() error: %v", err)
+	}
+	var got wrapper
+	if err := gob.NewDecoder(&buf).Decode(&got); err != nil {
+		t.Fatalf("gob Decode() error: %v", err)
+	}
+	if got.Name != "test" {
+		t.Errorf("Name = %q, want %q", got.Name, "test")
+	}
+	if diff := cmp.Diff(contents(m), contents(got.M)); diff != "" {
+		t.Errorf("gob round trip mismatch (-want +got):\n%s", diff)
+	}
+	if got.M.Len() != 2500 {
+		t.Errorf("Map.Len() = %d, want 2500", got.M.Len())
+	}
+	// The table is pre-sized, so loading does not grow.
+	if got.M.resizeGenerations != 0 {
+		t.Errorf("resizeGenerations = %d, want 0", got.M.resizeGenerations)
+	}
+}
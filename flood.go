@@ -0,0 +1,81 @@
+package swisstable
+
+// Hash flooding detection.
+//
+// With a weak hash function, or keys chosen by an adversary, many keys can share
+// a natural group, leading to very long probe chains and quadratic behavior.
+// When Set sees a probe chain of floodProbeLimit groups or more while inserting a new key,
+// we pick a new hash function by mixing a new salt into the output of the original
+// hash function, and rehash into a fresh table of the same size using the same
+// incremental growth used when resizing, which means iterators stay valid.
+//
+// Because we mix the output of the original hash function, this also helps with
+// weak hash functions that ignore the seed (such as an identity hash),
+// but not with hash functions that map many keys to the same 64-bit hash.
+// To avoid repeatedly rehashing in that case, we rehash at most once per table size.
+
+// maxFloodProbeLimit is the probe count that triggers a rehash in large tables.
+// With a reasonable hash function and our maximum load factor, the longest probe chain
+// slowly increases with table size. In experiments with sequential keys and the runtime hash,
+// tables with 32K slots have a longest chain of 4-9 groups, and tables with 2M slots have a
+// longest chain of 8-12 groups, so a probe chain this long is extremely unlikely
+// without flooding.
+const maxFloodProbeLimit = 32
+
+// minFloodProbeLimit is the smallest probe count that triggers a rehash.
+// A probe chain visits each group at most once, so a table with this many groups
+// or fewer never rehashes, but its probe chains are also too short to matter.
+const minFloodProbeLimit = 4
+
+// floodProbeLimit returns the probe count that triggers a rehash in a table with
+// the given number of groups. A table smaller than 64 groups can never have a probe chain
+// of maxFloodProbeLimit, so we use half the groups instead, which a reasonable hash function
+// is still very unlikely to reach.
+func floodProbeLimit(groups uint64) uint64 {
+	limit := groups / 2
+	if limit > maxFloodProbeLimit {
+		limit = maxFloodProbeLimit
+	}
+	if limit < minFloodProbeLimit {
+		limit = minFloodProbeLimit
+	}
+	return limit
+}
+
+// floodCheck starts a rehash if allowed, and reports whether it did.
+// It is called when Set observes a long probe chain.
+func (m *Map) floodCheck() bool {
+	if m.old != nil || m.disableResizing || m.current.size() <= m.floodTableSize {
+		return false
+	}
+	m.startRehash()
+	return true
+}
+
+// startRehash starts an incremental grow into a new table of the same size
+// using a new hash function.
+func (m *Map) startRehash() {
+	m.floodTableSize = m.current.size()
+	m.floodRehashes++
+	if m.baseHashFunc == nil {
+		m.baseHashFunc = m.hashFunc
+	}
+	base := m.baseHashFunc
+
+	// Derive the salt from the seed, which keeps things reproducible for a given seed
+	// while still being unpredictable for a random seed.
+	salt := mix64(uint64(m.seed) + uint64(m.floodRehashes)*0x9E3779B97F4A7C15)
+	m.startGrow(m.current.size(), func(k Key, seed uintptr) uint64 {
+		return mix64(base(k, seed) ^ salt)
+	}, true)
+}
+
+// mix64 is the 64-bit finalizer from MurmurHash3.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,192 @@
+package swisstable
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMap_FloodRehash(t *testing.T) {
+	tests := []struct {
+		name          string
+		hashFunc      hashFunc
+		n             int
+		key           func(i int) Key
+		wantRehash    bool
+		maxProbeLimit int // if non-zero, the maximum probe length we expect after rehashing
+	}{
+		{
+			// With identityHash, these keys all share the same natural group
+			// and the same h2 until we rehash.
+			name:          "identity hash, colliding keys",
+			hashFunc:      identityHash,
+			n:             1000,
+			key:           func(i int) Key { return Key(i) << 20 },
+			wantRehash:    true,
+			maxProbeLimit: maxFloodProbeLimit,
+		},
+		{
+			name:       "identity hash, sequential keys",
+			hashFunc:   identityHash,
+			n:          1000,
+			key:        func(i int) Key { return Key(i) },
+			wantRehash: false,
+		},
+		{
+			// Rehashing can't help if all keys have the same 64-bit hash,
+			// but we should still be correct and not rehash repeatedly.
+			name:       "zero hash",
+			hashFunc:   zeroHash,
+			n:          1000,
+			key:        func(i int) Key { return Key(i) },
+			wantRehash: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(1024, WithHashFunc(tt.hashFunc), WithSeed(42))
+			for i := 0; i < tt.n; i++ {
+				m.Set(tt.key(i), Value(i))
+			}
+
+			// Get also checks old while any rehash is in progress.
+			for i := 0; i < tt.n; i++ {
+				got, ok := m.Get(tt.key(i))
+				if !ok || got != Value(i) {
+					t.Fatalf("Map.Get(%v) = %v, %v, want %v, true", tt.key(i), got, ok, i)
+				}
+			}
+			seen := make(map[Key]bool)
+			m.Range(func(k Key, v Value) bool {
+				if seen[k] {
+					t.Fatalf("Map.Range() returned duplicate key %v", k)
+				}
+				seen[k] = true
+				return true
+			})
+			if len(seen) != tt.n || m.Len() != tt.n {
+				t.Fatalf("Map.Range() returned %d keys, Map.Len() = %d, want %d", len(seen), m.Len(), tt.n)
+			}
+
+			stats := m.Stats()
+			if (stats.FloodRehashes > 0) != tt.wantRehash {
+				t.Errorf("Map.Stats() FloodRehashes = %d, want rehash %v", stats.FloodRehashes, tt.wantRehash)
+			}
+			// We rehash at most once per table size.
+			if stats.FloodRehashes > stats.ResizeGenerations+1 {
+				t.Errorf("Map.Stats() FloodRehashes = %d, ResizeGenerations = %d, want at most one rehash per table size",
+					stats.FloodRehashes, stats.ResizeGenerations)
+			}
+			if tt.maxProbeLimit > 0 && !stats.Growing && len(stats.ProbeLengths)-1 > tt.maxProbeLimit {
+				t.Errorf("Map.Stats() max probe length = %d, want <= %d", len(stats.ProbeLengths)-1, tt.maxProbeLimit)
+			}
+
+			// Deleting everything should also work after rehashing.
+			for i := 0; i < tt.n; i++ {
+				m.Delete(tt.key(i))
+			}
+			if m.Len() != 0 {
+				t.Errorf("Map.Len() = %d after deleting all keys, want 0", m.Len())
+			}
+			for i := 0; i < tt.n; i++ {
+				if _, ok := m.Get(tt.key(i)); ok {
+					t.Fatalf("Map.Get(%v) found deleted key", tt.key(i))
+				}
+			}
+		})
+	}
+}
+
+func TestMap_FloodRehashSmallTable(t *testing.T) {
+	tests := []struct {
+		capacity   int
+		n          int
+		wantRehash bool
+	}{
+		// 2 and 4 groups are too small for a probe chain to reach minFloodProbeLimit.
+		{capacity: 16, n: 20, wantRehash: false},
+		{capacity: 40, n: 40, wantRehash: false},
+		// 8 groups with a limit of 4, and 16 groups with a limit of 8.
+		{capacity: 100, n: 90, wantRehash: true},
+		{capacity: 200, n: 150, wantRehash: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("capacity %d", tt.capacity), func(t *testing.T) {
+			m := New(tt.capacity, WithHashFunc(identityHash), WithSeed(42))
+			groups := m.current.groupMask + 1
+			// With identityHash, these keys all share the same natural group.
+			key := func(i int) Key { return Key(i) << 20 }
+			for i := 0; i < tt.n; i++ {
+				m.Set(key(i), Value(i))
+			}
+			if m.current.groupMask+1 != groups && m.floodRehashes == 0 {
+				t.Fatalf("table grew from %d to %d groups, want flooding in the original table", groups, m.current.groupMask+1)
+			}
+			if got := m.floodRehashes > 0; got != tt.wantRehash {
+				t.Errorf("Map floodRehashes = %d with %d groups and a limit of %d, want rehash %v",
+					m.floodRehashes, groups, floodProbeLimit(groups), tt.wantRehash)
+			}
+			for i := 0; i < tt.n; i++ {
+				if got, ok := m.Get(key(i)); !ok || got != Value(i) {
+					t.Fatalf("Map.Get(%v) = %v, %v, want %v, true", key(i), got, ok, i)
+				}
+			}
+		})
+	}
+}
+
+func TestFloodProbeLimit(t *testing.T) {
+	tests := []struct {
+		groups uint64
+		want   uint64
+	}{
+		{1, minFloodProbeLimit},
+		{4, minFloodProbeLimit},
+		{8, 4},
+		{16, 8},
+		{32, 16},
+		{64, maxFloodProbeLimit},
+		{1 << 20, maxFloodProbeLimit},
+	}
+	for _, tt := range tests {
+		if got := floodProbeLimit(tt.groups); got != tt.want {
+			t.Errorf("floodProbeLimit(%d) = %d, want %d", tt.groups, got, tt.want)
+		}
+	}
+}
+
+func TestMap_FloodRehashRange(t *testing.T) {
+	// Start iterating, then trigger a rehash in the middle of iterating.
+	// We expect to see each key that is present for the whole iteration exactly once.
+	m := New(1024, WithHashFunc(identityHash), WithSeed(42))
+	key := func(i int) Key { return Key(i) << 20 }
+	for i := 0; i < 5; i++ {
+		m.Set(key(i), Value(i))
+	}
+
+	seen := make(map[Key]int)
+	added := false
+	m.Range(func(k Key, v Value) bool {
+		seen[k]++
+		if !added {
+			for i := 5; i < 1000; i++ {
+				m.Set(key(i), Value(i))
+			}
+			added = true
+			if m.Stats().FloodRehashes == 0 {
+				t.Fatalf("expected a flood rehash")
+			}
+		}
+		return true
+	})
+	for i := 0; i < 5; i++ {
+		if seen[key(i)] != 1 {
+			t.Errorf("Map.Range() returned key %v %d times, want 1", key(i), seen[key(i)])
+		}
+	}
+	for k, n := range seen {
+		if n != 1 {
+			t.Errorf("Map.Range() returned key %v %d times, want 1", k, n)
+		}
+	}
+}
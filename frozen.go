@@ -0,0 +1,143 @@
+package swisstable
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+// FrozenMap is an immutable map created by Map.Freeze.
+//
+// Because all keys are known up front and nothing is ever deleted, a FrozenMap can
+// use a higher load factor than Map, has no DELETED control bytes, and places
+// keys to minimize probe lengths. Get does not need to check for growth, misuse,
+// or single-writer mode, and a FrozenMap is safe for concurrent use by multiple goroutines.
+type FrozenMap struct {
+	table    fixedTable
+	hashFunc hashFunc
+	seed     uintptr
+	count    int
+}
+
+// frozenMaxLoad is the maximum load factor of a FrozenMap, as a fraction of 8.
+// We stay below a full table so that each probe chain ends in a group with an EMPTY slot.
+const frozenMaxLoad = 7
+
+// Freeze returns a FrozenMap with the current key/values of m.
+// m is not modified and can continue to be used.
+func (m *Map) Freeze() *FrozenMap {
+	kvs := make([]KV, 0, m.elemCount)
+	m.Range(func(k Key, v Value) bool {
+		kvs = append(kvs, KV{Key: k, Value: v})
+		return true
+	})
+
+	tableSize := 16
+	for tableSize*frozenMaxLoad/8 < len(kvs) {
+		tableSize <<= 1
+	}
+	fm := &FrozenMap{
+		table:    *newFixedTable(tableSize),
+		hashFunc: m.hashFunc,
+		seed:     m.seed,
+		count:    len(kvs),
+	}
+	if fm.hashFunc == nil {
+		// m is a zero Map.
+		fm.hashFunc = hashUint64
+		fm.seed = uintptr(fastrand())<<32 | uintptr(fastrand())
+	}
+	t := &fm.table
+
+	// We place keys in two passes. First, we place each key in its natural group
+	// if there is room, which means a key is only displaced if its natural group
+	// is full of other keys that also have it as their natural group.
+	// Second, we place the remaining keys in the first group
+	// with room along their probe sequence.
+	// A lookup for a displaced key never stops early because the groups earlier in
+	// its probe sequence were already full when we placed it, and we never remove anything.
+	// TODO: could go further, such as placing the keys of longer probe chains first.
+	hashes := make([]uint64, len(kvs))
+	var overflow []int
+	for i, kv := range kvs {
+		h := fm.hashFunc(kv.Key, fm.seed)
+		hashes[i] = h
+		group := h & t.groupMask
+		emptyBitmask := matchEmpty(t.groupControl(group))
+		if emptyBitmask == 0 {
+			overflow = append(overflow, i)
+			continue
+		}
+		offset := bits.TrailingZeros32(emptyBitmask)
+		t.setControl(group, offset, t.h2(h))
+		*t.slot(group, offset) = kv
+	}
+	for _, i := range overflow {
+		h := hashes[i]
+		group, offset := t.findFirstEmptyOrDeleted(h)
+		t.setControl(group, offset, t.h2(h))
+		*t.slot(group, offset) = kvs[i]
+	}
+	return fm
+}
+
+// Get returns the value for k, and whether k was found.
+//
+// For cold lookups, time is dominated by the cache misses on the control bytes and
+// the slot. Because Freeze places almost every key in its natural group, Get prefetches
+// that group's slots while it loads the control bytes, so the two misses overlap rather than
+// happen one after the other. This makes a cold Get about 35% faster than Map.Get
+// (GetAllStartCold), at a cost of roughly 1-2ns per hot lookup. An experiment storing the
+// control bytes of each group next to its slots was not faster.
+func (fm *FrozenMap) Get(k Key) (v Value, ok bool) {
+	h := fm.hashFunc(k, fm.seed)
+	t := &fm.table
+	group := h & t.groupMask
+	h2 := t.h2(h)
+
+	// Start loading the natural group's slots along with its control bytes. See prefetch.go.
+	// (A chunk with no keys might not be allocated.)
+	chunk, pos := t.locate(group)
+	if chunk.allocated() {
+		prefetchGroupSlots(uintptr(unsafe.Pointer(chunk.slot(pos))))
+	}
+
+	// Do quadratic probing, which terminates because there is always an EMPTY slot.
+	var probeCount uint64
+	for {
+		controlBytes := chunk.groupControl(pos)
+		bitmask, _ := MatchByte(h2, controlBytes)
+		for bitmask != 0 {
+			offset := bits.TrailingZeros32(bitmask)
+			kv := chunk.slot(pos + uint64(offset))
+			if kv.Key == k {
+				return kv.Value, true
+			}
+			bitmask &^= 1 << offset
+		}
+		if matchEmpty(controlBytes) != 0 {
+			return zeroValue(), false
+		}
+		probeCount++
+		group = (group + probeCount) & t.groupMask
+		chunk, pos = t.locate(group)
+	}
+}
+
+// Range calls f for each key/value, in no particular order, stopping if f returns false.
+func (fm *FrozenMap) Range(f func(key Key, value Value) bool) {
+	for ci := range fm.table.chunks {
+		for i, c := range fm.table.chunkControl(ci) {
+			if isStored(c) {
+				kv := *fm.table.chunks[ci].slot(uint64(i))
+				if !f(kv.Key, kv.Value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Len returns the number of key/values.
+func (fm *FrozenMap) Len() int {
+	return fm.count
+}
@@ -0,0 +1,268 @@
+package swisstable
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMap_Freeze(t *testing.T) {
+	tests := []struct {
+		name     string
+		hashFunc hashFunc
+		n        int
+		deletes  bool
+	}{
+		{"empty", hashUint64, 0, false},
+		{"one", hashUint64, 1, false},
+		{"one group", hashUint64, 14, false},
+		{"exact 7/8", hashUint64, 56, false},
+		{"large", hashUint64, 100_000, false},
+		{"large with deletes", hashUint64, 100_000, true},
+		{"identity hash", identityHash, 10_000, false},
+		{"zero hash", zeroHash, 500, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(0, WithHashFunc(tt.hashFunc))
+			for k := Key(0); k < Key(tt.n); k++ {
+				m.Set(k, Value(-k))
+			}
+			if tt.deletes {
+				for k := Key(0); k < Key(tt.n); k += 3 {
+					m.Delete(k)
+				}
+			}
+			want := contents(m)
+
+			fm := m.Freeze()
+			if fm.Len() != len(want) {
+				t.Errorf("FrozenMap.Len() = %d, want %d", fm.Len(), len(want))
+			}
+			for k, v := range want {
+				got, ok := fm.Get(k)
+				if !ok || got != v {
+					t.Fatalf("FrozenMap.Get(%v) = %v, %v, want %v, true", k, got, ok, v)
+				}
+			}
+			for k := Key(tt.n); k < Key(tt.n)+1000; k++ {
+				if got, ok := fm.Get(k); ok {
+					t.Fatalf("FrozenMap.Get(%v) = %v, true, want miss", k, got)
+				}
+			}
+			got := make(map[Key]Value)
+			fm.Range(func(k Key, v Value) bool {
+				got[k] = v
+				return true
+			})
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("FrozenMap.Range() mismatch (-want +got):\n%s", diff)
+			}
+
+			// The table should be right-sized for our load factor.
+			tableSize := fm.table.size()
+			if len(want) > tableSize*frozenMaxLoad/8 || (tableSize > 16 && len(want) <= tableSize/2*frozenMaxLoad/8) {
+				t.Errorf("table size = %d, not right-sized for %d key/values", tableSize, len(want))
+			}
+
+			// Keys should not be displaced unless their natural group is full
+			// of keys with the same natural group.
+			naturalCount := make([]int, fm.table.groups())
+			for k := range want {
+				h := fm.hashFunc(k, fm.seed)
+				naturalCount[h&fm.table.groupMask]++
+			}
+			control, slots := tableControl(&fm.table), tableSlots(&fm.table)
+			for pos, c := range control {
+				if c == deletedSentinel {
+					t.Fatalf("FrozenMap has a DELETED control byte")
+				}
+				if !isStored(c) {
+					continue
+				}
+				k := slots[pos].Key
+				natural := fm.hashFunc(k, fm.seed) & fm.table.groupMask
+				if uint64(pos/16) != natural && naturalCount[natural] <= 16 {
+					t.Fatalf("key %v displaced from group %d with only %d keys", k, natural, naturalCount[natural])
+				}
+			}
+
+			// m is unchanged.
+			if diff := cmp.Diff(want, contents(m)); diff != "" {
+				t.Errorf("Map changed by Freeze (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMap_FreezeGrowing(t *testing.T) {
+	m := New(20_000) // resize threshold of 26624
+	for k := Key(0); k < 26_625; k++ {
+		m.Set(k, Value(k))
+	}
+	if m.old == nil {
+		t.Fatal("expected to be growing")
+	}
+	fm := m.Freeze()
+	if diff := cmp.Diff(contents(m), func() map[Key]Value {
+		got := make(map[Key]Value)
+		fm.Range(func(k Key, v Value) bool {
+			got[k] = v
+			return true
+		})
+		return got
+	}()); diff != "" {
+		t.Errorf("FrozenMap.Range() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestFrozenMap_ConcurrentGet(t *testing.T) {
+	m := New(0)
+	for k := Key(0); k < 10_000; k++ {
+		m.Set(k, Value(k))
+	}
+	fm := m.Freeze()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := Key(0); k < 20_000; k++ {
+				v, ok := fm.Get(k)
+				if ok != (k < 10_000) || (ok && v != Value(k)) {
+					t.Errorf("FrozenMap.Get(%v) = %v, %v", k, v, ok)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkGetAllStartCold_Frozen creates many frozen maps so that they are
+// cold at the start. It is intended to be run with -benchtime=1x, and compared
+// with BenchmarkGetAllStartCold_Swiss.
+func BenchmarkGetAllStartCold_Frozen(b *testing.B) {
+	bms := almostGrowPointMapSizes([]int{
+		1 << 10,
+		1 << 20,
+		1 << 23,
+	})
+	if !*longTestFlag {
+		bms = []benchmark{
+			{"map size 1000000", 1_000_000},
+		}
+	}
+
+	for _, bm := range bms {
+		b.Run(bm.name, func(b *testing.B) {
+			minMem := *coldMemTestFlag * (1 << 20)
+
+			// we don't use overhead to keep the count of maps consistent
+			// across different implementations
+			mapMem := float64(bm.mapElements) * 16
+			mapCnt := int(math.Ceil(minMem / mapMem))
+
+			keys := make([]Key, bm.mapElements)
+			for i := 0; i < len(keys); i++ {
+				keys[i] = Key(i)
+			}
+
+			b.Logf("creating %d maps with %.1f MB of data. %d total keys", mapCnt, float64(mapCnt)*mapMem/(1<<20), mapCnt*bm.mapElements)
+			maps := make([]*FrozenMap, mapCnt)
+			for i := 0; i < mapCnt; i++ {
+				m := New(bm.mapElements)
+				for j := 0; j < bm.mapElements; j++ {
+					m.Set(Key(j), Value(j))
+				}
+				maps[i] = m.Freeze()
+			}
+
+			// Shuffle the keys after we have placed them in the maps.
+			// Otherwise, we could favor early entrants in a given bucket when reading below.
+			rand.Shuffle(len(keys), func(i, j int) {
+				keys[i], keys[j] = keys[j], keys[i]
+			})
+
+			getKeys := func(m *FrozenMap, ratio float64) {
+				count := int(ratio * float64(bm.mapElements))
+				for _, k := range keys {
+					if count == 0 {
+						break
+					}
+					count--
+					v, b := m.Get(Key(k))
+					sinkValue = v
+					sinkBool = b
+				}
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				for _, m := range maps {
+					getKeys(m, 1.0)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetHitHot_Frozen(b *testing.B) {
+	hotKeyCount := 20
+	lookupEachKey := 50
+
+	bms := almostGrowPointMapSizes([]int{
+		1 << 10,
+		1 << 20,
+		1 << 23,
+	})
+	if !*longTestFlag {
+		bms = []benchmark{
+			{"map size 1000000", 1_000_000},
+		}
+	}
+
+	for _, bm := range bms {
+		b.Run(bm.name, func(b *testing.B) {
+			// Fill the map under test
+			m := New(bm.mapElements)
+			for i := Key(0); i < Key(bm.mapElements); i++ {
+				m.Set(i, Value(i))
+			}
+			fm := m.Freeze()
+
+			// Generate random hot keys repeated N times then shuffled
+			var hotKeys []Key
+			for i := 0; i < hotKeyCount; i++ {
+				hotKeys = append(hotKeys, Key(rand.Intn(bm.mapElements)))
+			}
+			var gets []Key
+			for i := 0; i < hotKeyCount; i++ {
+				k := hotKeys[i]
+				for j := 0; j < lookupEachKey; j++ {
+					gets = append(gets, k)
+				}
+			}
+			rand.Shuffle(len(gets), func(i, j int) {
+				gets[i], gets[j] = gets[j], gets[i]
+			})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				for _, key := range gets {
+					v, b := fm.Get(key)
+					sinkInt = int64(v)
+					sinkBool = b
+				}
+			}
+		})
+	}
+}
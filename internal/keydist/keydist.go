@@ -0,0 +1,153 @@
+// Package keydist generates keys with different distributions for benchmarks and tests.
+//
+// Keys are int64s rather than swisstable.Keys so that tests inside package swisstable
+// can use this package without an import cycle.
+//
+// Most of our benchmarks and tests use sequential keys, which are friendly
+// to any hash function and to the CPU caches. Real workloads also see random 64-bit IDs,
+// clustered ranges of IDs, skewed access to a subset of keys, and sometimes keys
+// that collide in the bits of the hash used for the group (h1) or the control byte (h2).
+package keydist
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Dist is a named distribution of keys.
+type Dist struct {
+	// Name identifies the distribution, such as in benchmark names.
+	Name string
+
+	// keys returns n keys using r. They might contain duplicates,
+	// in which case Keys calls it again for more keys.
+	keys func(n int, r *rand.Rand) []int64
+}
+
+// maxStuckRounds is how many times in a row Keys asks for replacement keys
+// without getting a new one before deciding d cannot produce enough distinct keys.
+const maxStuckRounds = 100
+
+// Keys returns n distinct keys from d. The keys are reproducible for a given seed.
+// Keys panics if d cannot produce n distinct keys.
+func (d Dist) Keys(n int, seed int64) []int64 {
+	r := rand.New(rand.NewSource(seed))
+	keys := d.keys(n, r)
+	seen := make(map[int64]bool, n)
+	res := keys[:0]
+	for stuck := 0; len(res) < n; {
+		prev := len(res)
+		for _, k := range keys {
+			if !seen[k] && len(res) < n {
+				seen[k] = true
+				res = append(res, k)
+			}
+		}
+		if len(res) == prev {
+			stuck++
+			if stuck == maxStuckRounds {
+				panic(fmt.Sprintf("keydist: %s found only %d of %d distinct keys", d.Name, len(res), n))
+			}
+		} else {
+			stuck = 0
+		}
+		// Replace any duplicates.
+		keys = d.keys(n-len(res), r)
+	}
+	return res
+}
+
+// Sequential returns the keys start, start+stride, start+2*stride, ...
+// This is what most of our benchmarks use. stride must not be 0.
+func Sequential(start, stride int64) Dist {
+	if stride == 0 {
+		panic("keydist: Sequential with a stride of 0")
+	}
+	return Dist{
+		Name: "sequential",
+		keys: func(n int, r *rand.Rand) []int64 {
+			keys := make([]int64, n)
+			for i := range keys {
+				keys[i] = start + int64(i)*stride
+			}
+			return keys
+		},
+	}
+}
+
+// Uniform returns uniformly random 64-bit keys, such as random IDs.
+func Uniform() Dist {
+	return Dist{
+		Name: "uniform",
+		keys: func(n int, r *rand.Rand) []int64 {
+			keys := make([]int64, n)
+			for i := range keys {
+				keys[i] = int64(r.Uint64())
+			}
+			return keys
+		},
+	}
+}
+
+// Clustered returns runs of clusterLen consecutive keys, with each run starting
+// at a random 64-bit key, such as IDs allocated in blocks.
+func Clustered(clusterLen int) Dist {
+	if clusterLen < 1 {
+		panic(fmt.Sprintf("keydist: cluster length %d is less than 1", clusterLen))
+	}
+	return Dist{
+		Name: fmt.Sprintf("clustered%d", clusterLen),
+		keys: func(n int, r *rand.Rand) []int64 {
+			keys := make([]int64, 0, n)
+			for len(keys) < n {
+				base := int64(r.Uint64())
+				for i := 0; i < clusterLen && len(keys) < n; i++ {
+					keys = append(keys, base+int64(i))
+				}
+			}
+			return keys
+		},
+	}
+}
+
+// Colliding returns random keys whose hashes are all equal in the bits set in mask.
+// For example, with mask set to a table's group mask, all keys have the same h1 for that table.
+// Each key takes on average 2^(bits set in mask) tries to find, so mask should not have
+// too many bits set.
+func Colliding(name string, hash func(k int64) uint64, mask uint64) Dist {
+	return Dist{
+		Name: name,
+		keys: func(n int, r *rand.Rand) []int64 {
+			keys := make([]int64, 0, n)
+			// Each call uses the same target, including calls to replace duplicates.
+			target := hash(0) & mask
+			for len(keys) < n {
+				k := int64(r.Uint64())
+				if hash(k)&mask == target {
+					keys = append(keys, k)
+				}
+			}
+			return keys
+		},
+	}
+}
+
+// Zipf returns n accesses to keys, where the ith key is accessed
+// with probability proportional to 1/(i+1)^s. s must be greater than 1.
+// It models workloads where a small number of keys are hot.
+// The accesses are reproducible for a given seed.
+func Zipf(keys []int64, n int, s float64, seed int64) []int64 {
+	if len(keys) == 0 {
+		panic("keydist: Zipf with no keys")
+	}
+	r := rand.New(rand.NewSource(seed))
+	z := rand.NewZipf(r, s, 1, uint64(len(keys)-1))
+	if z == nil {
+		panic(fmt.Sprintf("keydist: Zipf exponent %v must be greater than 1", s))
+	}
+	accesses := make([]int64, n)
+	for i := range accesses {
+		accesses[i] = keys[z.Uint64()]
+	}
+	return accesses
+}
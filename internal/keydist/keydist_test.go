@@ -0,0 +1,95 @@
+package keydist
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDist_Keys(t *testing.T) {
+	identity := func(k int64) uint64 { return uint64(k) }
+	tests := []struct {
+		dist Dist
+		n    int
+	}{
+		{Sequential(0, 1), 1000},
+		{Sequential(-50, 7), 1000},
+		{Uniform(), 1000},
+		{Clustered(1), 1000},
+		{Clustered(64), 1000},
+		{Colliding("h1", identity, 0xFF), 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dist.Name, func(t *testing.T) {
+			keys := tt.dist.Keys(tt.n, 1)
+			if len(keys) != tt.n {
+				t.Fatalf("Keys(%d) returned %d keys", tt.n, len(keys))
+			}
+			seen := make(map[int64]bool)
+			for _, k := range keys {
+				if seen[k] {
+					t.Fatalf("Keys(%d) returned duplicate key %d", tt.n, k)
+				}
+				seen[k] = true
+			}
+			again := tt.dist.Keys(tt.n, 1)
+			for i := range keys {
+				if keys[i] != again[i] {
+					t.Fatalf("Keys(%d) is not reproducible: key %d is %d, then %d", tt.n, i, keys[i], again[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDist_KeysImpossible(t *testing.T) {
+	tests := []struct {
+		name    string
+		f       func()
+		wantErr string
+	}{
+		{"zero stride", func() { Sequential(5, 0) }, "stride of 0"},
+		// The keys wrap around to repeat after 2.
+		{"wrapping stride", func() { Sequential(0, math.MinInt64).Keys(3, 1) }, "found only 2 of 3 distinct keys"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				r := recover()
+				if msg, ok := r.(string); !ok || !strings.Contains(msg, tt.wantErr) {
+					t.Errorf("got panic %v, want panic containing %q", r, tt.wantErr)
+				}
+			}()
+			tt.f()
+		})
+	}
+}
+
+func TestColliding(t *testing.T) {
+	hash := func(k int64) uint64 { return uint64(k) * 0x9E3779B97F4A7C15 }
+	const mask = 0x7F << 10
+	keys := Colliding("h2", hash, mask).Keys(100, 1)
+	for _, k := range keys {
+		if got, want := hash(k)&mask, hash(keys[0])&mask; got != want {
+			t.Fatalf("key %d has masked hash %#x, want %#x", k, got, want)
+		}
+	}
+}
+
+func TestZipf(t *testing.T) {
+	keys := Sequential(100, 1).Keys(1000, 1)
+	accesses := Zipf(keys, 100_000, 1.1, 1)
+	counts := make(map[int64]int)
+	for _, k := range accesses {
+		if k < 100 || k >= 1100 {
+			t.Fatalf("Zipf returned key %d, which is not in keys", k)
+		}
+		counts[k]++
+	}
+	// The first key is the most popular.
+	for k, c := range counts {
+		if c > counts[100] {
+			t.Errorf("key %d accessed %d times, more than first key accessed %d times", k, c, counts[100])
+		}
+	}
+}
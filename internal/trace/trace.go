@@ -0,0 +1,283 @@
+// Package trace encodes and decodes operation traces recorded from a swisstable.Map.
+// See swisstable.Recorder, which writes traces, and cmd/swissreplay, which replays them.
+//
+// Keys and values are int64s rather than swisstable.Keys and Values so that
+// package swisstable can use this package without an import cycle.
+//
+// A trace is a header followed by a sequence of events. The header is the magic "SWTR",
+// followed by uvarints for the version, seed, hash mode and initial table size.
+// Each event is an Op byte followed by its arguments, with keys and values as varints
+// and Range ids, indexes and counts as uvarints:
+//
+//	OpGet        key
+//	OpGetHit     key value
+//	OpSet        key value
+//	OpDelete     key
+//	OpFree
+//	OpRangeStart id
+//	OpRangeAt    id index
+//	OpRangeEnd   id count
+//	OpRangeStop  id count
+//
+// Each Range has an id that is unique within the trace. A Range is recorded as OpRangeStart,
+// then for each callback during which the map was used, OpRangeAt with the index of the callback
+// followed by those events, and finally OpRangeEnd or OpRangeStop (if the callback returned false)
+// with the number of callbacks. Ranges can nest. The events of concurrent Ranges can interleave,
+// which is why the Range events carry the id.
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	magic   = "SWTR"
+	version = 2
+)
+
+// HashMode identifies the hash function of the recorded map.
+type HashMode byte
+
+const (
+	// HashRuntime is the default hash, which uses the runtime's per-process hash.
+	// A replay uses the same seed, but the table layout can differ from the recorded map.
+	HashRuntime HashMode = iota
+	// HashPortable is swisstable.PortableHash. A replay has the same table layout.
+	HashPortable
+	// HashCustom is a hash function from swisstable.WithHashFunc, which a replay cannot use.
+	HashCustom
+)
+
+func (h HashMode) String() string {
+	switch h {
+	case HashRuntime:
+		return "runtime"
+	case HashPortable:
+		return "portable"
+	case HashCustom:
+		return "custom"
+	default:
+		return fmt.Sprintf("HashMode(%d)", byte(h))
+	}
+}
+
+// Header describes the recorded map.
+type Header struct {
+	Seed      uint64
+	Hash      HashMode
+	TableSize uint64
+}
+
+// Op is the kind of an Event.
+// The values for Get, Set and Delete match swisstabletest.OpType.
+type Op byte
+
+const (
+	OpGet Op = iota
+	OpSet
+	OpDelete
+	OpRangeStart
+	OpRangeAt
+	OpRangeEnd
+	OpRangeStop
+	OpGetHit
+	OpFree
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpGet:
+		return "Get"
+	case OpGetHit:
+		return "GetHit"
+	case OpSet:
+		return "Set"
+	case OpDelete:
+		return "Delete"
+	case OpFree:
+		return "Free"
+	case OpRangeStart:
+		return "RangeStart"
+	case OpRangeAt:
+		return "RangeAt"
+	case OpRangeEnd:
+		return "RangeEnd"
+	case OpRangeStop:
+		return "RangeStop"
+	default:
+		return fmt.Sprintf("Op(%d)", byte(op))
+	}
+}
+
+// Event is one recorded operation.
+type Event struct {
+	Op Op
+	// Key is set for OpGet, OpGetHit, OpSet and OpDelete.
+	Key int64
+	// Value is set for OpGetHit and OpSet.
+	Value int64
+	// Range is the id of the Range for OpRangeStart, OpRangeAt, OpRangeEnd and OpRangeStop.
+	Range uint64
+	// N is the callback index for OpRangeAt, and the number of callbacks for OpRangeEnd and OpRangeStop.
+	N uint64
+}
+
+func (e Event) String() string {
+	switch e.Op {
+	case OpGet:
+		return fmt.Sprintf("Get(%d) = miss", e.Key)
+	case OpGetHit:
+		return fmt.Sprintf("Get(%d) = %d", e.Key, e.Value)
+	case OpSet:
+		return fmt.Sprintf("Set(%d, %d)", e.Key, e.Value)
+	case OpDelete:
+		return fmt.Sprintf("Delete(%d)", e.Key)
+	case OpFree:
+		return "Free()"
+	case OpRangeStart:
+		return fmt.Sprintf("Range #%d {", e.Range)
+	case OpRangeAt:
+		return fmt.Sprintf("#%d at %d:", e.Range, e.N)
+	case OpRangeEnd:
+		return fmt.Sprintf("} #%d after %d", e.Range, e.N)
+	case OpRangeStop:
+		return fmt.Sprintf("} #%d stopped after %d", e.Range, e.N)
+	default:
+		return e.Op.String()
+	}
+}
+
+// Writer writes a trace. Errors are sticky, and reported by Flush.
+type Writer struct {
+	w   *bufio.Writer
+	buf [2*binary.MaxVarintLen64 + 1]byte
+	err error
+}
+
+// NewWriter returns a Writer that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// WriteHeader writes the header. It must be called once, before any events.
+func (w *Writer) WriteHeader(h Header) {
+	w.write([]byte(magic))
+	for _, v := range []uint64{version, h.Seed, uint64(h.Hash), h.TableSize} {
+		w.write(w.buf[:binary.PutUvarint(w.buf[:], v)])
+	}
+}
+
+// WriteEvent writes e.
+func (w *Writer) WriteEvent(e Event) {
+	w.buf[0] = byte(e.Op)
+	n := 1
+	switch e.Op {
+	case OpGet, OpDelete:
+		n += binary.PutVarint(w.buf[n:], e.Key)
+	case OpGetHit, OpSet:
+		n += binary.PutVarint(w.buf[n:], e.Key)
+		n += binary.PutVarint(w.buf[n:], e.Value)
+	case OpRangeStart:
+		n += binary.PutUvarint(w.buf[n:], e.Range)
+	case OpRangeAt, OpRangeEnd, OpRangeStop:
+		n += binary.PutUvarint(w.buf[n:], e.Range)
+		n += binary.PutUvarint(w.buf[n:], e.N)
+	}
+	w.write(w.buf[:n])
+}
+
+func (w *Writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.Write(b)
+}
+
+// Flush writes any buffered data, and returns the first error encountered while writing.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.w.Flush()
+	return w.err
+}
+
+// Reader reads a trace.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader returns a Reader that reads from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// ReadHeader reads the header. It must be called once, before Next.
+func (r *Reader) ReadHeader() (Header, error) {
+	var h Header
+	m := make([]byte, len(magic))
+	if _, err := io.ReadFull(r.r, m); err != nil {
+		return h, fmt.Errorf("trace: reading header: %v", err)
+	}
+	if string(m) != magic {
+		return h, fmt.Errorf("trace: bad magic %q", m)
+	}
+	v, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return h, fmt.Errorf("trace: reading header: %v", err)
+	}
+	if v != version {
+		return h, fmt.Errorf("trace: unsupported version %d", v)
+	}
+	var hash uint64
+	for _, p := range []*uint64{&h.Seed, &hash, &h.TableSize} {
+		if *p, err = binary.ReadUvarint(r.r); err != nil {
+			return h, fmt.Errorf("trace: reading header: %v", err)
+		}
+	}
+	if hash > uint64(HashCustom) {
+		return h, fmt.Errorf("trace: unknown hash mode %d", hash)
+	}
+	h.Hash = HashMode(hash)
+	return h, nil
+}
+
+// Next returns the next event. At the end of the trace, it returns io.EOF.
+func (r *Reader) Next() (Event, error) {
+	var e Event
+	op, err := r.r.ReadByte()
+	if err != nil {
+		return e, err
+	}
+	e.Op = Op(op)
+	switch e.Op {
+	case OpGet, OpDelete:
+		e.Key, err = binary.ReadVarint(r.r)
+	case OpGetHit, OpSet:
+		e.Key, err = binary.ReadVarint(r.r)
+		if err == nil {
+			e.Value, err = binary.ReadVarint(r.r)
+		}
+	case OpRangeStart:
+		e.Range, err = binary.ReadUvarint(r.r)
+	case OpRangeAt, OpRangeEnd, OpRangeStop:
+		e.Range, err = binary.ReadUvarint(r.r)
+		if err == nil {
+			e.N, err = binary.ReadUvarint(r.r)
+		}
+	case OpFree:
+	default:
+		return e, fmt.Errorf("trace: unknown op %d", op)
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return e, fmt.Errorf("trace: reading %v: %v", e.Op, err)
+	}
+	return e, nil
+}
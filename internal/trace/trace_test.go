@@ -0,0 +1,114 @@
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestTrace_RoundTrip(t *testing.T) {
+	hdr := Header{Seed: math.MaxUint64, Hash: HashPortable, TableSize: 1 << 20}
+	events := []Event{
+		{Op: OpSet, Key: 1, Value: -1},
+		{Op: OpSet, Key: math.MinInt64, Value: math.MaxInt64},
+		{Op: OpGet, Key: 2},
+		{Op: OpGetHit, Key: 1, Value: -1},
+		{Op: OpDelete, Key: -3},
+		{Op: OpRangeStart, Range: 1},
+		{Op: OpRangeAt, Range: 1, N: 0},
+		{Op: OpRangeStart, Range: 2},
+		{Op: OpRangeEnd, Range: 2, N: 2},
+		{Op: OpRangeAt, Range: 1, N: 300},
+		{Op: OpDelete, Key: 1},
+		{Op: OpRangeStop, Range: 1, N: 301},
+		{Op: OpFree},
+		{Op: OpSet, Key: 1, Value: 1},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteHeader(hdr)
+	for _, e := range events {
+		w.WriteEvent(e)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() error: %v", err)
+	}
+
+	r := NewReader(&buf)
+	got, err := r.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if got != hdr {
+		t.Errorf("ReadHeader() = %+v, want %+v", got, hdr)
+	}
+	for i, want := range events {
+		e, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next() for event %d error: %v", i, err)
+		}
+		if e != want {
+			t.Errorf("event %d = %v, want %v", i, e, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next() at end error = %v, want io.EOF", err)
+	}
+}
+
+func TestTrace_Errors(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteHeader(Header{Seed: 1})
+	w.WriteEvent(Event{Op: OpSet, Key: 1000, Value: 1000})
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() error: %v", err)
+	}
+	valid := buf.String()
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"empty", "", "reading header"},
+		{"bad magic", "SWTX" + valid[4:], "bad magic"},
+		{"bad version", "SWTR\x01", "unsupported version"},
+		{"truncated header", valid[:6], "reading header"},
+		{"bad hash mode", "SWTR\x02\x00\x09\x00", "unknown hash mode"},
+		{"unknown op", valid[:8] + "\x20", "unknown op"},
+		{"truncated event", valid[:len(valid)-1], "reading Set: unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.data))
+			_, err := r.ReadHeader()
+			if err == nil {
+				_, err = r.Next()
+			}
+			if err == nil || errors.Is(err, io.EOF) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestWriter_StickyError(t *testing.T) {
+	w := NewWriter(failWriter{})
+	w.WriteHeader(Header{})
+	if err := w.Flush(); err == nil {
+		t.Fatal("Flush() succeeded writing to a failing writer")
+	}
+	w.WriteEvent(Event{Op: OpGet})
+	if err := w.Flush(); err == nil || err.Error() != "disk full" {
+		t.Errorf("second Flush() error = %v, want disk full", err)
+	}
+}
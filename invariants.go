@@ -0,0 +1,193 @@
+package swisstable
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// CheckInvariants verifies the internal consistency of m, and returns an error
+// describing the first problem it finds. It is intended for tests and fuzzing,
+// and takes time proportional to the size of the tables. It must not be called
+// concurrently with a write.
+//
+// It checks that each control byte is EMPTY, DELETED or the h2 of its slot's key,
+// that each key is reachable by probing from its natural group, that the element and
+// DELETED counts match the tables, and, while growing, that the growth status of each
+// group in old is consistent with the contents of old and current.
+// For a small map, it checks the single group of unhashed keys instead.
+func (m *Map) CheckInvariants() error {
+	if m.elemCount < 0 {
+		return fmt.Errorf("swisstable: negative element count %d", m.elemCount)
+	}
+	if m.small {
+		return m.checkSmall()
+	}
+	if m.current.chunks == nil {
+		if m.elemCount != 0 || m.old != nil {
+			return fmt.Errorf("swisstable: no table, but element count %d and growing is %v", m.elemCount, m.old != nil)
+		}
+		return nil
+	}
+	curHash := func(k Key) uint64 { return m.hashFunc(k, m.seed) }
+	curStored, err := checkTable("current", &m.current, curHash)
+	if err != nil {
+		return err
+	}
+
+	if m.old == nil {
+		if m.growStatus != nil || m.sweepCursor != 0 || m.rehashing || m.oldHashFunc != nil {
+			return fmt.Errorf("swisstable: not growing, but growth state is set (sweepCursor %d, rehashing %v)",
+				m.sweepCursor, m.rehashing)
+		}
+		if len(curStored) != m.elemCount {
+			return fmt.Errorf("swisstable: element count %d, but current has %d stored slots", m.elemCount, len(curStored))
+		}
+		return nil
+	}
+	return m.checkGrowing(curStored)
+}
+
+// checkGrowing checks the invariants that involve old while growing.
+// curStored holds the location of each key in current.
+func (m *Map) checkGrowing(curStored map[Key]uint64) error {
+	oldHash := func(k Key) uint64 { return m.oldHash(k, m.hashFunc(k, m.seed)) }
+	oldStored, err := checkTable("old", m.old, oldHash)
+	if err != nil {
+		return err
+	}
+	if len(m.growStatus) != len(newGrowStatus(int(m.old.groups()))) {
+		return fmt.Errorf("swisstable: growStatus has %d words for %d groups in old", len(m.growStatus), m.old.groups())
+	}
+	if m.sweepCursor > m.old.groups() {
+		return fmt.Errorf("swisstable: sweepCursor %d past %d groups in old", m.sweepCursor, m.old.groups())
+	}
+	if m.oldHashFunc == nil {
+		return fmt.Errorf("swisstable: growing, but oldHashFunc is not set")
+	}
+
+	for g := uint64(0); g < m.old.groups(); g++ {
+		if m.growStatus.isChainEvacuated(g) && !m.growStatus.isEvacuated(g) {
+			return fmt.Errorf("swisstable: old group %d is ChainEvacuated but not Evacuated", g)
+		}
+	}
+
+	// Keys in groups of old that have not been evacuated are live, and must not also be in current.
+	live := len(curStored)
+	for k, group := range oldStored {
+		natGroup := oldHash(k) & m.old.groupMask
+		if m.growStatus.isChainEvacuated(natGroup) && !m.growStatus.isEvacuated(group) {
+			return fmt.Errorf("swisstable: key %d in old group %d is not evacuated, but its natural group %d is ChainEvacuated",
+				k, group, natGroup)
+		}
+		if m.growStatus.isEvacuated(group) {
+			continue
+		}
+		live++
+		if curGroup, ok := curStored[k]; ok {
+			return fmt.Errorf("swisstable: key %d is in current group %d and in old group %d, which is not evacuated",
+				k, curGroup, group)
+		}
+	}
+	if live != m.elemCount {
+		return fmt.Errorf("swisstable: element count %d, but current and unevacuated groups of old have %d keys",
+			m.elemCount, live)
+	}
+
+	for k, group := range curStored {
+		h := m.hashFunc(k, m.seed)
+		natGroup := m.oldHash(k, h) & m.old.groupMask
+		if _, ok := oldStored[k]; !ok && !m.growStatus.isEvacuated(natGroup) {
+			// A key that is not from old was written after its natural group was evacuated.
+			return fmt.Errorf("swisstable: key %d is only in current, but its natural group %d in old is not evacuated", k, natGroup)
+		}
+		// Range relies on curHasDisplaced to know when it can reconstruct hashes, which it
+		// does only when not rehashing.
+		if !m.rehashing && group != h&m.current.groupMask && !m.growStatus.curHasDisplaced(group&m.old.groupMask) {
+			return fmt.Errorf("swisstable: key %d is displaced to current group %d, but CurHasDisplaced is not set", k, group)
+		}
+	}
+	return nil
+}
+
+// checkTable checks the control bytes, probe chains and deleteCount of t,
+// and returns the group of each stored key.
+func checkTable(name string, t *fixedTable, hash func(k Key) uint64) (map[Key]uint64, error) {
+	if t.size() != len(t.chunks)*t.chunkSize() {
+		return nil, fmt.Errorf("swisstable: %s has %d slots, but %d chunks of %d slots", name, t.size(), len(t.chunks), t.chunkSize())
+	}
+	var lazy bool
+	for i := range t.chunks {
+		if c := &t.chunks[i]; !c.allocated() {
+			if c.control != unsafe.Pointer(&emptyChunkControl[0]) {
+				return nil, fmt.Errorf("swisstable: %s chunk %d has no slots, but has its own control bytes", name, i)
+			}
+			lazy = true
+		}
+	}
+	if lazy {
+		// Unallocated chunks share emptyChunkControl, so a stray write to it
+		// would show up in every table.
+		for i, c := range emptyChunkControl {
+			if c != emptySentinel {
+				return nil, fmt.Errorf("swisstable: shared empty chunk control byte %d is %#x, want EMPTY", i, c)
+			}
+		}
+	}
+
+	stored := make(map[Key]uint64)
+	var deleted int
+	var haveEmpty bool
+	for g := uint64(0); g < t.groups(); g++ {
+		control := t.groupControl(g)
+		for offset, c := range control {
+			switch {
+			case c == emptySentinel:
+				haveEmpty = true
+			case c == deletedSentinel:
+				deleted++
+			case !isStored(c):
+				return nil, fmt.Errorf("swisstable: %s group %d offset %d has invalid control byte %#x", name, g, offset, c)
+			default:
+				k := t.slot(g, offset).Key
+				h := hash(k)
+				if c != t.h2(h) {
+					return nil, fmt.Errorf("swisstable: %s group %d offset %d has control byte %#x, but key %d has h2 %#x",
+						name, g, offset, c, k, t.h2(h))
+				}
+				if prev, ok := stored[k]; ok {
+					return nil, fmt.Errorf("swisstable: %s has key %d in groups %d and %d", name, k, prev, g)
+				}
+				stored[k] = g
+				if err := checkReachable(t, k, h, g); err != nil {
+					return nil, fmt.Errorf("swisstable: %s %v", name, err)
+				}
+			}
+		}
+	}
+	if !haveEmpty {
+		return nil, fmt.Errorf("swisstable: %s has no EMPTY slots, so probing cannot terminate", name)
+	}
+	if deleted != t.deleteCount {
+		return nil, fmt.Errorf("swisstable: %s deleteCount %d, but has %d DELETED slots", name, t.deleteCount, deleted)
+	}
+	return stored, nil
+}
+
+// checkReachable checks that probing for k with hash h in t reaches group
+// before a group with an EMPTY slot ends the probe sequence.
+func checkReachable(t *fixedTable, k Key, h uint64, group uint64) error {
+	g := h & t.groupMask
+	for probeCount := uint64(0); probeCount < t.groups(); probeCount++ {
+		g = (g + probeCount) & t.groupMask
+		if g == group {
+			return nil
+		}
+		for _, c := range t.groupControl(g) {
+			if c == emptySentinel {
+				return fmt.Errorf("key %d in group %d is not reachable from natural group %d: group %d has an EMPTY slot",
+					k, group, h&t.groupMask, g)
+			}
+		}
+	}
+	return fmt.Errorf("key %d in group %d is not reachable from natural group %d", k, group, h&t.groupMask)
+}
@@ -0,0 +1,202 @@
+package swisstable
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestMap_CheckInvariants(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []Option
+		keys  int
+		flood bool // use keys that collide with identityHash to trigger flood rehashes
+	}{
+		{"default hash", nil, 1000, false},
+		{"identity hash", []Option{WithHashFunc(identityHash)}, 1000, false},
+		{"zero hash", []Option{WithHashFunc(zeroHash)}, 200, false},
+		{"flood rehash", []Option{WithHashFunc(identityHash)}, 1000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(0, tt.opts...)
+			check := func(op string, k Key) {
+				t.Helper()
+				if err := m.CheckInvariants(); err != nil {
+					t.Fatalf("after %s(%d): Map.CheckInvariants() = %v", op, k, err)
+				}
+			}
+			check("New", 0)
+			key := func(i int) Key {
+				if tt.flood {
+					return Key(i) << 20
+				}
+				return Key(i)
+			}
+
+			rng := rand.New(rand.NewSource(1))
+			var sawGrowing bool
+			for i := 0; i < 4*tt.keys; i++ {
+				k := key(rng.Intn(tt.keys))
+				switch rng.Intn(4) {
+				case 0:
+					m.Delete(k)
+					check("Delete", k)
+				default:
+					m.Set(k, Value(k))
+					check("Set", k)
+				}
+				sawGrowing = sawGrowing || m.old != nil
+
+				if i%500 == 0 {
+					// Modify the map during a Range, which can start and finish grows.
+					var n int
+					m.Range(func(k Key, v Value) bool {
+						m.Delete(k)
+						check("Delete during Range", k)
+						m.Set(key(tt.keys+i+n), 0)
+						check("Set during Range", key(tt.keys+i+n))
+						n++
+						return n < 20
+					})
+				}
+			}
+			if !sawGrowing {
+				t.Errorf("map never checked while growing")
+			}
+			if tt.flood && m.floodRehashes == 0 {
+				t.Errorf("map never had a flood rehash")
+			}
+		})
+	}
+}
+
+func TestMap_CheckInvariantsDetects(t *testing.T) {
+	// growing returns a map with a grow in progress.
+	growing := func() *Map {
+		m := New(100, WithHashFunc(identityHash))
+		for k := Key(0); m.old == nil; k++ {
+			m.Set(k, Value(k))
+		}
+		return m
+	}
+	// notGrowing returns a map with keys displaced from their natural group.
+	notGrowing := func() *Map {
+		m := New(64, WithHashFunc(identityHash))
+		for k := Key(0); k < 20; k++ {
+			m.Set(k<<6, Value(k))
+		}
+		m.Delete(3 << 6)
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		build   func() *Map
+		corrupt func(m *Map)
+		wantErr string
+	}{
+		{
+			name:    "wrong h2",
+			build:   notGrowing,
+			corrupt: func(m *Map) { m.current.groupControl(0)[0] ^= 0x01 },
+			wantErr: "but key 0 has h2",
+		},
+		{
+			name:    "invalid control byte",
+			build:   notGrowing,
+			corrupt: func(m *Map) { m.current.groupControl(0)[0] = 0x01 },
+			wantErr: "invalid control byte",
+		},
+		{
+			name:    "element count",
+			build:   notGrowing,
+			corrupt: func(m *Map) { m.elemCount++ },
+			wantErr: "element count 20, but current has 19",
+		},
+		{
+			name:    "delete count",
+			build:   notGrowing,
+			corrupt: func(m *Map) { m.current.deleteCount = 0 },
+			wantErr: "deleteCount 0, but has 1 DELETED",
+		},
+		{
+			name:  "unreachable",
+			build: notGrowing,
+			corrupt: func(m *Map) {
+				// Empty the natural group of the displaced keys, ending their probe sequence.
+				for i, c := range m.current.groupControl(0) {
+					if isStored(c) {
+						m.current.groupControl(0)[i] = emptySentinel
+						m.elemCount--
+					}
+				}
+			},
+			wantErr: "is not reachable from natural group 0",
+		},
+		{
+			name:  "duplicate key",
+			build: notGrowing,
+			corrupt: func(m *Map) {
+				*m.current.slot(1, 0) = *m.current.slot(0, 0)
+			},
+			wantErr: "has key 0 in groups 0 and 1",
+		},
+		{
+			name:  "growth state while not growing",
+			build: notGrowing,
+			corrupt: func(m *Map) {
+				m.sweepCursor = 1
+			},
+			wantErr: "not growing",
+		},
+		{
+			name:  "chain evacuated without evacuated",
+			build: growing,
+			corrupt: func(m *Map) {
+				m.growStatus.set(m.old.groups()-1, statusChainEvacuated)
+			},
+			wantErr: "ChainEvacuated but not Evacuated",
+		},
+		{
+			name:  "evacuated without moving",
+			build: growing,
+			corrupt: func(m *Map) {
+				for g := uint64(0); g < m.old.groups(); g++ {
+					m.growStatus.set(g, statusEvacuated)
+				}
+			},
+			wantErr: "element count",
+		},
+		{
+			name:  "key in current and unevacuated old",
+			build: growing,
+			corrupt: func(m *Map) {
+				m.growStatus = newGrowStatus(int(m.old.groups()))
+			},
+			wantErr: "which is not evacuated",
+		},
+		{
+			name:  "sweepCursor",
+			build: growing,
+			corrupt: func(m *Map) {
+				m.sweepCursor = m.old.groups() + 1
+			},
+			wantErr: "sweepCursor",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.build()
+			if err := m.CheckInvariants(); err != nil {
+				t.Fatalf("Map.CheckInvariants() before corrupting = %v", err)
+			}
+			tt.corrupt(m)
+			err := m.CheckInvariants()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Map.CheckInvariants() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
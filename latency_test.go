@@ -0,0 +1,199 @@
+package swisstable
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/thepudds/swisstable/internal/keydist"
+)
+
+// The latency benchmarks record the time of each individual Set and Delete
+// while a map grows from empty through many grow cycles, and report percentiles
+// of those latencies rather than an average. Incremental growth is meant to
+// bound the worst case for a single operation, which an average hides.
+//
+// They compare incremental growth, a full rehash on each resize (fullGrow),
+// and the runtime map, along with a sweep over the moveGroups tunables
+// growMoves and growSweepWindow. For example:
+//
+//	go test -run=NONE -bench=Latency -benchtime=5x
+//
+// Each operation is timed with time.Now, which adds a fixed overhead
+// of roughly 20-40ns to every measurement, including for the runtime map.
+
+const (
+	// latencyElements is how many keys each iteration inserts, starting from an empty map.
+	// From a table of 16 slots, 1<<20 keys is 17 grow cycles.
+	latencyElements = 1 << 20
+	// latencyDeleteEvery is how often we delete an earlier key, so that
+	// Deletes are also measured while growing.
+	latencyDeleteEvery = 4
+)
+
+// latencies holds per-operation latencies in nanoseconds.
+type latencies []int64
+
+// percentile returns the latency at quantile q in [0, 1]. It expects l to be sorted.
+func (l latencies) percentile(q float64) int64 {
+	if len(l) == 0 {
+		return 0
+	}
+	i := int(q * float64(len(l)-1))
+	return l[i]
+}
+
+// report sorts l and reports its p50, p99, p999 and max as benchmark metrics, with names prefixed by op.
+func (l latencies) report(b *testing.B, op string) {
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	b.ReportMetric(float64(l.percentile(0.5)), op+"-p50-ns")
+	b.ReportMetric(float64(l.percentile(0.99)), op+"-p99-ns")
+	b.ReportMetric(float64(l.percentile(0.999)), op+"-p999-ns")
+	b.ReportMetric(float64(l.percentile(1)), op+"-max-ns")
+}
+
+// latencyMap is the subset of map operations the latency benchmarks time.
+type latencyMap interface {
+	Set(k Key, v Value)
+	Delete(k Key)
+}
+
+type stdLatencyMap map[Key]Value
+
+func (m stdLatencyMap) Set(k Key, v Value) { m[k] = v }
+func (m stdLatencyMap) Delete(k Key)       { delete(m, k) }
+
+// benchmarkLatency fills a new map from newMap with latencyElements keys on each iteration,
+// deleting an earlier key every latencyDeleteEvery Sets, and reports the latency percentiles
+// for Set and Delete across all iterations.
+func benchmarkLatency(b *testing.B, newMap func() latencyMap) {
+	keys := keyList(keydist.Uniform(), latencyElements, 1)
+	sets := make(latencies, 0, b.N*latencyElements)
+	deletes := make(latencies, 0, b.N*latencyElements/latencyDeleteEvery)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := newMap()
+		for j, k := range keys {
+			start := time.Now()
+			m.Set(k, Value(k))
+			sets = append(sets, int64(time.Since(start)))
+
+			if j%latencyDeleteEvery == latencyDeleteEvery-1 {
+				k := keys[j/2]
+				start := time.Now()
+				m.Delete(k)
+				deletes = append(deletes, int64(time.Since(start)))
+			}
+		}
+	}
+	b.StopTimer()
+	sets.report(b, "set")
+	deletes.report(b, "del")
+}
+
+func BenchmarkLatency_Swiss(b *testing.B) {
+	benchmarkLatency(b, func() latencyMap { return New(0) })
+}
+
+func BenchmarkLatency_SwissFullGrow(b *testing.B) {
+	benchmarkLatency(b, func() latencyMap {
+		m := New(0)
+		m.fullGrow = true
+		return m
+	})
+}
+
+func BenchmarkLatency_Std(b *testing.B) {
+	benchmarkLatency(b, func() latencyMap { return make(stdLatencyMap) })
+}
+
+// BenchmarkLatency_GrowTunables sweeps the moveGroups tunables.
+// The defaults are growMoves=2 and growSweepWindow=1000.
+func BenchmarkLatency_GrowTunables(b *testing.B) {
+	for _, moves := range []int{1, 2, 4, 8} {
+		for _, window := range []uint64{100, 1000, 10_000} {
+			b.Run(fmt.Sprintf("moves=%d/window=%d", moves, window), func(b *testing.B) {
+				defer func(moves int, window uint64) {
+					growMoves, growSweepWindow = moves, window
+				}(growMoves, growSweepWindow)
+				growMoves, growSweepWindow = moves, window
+				benchmarkLatency(b, func() latencyMap { return New(0) })
+			})
+		}
+	}
+}
+
+func TestMap_FullGrow(t *testing.T) {
+	m := New(0)
+	m.fullGrow = true
+	for k := Key(0); k < 100_000; k++ {
+		m.Set(k, Value(k))
+		if m.old != nil {
+			t.Fatalf("Map.Set(%d) left the map growing with fullGrow set", k)
+		}
+	}
+	for k := Key(0); k < 100_000; k += 2 {
+		m.Delete(k)
+	}
+	if m.Len() != 50_000 {
+		t.Errorf("Map.Len() = %d, want 50000", m.Len())
+	}
+	for k := Key(0); k < 100_000; k++ {
+		v, ok := m.Get(k)
+		if wantOk := k%2 == 1; ok != wantOk || (ok && v != Value(k)) {
+			t.Errorf("Map.Get(%d) = %d, %v, want %d, %v", k, v, ok, k, wantOk)
+		}
+	}
+}
+
+func TestMap_FullGrowFloodRehash(t *testing.T) {
+	// fullGrow also applies to a rehash started by hash flooding.
+	m := New(1024, WithHashFunc(identityHash), WithSeed(42))
+	m.fullGrow = true
+	// With identityHash, these keys all share the same natural group and h2. See flood_test.go.
+	key := func(i int) Key { return Key(i) << 20 }
+	for i := 0; i < 1000; i++ {
+		m.Set(key(i), Value(i))
+		if m.old != nil {
+			t.Fatalf("Map.Set(%d) left the map growing with fullGrow set", key(i))
+		}
+	}
+	if m.floodRehashes == 0 {
+		t.Fatalf("Map did not rehash for colliding keys")
+	}
+	for i := 0; i < 1000; i++ {
+		if v, ok := m.Get(key(i)); !ok || v != Value(i) {
+			t.Errorf("Map.Get(%d) = %d, %v, want %d, true", key(i), v, ok, i)
+		}
+	}
+	if err := m.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMap_GrowTunables(t *testing.T) {
+	// Growth must still complete and keep every key with extreme settings.
+	for _, tt := range []struct {
+		moves  int
+		window uint64
+	}{{1, 1}, {1, 100_000}, {64, 1}} {
+		t.Run(fmt.Sprintf("moves=%d/window=%d", tt.moves, tt.window), func(t *testing.T) {
+			defer func(moves int, window uint64) {
+				growMoves, growSweepWindow = moves, window
+			}(growMoves, growSweepWindow)
+			growMoves, growSweepWindow = tt.moves, tt.window
+
+			m := New(0)
+			for k := Key(0); k < 50_000; k++ {
+				m.Set(k, Value(k))
+			}
+			for k := Key(0); k < 50_000; k++ {
+				if v, ok := m.Get(k); !ok || v != Value(k) {
+					t.Fatalf("Map.Get(%d) = %d, %v, want %d, true", k, v, ok, k)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"math/bits"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -32,10 +34,11 @@ import (
 // properly navigated when juggling an old and new table.
 //
 // The basic approach is to maintain an immutable old once growth starts, along with
-// some growth status bytes that are live for the duration of the growth, with one
-// byte per group. (This can be collapsed down to fewer bits, but we use a full byte for now).
-// Even with the extra growth status bytes, this still uses less memory than the runtime map,
-// which allocates extra overflow buckets that exceed the size of the growth status bytes
+// some growth status bits that are live for the duration of the growth, with 3 bits
+// per group of old. The bits are packed as 3 uint64 bitsets (one per status flag) for each
+// run of 64 groups, so the flags of neighboring groups share a cache line. See growStatus.
+// Even with the growth status bits, this still uses less memory than the runtime map,
+// which allocates extra overflow buckets that exceed the size of the growth status bits
 // even for small key/values.
 //
 // If an iterator starts mid-growth, it walks both the old and new table, taking care
@@ -57,18 +60,24 @@ type KV struct {
 type hashFunc func(k Key, seed uintptr) uint64
 
 // Control byte special values.
-// If the high bit is 1, it is a special sentinel value of EMPTY or DELETED.
-// If the high bit is 0, there is a STORED entry in the corresponding
+// If the high bit is 0, it is a special sentinel value of EMPTY or DELETED.
+// If the high bit is 1, there is a STORED entry in the corresponding
 // slot in the table, and the next 7 bits are the h2 values. (This is called 'FULL'
 // in the original C++ swisstable implementation, but we call it STORED).
-// TODO: consider flipping meaning of first bit, possibly with 0x00 for empty and 0x7F for deleted?
-const emptySentinel = 0b1111_1111
-const deletedSentinel = 0b1000_0000
+// EMPTY is 0x00 so that freshly allocated (zeroed) control bytes are already EMPTY,
+// which avoids a pass over the control bytes when creating a table.
+// (The original C++ swisstable implementation uses the opposite high bit for STORED).
+const emptySentinel = 0b0000_0000
+const deletedSentinel = 0b0111_1111
 
 // Map is a map, supporting Set, Get, Delete, Range and Len.
 // It is implemented via a modified Swisstable.
 // Unlike the original C++ Swisstable implementation,
 // Map supports incremental resizing without invalidating iterators.
+//
+// The zero Map is empty and ready to use, with the default options. It allocates
+// its table on the first Set, so a Map can be embedded in other types without
+// calling New. A Map must not be copied after first use.
 type Map struct {
 	// Internally, a Map manages one or two fixedTables to store key/values. Normally,
 	// it manages one fixedTable. While growing, it manages two fixedTables.
@@ -84,8 +93,7 @@ type Map struct {
 	old *fixedTable
 
 	// growStatus tracks what has happened on a group by group basis.
-	// To slightly simplify, currently each group gets a byte. TODO: could collapse that down to few bits.
-	growStatus []byte
+	growStatus growStatus
 
 	sweepCursor uint64
 
@@ -100,50 +108,188 @@ type Map struct {
 	// TODO: remove
 	disableResizing bool
 
+	// fullGrow makes each grow (a resize or a flood rehash) move all of old at once,
+	// rather than incrementally.
+	// It is only used to compare latencies with incremental growth. See latency_test.go.
+	fullGrow bool
+
 	// Our hash function, which generates a 64-bit hash
 	hashFunc hashFunc
 	seed     uintptr
 
+	// oldHashFunc is the hash function for old while growing.
+	// It differs from hashFunc only if rehashing is true, which means
+	// the current grow is a rehash to recover from a hash flooding attack. See flood.go.
+	oldHashFunc hashFunc
+	rehashing   bool
+	// baseHashFunc is the original hash function if we have ever rehashed.
+	baseHashFunc hashFunc
+	// floodTableSize is the table size when we last started a rehash.
+	// We do not start another rehash until the table has grown.
+	floodTableSize int
+
+	// sortedJSON indicates MarshalJSON should sort keys. See encoding.go.
+	sortedJSON bool
+
+	// prefetch indicates lookups use software prefetching. See prefetch.go.
+	prefetch bool
+
+	// small indicates current is a single group holding unhashed keys. See small.go.
+	small bool
+
+	// swmr indicates single-writer, multi-reader mode. See swmr.go.
+	swmr bool
+	// seq is a sequence counter (seqlock) that is odd while a write is in progress.
+	// Only used in swmr mode.
+	seq uint64
+	// view is a *swmrView holding the tables for lock-free readers.
+	// Only used in swmr mode.
+	view unsafe.Pointer
+
+	// rec records operations if not nil. See record.go.
+	rec *Recorder
+
+	// mem is the Allocator for off-heap tables, or nil to use the Go heap. See offheap.go.
+	mem Allocator
+	// retired holds off-heap tables that m no longer uses, but which might
+	// still be used by active iterators. It is protected by iterMu.
+	retired []fixedTable
+
 	// Flags tracking state.
-	// TODO: collapse down to single flag variable
+	// Currently only hashWriting, which is used to detect concurrent misuse.
 	// TODO: could use these flags to indicate OK to clear during evac
 	// haveIter    bool
 	// haveOldIter bool
-
-	// Internal stats to help observe behavior.
-	// TODO: eventually remove stats, not actively tracking some
-	gets                int
-	getH2FalsePositives int
-	getExtraGroups      int
+	flags uint8
+
+	// iterCount is the number of active iterators, and trackIters is set once
+	// MemoryUsage has been called. Both are accessed atomically. See memory.go.
+	iterCount  int32
+	trackIters uint32
+	// iters records the tables used by active iterators if trackIters is set.
+	// It is protected by iterMu because multiple goroutines can call Range concurrently
+	// when there is no writer. (In single-writer mode, only the writer calls Range).
+	iterMu  sync.Mutex
+	iterSeq uint64
+	iters   []iterSnapshot
+
+	// Internal stats to help observe behavior. These are reported by Stats.
+	// The counters are only tracked if statsEnabled is true, which is controlled
+	// by the swisstablestats build tag.
+	gets                counter
+	lookups             counter
+	getH2Matches        counter
+	getH2FalsePositives counter
+	getExtraGroups      counter
 	resizeGenerations   int
+	floodRehashes       int
+
+	// displacedMoves counts moves of a key's displaced group in old by moveGroups
+	// after the chain from its natural group could not be completed. It is rare,
+	// and is only tracked to let tests confirm they reach it.
+	displacedMoves int
 }
 
+// Flag values for Map.flags.
+const (
+	// hashWriting indicates a goroutine is writing to the map.
+	// Similar to the runtime map, it is used to detect some concurrent misuse.
+	hashWriting = 1 << 0
+)
+
+// Option configures a Map. Options are passed to New.
+type Option func(*Map)
+
 // New returns a *Map that is ready to use.
 // capacity is a hint, and "at least".
-func New(capacity int) *Map {
+func New(capacity int, opts ...Option) *Map {
 	// tableSize will be roughly 1/0.8 x user suggested capacity,
-	// rounded up to a power of 2.
-	// TODO: for now, should probably make capcity be at least 16 (group size)
-	// to temporarily simplify handling small maps (where small here is < 16).
+	// rounded up to a power of 2, and is at least 16 (one group).
+	// A single-group table starts in small mode. See small.go.
 	tableSize := calcTableSize(capacity)
 
-	current := *newFixedTable(tableSize)
+	m := &Map{}
+	m.initDefaults()
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.swmr && m.mem != nil {
+		panic("swisstable: SingleWriter cannot be combined with off-heap storage")
+	}
+	if m.swmr && m.rec != nil {
+		panic("swisstable: SingleWriter cannot be combined with Record")
+	}
+	m.reset(tableSize)
+	if m.swmr {
+		m.publish()
+	}
+	if m.rec != nil {
+		m.rec.start(m)
+	}
+	return m
+}
+
+// initDefaults sets the default hash function and a random seed if
+// m does not yet have a hash function, such as for a zero Map.
+func (m *Map) initDefaults() {
+	if m.hashFunc == nil {
+		m.hashFunc = hashUint64
+		m.seed = uintptr(fastrand())<<32 | uintptr(fastrand())
+	}
+}
+
+// A zero Map is ready to use, like the runtime map. It has no table until the
+// first Set, so reads of a zero Map do not allocate. We check for a zero Map with
+// m.current.chunks == nil, which is also true after Free.
+
+// lazyInit gives a zero Map its hash function, a fresh seed, and an empty table.
+func (m *Map) lazyInit() {
+	m.initDefaults()
+	m.reset(calcTableSize(0))
+	if m.swmr {
+		m.publish()
+	}
+}
+
+// reset discards all key/values and any in-progress grow,
+// and starts over with an empty current of tableSize.
+// It keeps the seed and the configuration set by options,
+// but drops any hash function picked by a flood rehash.
+// The caller is responsible for publishing in swmr mode.
+func (m *Map) reset(tableSize int) {
+	m.release(&m.current)
+	if m.old != nil {
+		m.release(m.old)
+	}
+	m.current = *newFixedTableIn(tableSize, m.mem)
+	m.small = m.useSmall(tableSize)
+	m.old = nil
+	m.growStatus = nil
+	m.sweepCursor = 0
+	m.elemCount = 0
 
 	// TODO: for now, use same fill factor as the runtime map to
 	// make it easier to compare performance across different sizes.
-	resizeThreshold := (tableSize * 13) / 16 // TODO: centralize
-	return &Map{
-		current:         current,
-		hashFunc:        hashUint64,
-		seed:            uintptr(fastrand())<<32 | uintptr(fastrand()),
-		resizeThreshold: resizeThreshold,
+	m.resizeThreshold = (tableSize * 13) / 16 // TODO: centralize
+
+	if m.baseHashFunc != nil {
+		m.hashFunc = m.baseHashFunc
+		m.baseHashFunc = nil
 	}
+	m.oldHashFunc = nil
+	m.rehashing = false
+	m.floodTableSize = 0
 }
 
 // fixedTable does not support resizing.
 type fixedTable struct {
-	control []byte
-	slots   []KV
+	// chunks hold the control bytes and slots. See chunk.go.
+	chunks         []tableChunk
+	chunkShift     uint8
+	chunkGroupMask uint64
+	// mem allocates the chunks if not nil. See offheap.go.
+	mem Allocator
+
 	// groupCount int // TODO: consider using this, but maybe instead compare groupMask?
 	groupMask uint64
 	h2Shift   uint8
@@ -166,9 +312,33 @@ type fixedTable struct {
 //    https://github.com/facebook/folly/blob/main/folly/container/F14.md#f14-variants )
 
 func (m *Map) Get(k Key) (v Value, ok bool) {
+	if m.rec != nil {
+		return m.getRecorded(k)
+	}
+	return m.get(k)
+}
+
+func (m *Map) get(k Key) (v Value, ok bool) {
+	if m.swmr {
+		// Readers might be racing with the writer.
+		return m.getConcurrent(k)
+	}
+	if m.flags&hashWriting != 0 {
+		fatal("concurrent map read and map write")
+	}
+	if statsEnabled {
+		m.gets.inc()
+	}
+	if m.small {
+		return m.getSmall(k)
+	}
+	if m.current.chunks == nil {
+		// A zero Map.
+		return zeroValue(), false
+	}
 	h := m.hashFunc(k, m.seed)
 
-	if m.old == nil || isChainEvacuated(m.growStatus[h&m.old.groupMask]) {
+	if m.old == nil || m.growStatus.isChainEvacuated(m.oldHash(k, h)&m.old.groupMask) {
 		// We are either not growing, which is the simple case, and we
 		// can just look in m.current, or we are growing but we have
 		// recorded that any keys with the natural group of this key
@@ -183,15 +353,16 @@ func (m *Map) Get(k Key) (v Value, ok bool) {
 
 	// We are growing.
 	// TODO: maybe extract to findGrowing or similar. Would be nice to do midstack inlining for common case.
-	oldNatGroup := h & m.old.groupMask
-	oldNatGroupEvac := isEvacuated(m.growStatus[oldNatGroup])
-	table := &m.current
+	oldH := m.oldHash(k, h)
+	oldNatGroup := oldH & m.old.groupMask
+	oldNatGroupEvac := m.growStatus.isEvacuated(oldNatGroup)
+	table, tableH := &m.current, h
 	if !oldNatGroupEvac {
 		// The key has never been written/deleted in current since this grow started
 		// (because we always move the natural group when writing/deleting a key while growing).
-		table = m.old
+		table, tableH = m.old, oldH
 	}
-	kv, _, _ := m.find(table, k, h)
+	kv, _, _ := m.find(table, k, tableH)
 	if kv != nil {
 		// Hit
 		return kv.Value, true
@@ -211,7 +382,7 @@ func (m *Map) Get(k Key) (v Value, ok bool) {
 	// so the work we did above handled that majority of groups.
 	// Now we do more work for less common cases.
 
-	oldKv, oldDisplGroup, _ := m.find(m.old, k, h)
+	oldKv, oldDisplGroup, _ := m.find(m.old, k, oldH)
 	if oldNatGroup == oldDisplGroup {
 		// We already know from above that this group was evacuated,
 		// which means if there was a prior matching key in this group,
@@ -219,7 +390,7 @@ func (m *Map) Get(k Key) (v Value, ok bool) {
 		// Given it is not in current now, this is a miss for the overall map.
 		return zeroValue(), false
 	}
-	if oldKv != nil && !isEvacuated(m.growStatus[oldDisplGroup]) {
+	if oldKv != nil && !m.growStatus.isEvacuated(oldDisplGroup) {
 		// Hit for the overall map. This is a group with a displaced matching key, and
 		// we've never written/deleted this key since grow started,
 		// so golden copy is in old.
@@ -236,23 +407,28 @@ func (m *Map) Get(k Key) (v Value, ok bool) {
 // For a hit, group is the location of the key, and offset is the location within the group.
 // For a miss, group is the last probed group.
 func (m *Map) find(t *fixedTable, k Key, h uint64) (kv *KV, group uint64, offset int) {
+	if m.prefetch {
+		return m.findPrefetch(t, k, h)
+	}
 	// TODO: likely giving up some of performance by sharing find between Get and Delete
 	group = h & t.groupMask
 	h2 := t.h2(h)
 
-	// TODO: could try hints to elim some bounds check below with additional masking? maybe:
-	// controlLenMask := len(m.current.control) - 1
-	// slotsLenMask := len(m.current.slots) - 1
+	// TODO: could try hints to elim some bounds check below with additional masking? maybe
+	// masking pos with the chunk length - 1.
 
 	var probeCount uint64
+	if statsEnabled {
+		m.lookups.inc()
+	}
 
 	// Do quadratic probing.
 	// This loop will terminate because (1) incrementing by
 	// triangluar numbers will hit every slot in a power of 2 sized table
 	// and (2) we always enforce at least some empty slots by resizing when needed.
 	for {
-		pos := group * 16
-		controlBytes := t.control[pos:]
+		chunk, pos := t.locate(group)
+		controlBytes := chunk.groupControl(pos)
 		bitmask, ok := MatchByte(h2, controlBytes)
 		if debug && !ok {
 			panic("short control byte slice")
@@ -260,14 +436,19 @@ func (m *Map) find(t *fixedTable, k Key, h uint64) (kv *KV, group uint64, offset
 		for bitmask != 0 {
 			// We have at least one hit on h2
 			offset = bits.TrailingZeros32(bitmask)
-			kv := &t.slots[int(pos)+offset]
+			kv := chunk.slot(pos + uint64(offset))
+			if statsEnabled {
+				m.getH2Matches.inc()
+			}
 			if kv.Key == k {
 				return kv, group, offset
 			}
 			// TODO: is this right? The test coverage hits this, but
 			// getting lower than expected false positives in benchmarks, maybe?
 			// (but current benchmarks might have more conservative fill currently?)
-			// m.getH2FalsePositives++ // stats.
+			if statsEnabled {
+				m.getH2FalsePositives.inc()
+			}
 
 			// continue to look. infrequent with 7 bit h2.
 			// clear the bit we just checked.
@@ -279,7 +460,7 @@ func (m *Map) find(t *fixedTable, k Key, h uint64) (kv *KV, group uint64, offset
 		// Check if this group is full or has at least one empty slot.
 		// TODO: call it H1 and H2, removing h2 term
 		// TODO: can likely skip getting the offset below and just test bitmask > 0
-		emptyBitmask, ok := MatchByte(emptySentinel, t.control[group*16:])
+		emptyBitmask, ok := MatchByte(emptySentinel, controlBytes)
 		if debug && !ok {
 			panic("short control byte slice")
 		}
@@ -298,19 +479,54 @@ func (m *Map) find(t *fixedTable, k Key, h uint64) (kv *KV, group uint64, offset
 		// quadratic probing across groups.
 		// Continue our quadratic probing across groups, using triangular numbers.
 		// TODO: rust implementation uses a ProbeSeq and later C++ also has a probe seq; could consider something similar
-		// m.getExtraGroups++ // stats
+		if statsEnabled {
+			m.getExtraGroups.inc()
+		}
 		probeCount++
 		group = (group + probeCount) & t.groupMask
-		if debug && probeCount >= uint64(len(t.slots)/16) {
-			panic(fmt.Sprintf("impossible: probeCount: %d groups: %d underlying table len: %d", probeCount, len(t.slots)/16, len(t.slots)))
+		if debug && probeCount >= t.groups() {
+			panic(fmt.Sprintf("impossible: probeCount: %d groups: %d underlying table len: %d", probeCount, t.groups(), t.size()))
 		}
 	}
 }
 
 // Set sets k and v within the map.
 func (m *Map) Set(k Key, v Value) {
+	if m.rec != nil {
+		m.rec.set(k, v)
+	}
 	// Write the element, incrementing element count if needed and moving if needed.
+	m.beginWrite()
+	if m.current.chunks == nil {
+		m.lazyInit()
+	}
 	m.set(k, v, 1, true)
+	m.endWrite()
+}
+
+// beginWrite marks the start of a write operation.
+// Similar to the runtime map, it is a fatal error if another write is in progress.
+func (m *Map) beginWrite() {
+	if m.flags&hashWriting != 0 {
+		fatal("concurrent map writes")
+	}
+	m.flags ^= hashWriting
+	if m.swmr {
+		// The sequence counter becomes odd.
+		atomic.AddUint64(&m.seq, 1)
+	}
+}
+
+// endWrite marks the end of a write operation.
+func (m *Map) endWrite() {
+	if m.flags&hashWriting == 0 {
+		fatal("concurrent map writes")
+	}
+	m.flags &^= hashWriting
+	if m.swmr {
+		// The sequence counter becomes even.
+		atomic.AddUint64(&m.seq, 1)
+	}
 }
 
 // set sets k and v within the map, returning group and the probe count.
@@ -319,20 +535,25 @@ func (m *Map) Set(k Key, v Value) {
 // which does not change the number of elements.
 // moveIfNeeded indicates if we should do move operations if currently growing.
 func (m *Map) set(k Key, v Value, elemIncr int, moveIfNeeded bool) {
+	if m.small && m.setSmall(k, v, elemIncr) {
+		return
+	}
 	h := m.hashFunc(k, m.seed)
 	group := h & m.current.groupMask
 	h2 := m.current.h2(h)
 
 	if moveIfNeeded && m.old != nil {
 		// We are growing. Move groups if needed
-		m.moveGroups(group, k, h)
+		m.moveGroups(k, m.oldHash(k, h))
 	}
 
 	var probeCount uint64
 	// Do quadratic probing.
 	// This loop will terminate for same reasons as find loop.
 	for {
-		bitmask, ok := MatchByte(h2, m.current.control[group*16:])
+		chunk, pos := m.current.locate(group)
+		controlBytes := chunk.groupControl(pos)
+		bitmask, ok := MatchByte(h2, controlBytes)
 		if debug && !ok {
 			panic("short control byte slice")
 		}
@@ -340,17 +561,15 @@ func (m *Map) set(k Key, v Value, elemIncr int, moveIfNeeded bool) {
 		for bitmask != 0 {
 			// We have at least one hit on h2
 			offset := bits.TrailingZeros32(bitmask)
-			pos := int(group*16) + offset
-			kv := m.current.slots[pos]
+			kv := chunk.slot(pos + uint64(offset))
 			if kv.Key == k {
 				// update the existing key. Note we don't increment the elem count because we are replacing.
-				m.current.control[pos] = h2
-				m.current.slots[pos] = KV{Key: k, Value: v}
+				m.storeSlot(chunk, pos+uint64(offset), KV{Key: k, Value: v})
 				// Track if we have any displaced elements in current while growing. This is rare.
 				// TODO: This might not be a net perf win.
 				if m.old != nil && probeCount != 0 {
 					oldGroup := group & m.old.groupMask
-					m.growStatus[oldGroup] = setCurHasDisplaced(m.growStatus[oldGroup])
+					m.setGrowStatus(oldGroup, statusCurHasDisplaced)
 				}
 				return
 			}
@@ -364,11 +583,17 @@ func (m *Map) set(k Key, v Value, elemIncr int, moveIfNeeded bool) {
 		// but failed to find an equal key in loop just above.
 		// See if this is the end of our probe chain, which is indicated
 		// by the presence of an EMPTY slot.
-		emptyBitmask := matchEmpty(m.current.control[group*16:])
+		emptyBitmask := matchEmpty(controlBytes)
 		if emptyBitmask != 0 {
 			// We've reached the end of our probe chain without finding
 			// a match on an existing key.
-			if m.elemCount+m.current.deleteCount >= m.resizeThreshold && !m.disableResizing {
+			// We don't resize while moving groups (elemIncr of 0). When rehashing into a
+			// table of the same size, elemCount can already be near the threshold.
+			if elemIncr > 0 && m.elemCount+m.current.deleteCount >= m.resizeThreshold && !m.disableResizing {
+				if m.old != nil {
+					// Rare. A rehash started close to the resize threshold and has not yet completed.
+					m.finishGrow()
+				}
 				// Double our size
 				m.startResize()
 
@@ -381,6 +606,13 @@ func (m *Map) set(k Key, v Value, elemIncr int, moveIfNeeded bool) {
 				m.set(k, v, 1, true)
 				return
 			}
+			if probeCount >= minFloodProbeLimit && probeCount >= floodProbeLimit(m.current.groupMask+1) &&
+				moveIfNeeded && m.floodCheck() {
+				// We have an unusually long probe chain, and we have started
+				// rehashing with a new hash function. Set the key in our new table.
+				m.set(k, v, 1, true)
+				return
+			}
 
 			var offset int
 			if m.current.deleteCount == 0 || probeCount == 0 {
@@ -403,17 +635,21 @@ func (m *Map) set(k Key, v Value, elemIncr int, moveIfNeeded bool) {
 			}
 
 			// update empty or deleted slot
-			pos := int(group*16) + offset
-			if m.current.control[pos] == deletedSentinel {
+			chunk, pos = m.current.locate(group)
+			if !chunk.allocated() {
+				m.current.allocChunk(chunk)
+			}
+			i := pos + uint64(offset)
+			if *chunk.controlAt(i) == deletedSentinel {
 				m.current.deleteCount--
 			}
-			m.current.control[pos] = h2
-			m.current.slots[pos] = KV{Key: k, Value: v}
+			*chunk.controlAt(i) = h2
+			m.storeSlot(chunk, i, KV{Key: k, Value: v})
 			m.elemCount += elemIncr
 			// Track if we have any displaced elements in current while growing. This is rare.
 			if m.old != nil && probeCount != 0 {
 				oldGroup := group & m.old.groupMask
-				m.growStatus[oldGroup] = setCurHasDisplaced(m.growStatus[oldGroup])
+				m.setGrowStatus(oldGroup, statusCurHasDisplaced)
 			}
 			return
 		}
@@ -425,8 +661,8 @@ func (m *Map) set(k Key, v Value, elemIncr int, moveIfNeeded bool) {
 		probeCount++
 		group = (group + probeCount) & m.current.groupMask
 
-		if debug && probeCount >= uint64(len(m.current.slots)/16) {
-			panic(fmt.Sprintf("impossible: probeCount: %d groups: %d underlying table len: %d", probeCount, len(m.current.slots)/16, len(m.current.slots)))
+		if debug && probeCount >= m.current.groups() {
+			panic(fmt.Sprintf("impossible: probeCount: %d groups: %d underlying table len: %d", probeCount, m.current.groups(), m.current.size()))
 		}
 	}
 }
@@ -437,38 +673,63 @@ func (m *Map) set(k Key, v Value, elemIncr int, moveIfNeeded bool) {
 func (m *Map) startResize() {
 	// prepare for a new, larger and initially empty current.
 	m.resizeThreshold = m.resizeThreshold << 1
-	newTableSize := len(m.current.control) << 1
+	m.startGrow(m.current.size()<<1, m.hashFunc, false)
+}
 
+// startGrow moves current to old and creates a new current with newTableSize,
+// using newHashFunc for the new current. rehash indicates newHashFunc differs from
+// the hash function for old. The caller is responsible for updating resizeThreshold.
+func (m *Map) startGrow(newTableSize int, newHashFunc hashFunc, rehash bool) {
 	// place current in old, and create a new current
 	m.old = &fixedTable{}
 	*m.old = m.current
-	m.current = *newFixedTable(newTableSize)
+	m.current = *newFixedTableIn(newTableSize, m.mem)
+	m.oldHashFunc = m.hashFunc
+	m.rehashing = rehash
+	m.hashFunc = newHashFunc
 
 	// get ready to track our grow operation
-	m.growStatus = make([]byte, len(m.old.control))
+	m.growStatus = newGrowStatus(int(m.old.groups()))
 	m.sweepCursor = 0
 
-	// TODO: temp stat for now
 	m.resizeGenerations++
+
+	if m.swmr {
+		m.publish()
+	}
+	if m.fullGrow {
+		m.finishGrow()
+	}
 }
 
-// moveGroups takes a group in current along with a
-// key that is triggering the move. It only expects to be called
+// growMoves and growSweepWindow bound the work done by moveGroups on each write while growing.
+// growMoves is the number of groups we aim to move, and growSweepWindow is the most
+// groups the sweep walks looking for groups to move or mark ChainEvacuated.
+// Together they trade the latency of each write against how long growth lasts,
+// which must end before the next grow starts. They are variables so that the
+// latency benchmarks can compare settings. See latency_test.go.
+var (
+	growMoves              = 2
+	growSweepWindow uint64 = 1000
+)
+
+// moveGroups takes a key that is triggering the move along with
+// its hash for old (see oldHash). It only expects to be called
 // while growing. It moves up to three groups:
-//   1. the natural group for this key
-//   2. the group this key is located in if it is displaced in old from its natural group
-//   3. incrementally move from the front, including to ensure we finish and don't miss any groups
-func (m *Map) moveGroups(group uint64, k Key, h uint64) {
-	allowedMoves := 2
+//  1. the natural group for this key
+//  2. the group this key is located in if it is displaced in old from its natural group
+//  3. incrementally move from the front, including to ensure we finish and don't miss any groups
+func (m *Map) moveGroups(k Key, oldH uint64) {
+	allowedMoves := growMoves
 
 	// First, if the natural group for this key has not been moved, move it
-	oldNatGroup := group & m.old.groupMask
-	if !isEvacuated(m.growStatus[oldNatGroup]) {
+	oldNatGroup := oldH & m.old.groupMask
+	if !m.growStatus.isEvacuated(oldNatGroup) {
 		m.moveGroup(oldNatGroup)
 		allowedMoves--
 	}
 
-	if !isChainEvacuated(m.growStatus[oldNatGroup]) {
+	if !m.growStatus.isChainEvacuated(oldNatGroup) {
 		// Walk the chain that started at the natural group, moving any unmoved groups as we go.
 		// If we move the complete chain, we mark the natural group as ChainEvacuated with moveChain.
 		// The first group we'll visit is the one after the natural group (probeCount of 1).
@@ -484,30 +745,32 @@ func (m *Map) moveGroups(group uint64, k Key, h uint64) {
 			// We rely elsewhere (such as in Get) upon always moving the actual group
 			// containing the key when an existing key is Set/Deleted.
 			// Find the key. Note that we don't need to recompute the hash.
-			kv, oldDisplGroup, _ := m.find(m.old, k, h)
+			kv, oldDisplGroup, _ := m.find(m.old, k, oldH)
 			if kv != nil && oldDisplGroup != oldNatGroup {
-				if !isEvacuated(m.growStatus[oldDisplGroup]) {
+				if !m.growStatus.isEvacuated(oldDisplGroup) {
 					// Not moved yet, so move it.
-					// TODO: non-fuzzing tests don't hit this. fuzzing hasn't reached this branch either (so far).
+					// Fuzzing has not reached this branch (so far), but the model checking
+					// in modelcheck_test.go does, which it confirms with displacedMoves.
 					m.moveGroup(oldDisplGroup)
 					allowedMoves-- // Can reach -1 here. Rare, should be ok.
+					m.displacedMoves++
 				}
 			}
 		}
 	}
 
-	stopCursor := uint64(len(m.old.control)) / 16
-	if stopCursor > m.sweepCursor+1000 {
-		stopCursor = m.sweepCursor + 1000
+	stopCursor := m.old.groups()
+	if stopCursor > m.sweepCursor+growSweepWindow {
+		stopCursor = m.sweepCursor + growSweepWindow
 	}
 	for m.sweepCursor < stopCursor {
 		// Walk up to N groups looking for something to move and/or to mark ChainEvacuated.
 		// The sweepCursor group is marked ChainEvacuated if we evac through the end of the chain.
 		// The majority of the time, sweepCursor is a singleton chain or is otherwise the end of a chain.
-		if !isChainEvacuated(m.growStatus[m.sweepCursor]) {
+		if !m.growStatus.isChainEvacuated(m.sweepCursor) {
 			allowedMoves, _ = m.moveChain(m.sweepCursor, 0, allowedMoves)
 		}
-		if isChainEvacuated(m.growStatus[m.sweepCursor]) {
+		if m.growStatus.isChainEvacuated(m.sweepCursor) {
 			m.sweepCursor++
 			continue
 		}
@@ -517,16 +780,45 @@ func (m *Map) moveGroups(group uint64, k Key, h uint64) {
 	}
 
 	// Check if we are now done
-	if m.sweepCursor >= (uint64(len(m.old.control)) / 16) {
+	if m.sweepCursor >= m.old.groups() {
 		// Done growing!
 		// TODO: we have some test coverage of this, but would be nice to have more explicit test
-		// TODO: maybe extract a utility func
-		m.old = nil
-		m.growStatus = nil
-		m.sweepCursor = 0
+		m.endGrow()
+	}
+}
+
+// finishGrow moves all remaining groups from old to current,
+// and then ends the grow.
+func (m *Map) finishGrow() {
+	for g := uint64(0); g < m.old.groups(); g++ {
+		if !m.growStatus.isEvacuated(g) {
+			m.moveGroup(g)
+		}
+	}
+	m.endGrow()
+}
+
+// endGrow releases old once all of its groups have been evacuated.
+func (m *Map) endGrow() {
+	m.release(m.old)
+	m.old = nil
+	m.growStatus = nil
+	m.sweepCursor = 0
+	m.oldHashFunc = nil
+	m.rehashing = false
+	if m.swmr {
+		m.publish()
 	}
 }
 
+// oldHash returns the hash to use for k in old while growing, given h is the hash for current.
+func (m *Map) oldHash(k Key, h uint64) uint64 {
+	if !m.rehashing {
+		return h
+	}
+	return m.oldHashFunc(k, m.seed)
+}
+
 // moveChain walks a probe chain that starts at a natural group, moving unmoved groups.
 // The probeCount parameter allows it to begin in the middle of a walk.
 // moveChain returns the number of remaining allowedMoves and a bool indicating
@@ -537,14 +829,14 @@ func (m *Map) moveChain(oldNatGroup uint64, probeCount uint64, allowedMoves int)
 	g := (oldNatGroup + probeCount) & m.old.groupMask
 
 	for allowedMoves > 0 {
-		if !isEvacuated(m.growStatus[g]) {
+		if !m.growStatus.isEvacuated(g) {
 			// Evacute.
 			m.moveGroup(g)
 			allowedMoves--
 		}
-		if matchEmpty(m.old.control[g*16:]) != 0 {
+		if matchEmpty(m.old.groupControl(g)) != 0 {
 			// Done with the chain. Record that.
-			m.growStatus[oldNatGroup] = setChainEvacuated(m.growStatus[oldNatGroup])
+			m.setGrowStatus(oldNatGroup, statusChainEvacuated)
 			// chainEnd is true
 			return allowedMoves, true
 		}
@@ -558,10 +850,14 @@ func (m *Map) moveChain(oldNatGroup uint64, probeCount uint64, allowedMoves int)
 // It only moves that group, and does not cascade to other groups
 // (even if moving the group writes displaced elements to other groups).
 func (m *Map) moveGroup(group uint64) {
-	for offset, b := range m.old.control[group*16 : group*16+16] {
+	if m.flags&hashWriting == 0 {
+		// We are only called while writing, so someone else cleared the flag.
+		fatal("concurrent map writes")
+	}
+	for offset, b := range m.old.groupControl(group)[:16] {
 		if isStored(b) {
 			// TODO: cleanup
-			kv := m.old.slots[group*16+uint64(offset)]
+			kv := *m.old.slot(group, offset)
 
 			// We are re-using the set mechanism to write to
 			// current, but we don't want cascading moves of other groups
@@ -573,24 +869,40 @@ func (m *Map) moveGroup(group uint64) {
 		}
 	}
 	// Mark it evacuated.
-	m.growStatus[group] = setEvacuated(m.growStatus[group])
+	m.setGrowStatus(group, statusEvacuated)
 
-	if matchEmpty(m.old.control[group*16:]) != 0 {
+	if matchEmpty(m.old.groupControl(group)) != 0 {
 		// The probe chain starting at this group ends at this group,
 		// so we can also mark it ChainEvacuated.
-		m.growStatus[group] = setChainEvacuated(m.growStatus[group])
+		m.setGrowStatus(group, statusChainEvacuated)
 	}
 }
 
 func (m *Map) Delete(k Key) {
+	if m.rec != nil {
+		m.rec.delete(k)
+	}
+	m.beginWrite()
+	m.delete(k)
+	m.endWrite()
+}
+
+func (m *Map) delete(k Key) {
 	// TODO: make a 'delete' with moveIfNeeded
 
+	if m.small {
+		m.deleteSmall(k)
+		return
+	}
+	if m.current.chunks == nil {
+		// A zero Map.
+		return
+	}
 	h := m.hashFunc(k, m.seed)
-	group := h & m.current.groupMask
 	if m.old != nil {
 		// We are growing. Move groups if needed
 		// TODO: don't yet have a test that hits this (Delete while growing)
-		m.moveGroups(group, k, h)
+		m.moveGroups(k, m.oldHash(k, h))
 	}
 
 	kv, group, offset := m.find(&m.current, k, h)
@@ -603,7 +915,7 @@ func (m *Map) Delete(k Key) {
 	var sentinel byte = emptySentinel
 
 	// However, we need to check if there are any EMPTY positions in this group
-	emptyBitmask, ok := MatchByte(emptySentinel, m.current.control[group*16:])
+	emptyBitmask, ok := MatchByte(emptySentinel, m.current.groupControl(group))
 	if debug && !ok {
 		panic("short control byte slice")
 	}
@@ -616,10 +928,10 @@ func (m *Map) Delete(k Key) {
 		m.current.deleteCount++
 	}
 
-	pos := int(group*16) + offset
-	m.current.control[pos] = sentinel
+	chunk, pos := m.current.locate(group)
+	*chunk.controlAt(pos + uint64(offset)) = sentinel
 	// TODO: for a pointer, would want to set nil. could do with 'zero' generics func.
-	m.current.slots[pos] = KV{}
+	m.storeSlot(chunk, pos+uint64(offset), KV{})
 	m.elemCount--
 }
 
@@ -667,10 +979,23 @@ func (m *Map) Range(f func(key Key, value Value) bool) {
 	// invoked by Range might cause growth to start or finish), but not concurrently.
 	// For example, iterating while concurrently calling Set from another goroutine
 	// would be a user-level data race (similar to runtime maps).
+	// Without a writer, any number of goroutines may call Range concurrently, as with Get.
+	// In single-writer mode, Range does not use the lock-free reader path, so only the
+	// writer may call Range, and readers must only call Get.
 	//
 	// TODO: clean up comments and add better intro.
 	// TODO: make an iter struct, with a calling sequence like iterstart and iternext
 
+	if m.current.chunks == nil {
+		// A zero Map has nothing to iterate over.
+		return
+	}
+	if m.rec != nil {
+		var rr *recordedRange
+		rr, f = m.rec.rangeStart(f)
+		defer m.rec.rangeEnd(rr)
+	}
+
 	// Begin by storing some snapshots of our tables.
 	// For example, another m.old could appear later if a
 	// new grow starts after this iterator starts.
@@ -684,8 +1009,13 @@ func (m *Map) Range(f func(key Key, value Value) bool) {
 	// A new m.current can also be created mid iteration, so snapshot
 	// it as well so that we can iterate over the current we started with.
 	cur := m.current
-	curControl := m.current.control[:] // TODO: maybe not needed, and/or collapse these?
-	curSlots := m.current.slots[:]     // TODO: same
+
+	// The hash functions can change if a rehash starts mid iteration, so snapshot those too.
+	curHashFunc, oldHashFunc, rehashing := m.hashFunc, m.oldHashFunc, m.rehashing
+
+	// Record our snapshots so that MemoryUsage can report what we retain.
+	iterID := m.startIter(cur, old, growStatus)
+	defer m.endIter(iterID)
 
 	// Below, we pick a random starting group and starting offset within that group.
 	r := (uint64(fastrand()) << 32) | uint64(fastrand())
@@ -696,18 +1026,22 @@ func (m *Map) Range(f func(key Key, value Value) bool) {
 
 	// Now, iterate over our snapshot of old.
 	if old != nil {
-		for i, group := 0, r&old.groupMask; i < len(old.control)/16; i, group = i+1, (group+1)&old.groupMask {
+		for i, group := uint64(0), r&old.groupMask; i < old.groups(); i, group = i+1, (group+1)&old.groupMask {
+			if m.flags&hashWriting != 0 {
+				fatal("concurrent map iteration and map write")
+			}
 			offsetMask := uint64(0x0F)
-			for j, offset := 0, (r>>61)&offsetMask; j < 16; j, offset = j+1, (offset+1)&offsetMask {
-				pos := group*16 + offset
+			oldControl := old.groupControl(group)
+			for j, offset := 0, int((r>>61)&offsetMask); j < 16; j, offset = j+1, (offset+1)&int(offsetMask) {
 				// Iterate over control bytes individually for now.
 				// TODO: consider 64-bit check of control bytes or SSE operations (e.g., _mm_movemask_epi8).
-				if isStored(old.control[pos]) {
-					k := old.slots[pos].Key
+				if isStored(oldControl[offset]) {
+					kv := old.slot(group, offset)
+					k := kv.Key
 
 					// We don't need to worry about displacements here when checking
 					// evacuation status. (We are iterating over each control byte, wherever they have landed).
-					if !isEvacuated(growStatus[pos/16]) {
+					if !growStatus.isEvacuated(group) {
 						// Not evac. Because we always move both a key's natural group
 						// and the key's displaced group for any Set or Delete, not evac means
 						// we know nothing in this group has ever
@@ -717,7 +1051,7 @@ func (m *Map) Range(f func(key Key, value Value) bool) {
 						// have been multiple generations of growing, our snapshot
 						// of old will have everything evacuated).
 						// TODO: current non-fuzzing tests don't hit this. fuzzing does ;-)
-						cont := f(k, old.slots[pos].Value)
+						cont := f(k, kv.Value)
 						if !cont {
 							return
 						}
@@ -728,7 +1062,7 @@ func (m *Map) Range(f func(key Key, value Value) bool) {
 					// Check where the golden data resides now, and emit the live key/value if they still exist.
 					// TODO: could probably do less work, including avoiding lookup/hashing in same cases
 
-					if cur.groupMask == m.current.groupMask || m.old == nil {
+					if sameTable(&cur, &m.current) || m.old == nil {
 						// We still in the same grow as when the iter started,
 						// or that grow is finished and we are not in the middle
 						// of a different grow, so we don't need to look in m.old
@@ -747,7 +1081,7 @@ func (m *Map) Range(f func(key Key, value Value) bool) {
 					// We are in in the middle of a grow that is different from the grow at iter start.
 					// In other words, m.old is now a "new" old.
 					// Do a full Get, which looks in the live m.current or m.old as needed.
-					v, ok := m.Get(k)
+					v, ok := m.get(k)
 					if !ok {
 						// Group was evacuated, but key not there now, so we don't emit anything
 						continue
@@ -767,30 +1101,34 @@ func (m *Map) Range(f func(key Key, value Value) bool) {
 	// No old, or we've reached the end of old.
 	// We now iterate over our snapshot of current, but we will skip anything present in
 	// the immutable old because it would have been already processed above.
-	loopMask := uint64(len(curControl)/16 - 1)
-	for i, group := 0, r&loopMask; i < len(curControl)/16; i, group = i+1, (group+1)&loopMask {
+	for i, group := uint64(0), r&cur.groupMask; i < cur.groups(); i, group = i+1, (group+1)&cur.groupMask {
+		if m.flags&hashWriting != 0 {
+			fatal("concurrent map iteration and map write")
+		}
+		curControl := cur.groupControl(group)
 		offsetMask := uint64(0x0F)
-		for j, offset := 0, (r>>61)&offsetMask; j < 16; j, offset = j+1, (offset+1)&offsetMask {
-			pos := group*16 + offset
-			if isStored(curControl[pos]) {
-				curGroup := uint64(pos / 16)
-				k := curSlots[pos].Key
+		for j, offset := 0, int((r>>61)&offsetMask); j < 16; j, offset = j+1, (offset+1)&int(offsetMask) {
+			if isStored(curControl[offset]) {
+				k := cur.slot(group, offset).Key
 
 				if old != nil {
 					// We are about to look in old, but first, compute the hash for this key (frequently cheaply).
 					var h uint64
-					if !curHasDisplaced(growStatus[curGroup&old.groupMask]) {
+					if rehashing {
+						// Our snapshot of old uses a different hash function than current.
+						h = oldHashFunc(k, m.seed)
+					} else if !growStatus.curHasDisplaced(group & old.groupMask) {
 						// During a grow, we track when a group contains a displaced element.
 						// The group we are on does not have any displaced elemenets, which means
 						// we can reconstruct the useful portion of the hash from the group and h2
 						// This could help with cases like https://go.dev/issue/51410 when a map
 						// is in a growing state for an extended period.
 						// TODO: check cost and if worthwhile
-						h = cur.reconstructHash(curControl[pos], curGroup)
+						h = cur.reconstructHash(curControl[offset], group)
 					} else {
 						// Rare that a group in current would have displaced elems during a grow,
 						// but it means we must recompute the hash from scratch
-						h = m.hashFunc(k, m.seed)
+						h = curHashFunc(k, m.seed)
 					}
 
 					// Look in old
@@ -803,9 +1141,9 @@ func (m *Map) Range(f func(key Key, value Value) bool) {
 
 				// The key was not in old or there is no old. If the key is still live, we will emit it.
 				// Start by checking if m.current is the same as the snapshot of current we are iterating over.
-				if cur.groupMask == m.current.groupMask {
+				if sameTable(&cur, &m.current) {
 					// They are the same, so we can simply emit from the snapshot
-					cont := f(k, curSlots[pos].Value)
+					cont := f(k, cur.slot(group, offset).Value)
 					if !cont {
 						return
 					}
@@ -816,7 +1154,7 @@ func (m *Map) Range(f func(key Key, value Value) bool) {
 				// possibly a new m.old if needed, which is all handled by Get
 				// TODO: could pass in reconstructed hash here as well, though this is a rarer case compared to
 				// writes stopping and a map being "stuck" in the same growing state forever or long time.
-				v, ok := m.Get(k)
+				v, ok := m.get(k)
 				if !ok {
 					// key not there now, so we don't emit anything
 					continue
@@ -833,53 +1171,90 @@ func (m *Map) Range(f func(key Key, value Value) bool) {
 	}
 }
 
+// sameTable reports whether a and b refer to the same underlying table.
+func sameTable(a, b *fixedTable) bool {
+	return len(a.chunks) == len(b.chunks) && &a.chunks[0] == &b.chunks[0]
+}
+
 // isStored reports whether controlByte indicates a stored value.
-// If leading bit is 0, it means there is a valid value in the corresponding
+// If leading bit is 1, it means there is a valid value in the corresponding
 // slot in the table. (The next 7 bits are the h2 values).
 // TODO: maybe isStored -> hasStored or similar?
 func isStored(controlByte byte) bool {
-	return controlByte&(1<<7) == 0
+	return controlByte&(1<<7) != 0
 }
 
-// isEvacuated reports whether the group corresponding to statusByte
-// has been moved from old to new.
-// Note: this is just for the elements stored in that group in old,
-// and does not mean all elements dispalced fro mthat group have been evacuated.
-// TODO: collapse these flags down into fewer bits rather than using a full byte
-// TODO: maybe make a type
-func isEvacuated(statusByte byte) bool {
-	return statusByte&(1<<0) != 0
+// growStatus tracks what has happened to each group in old while growing.
+// It packs the status flags for each group into bitsets, using 3 bits per group.
+// The bits for a block of 64 consecutive groups are held in one word per flag,
+// and the words for a block are adjacent, so checking multiple flags for
+// a group typically touches a single cache line.
+// For an old table with 2^23 slots (2^19 groups), this is 192KiB, compared to 512KiB
+// for a byte per group, or 8MiB for a byte per slot.
+// On BenchmarkFillGrow_Swiss with 1M elements, this reduced B/op from 73.4MB to 71.4MB,
+// with no measurable change in ns/op (within noise).
+type growStatus []uint64
+
+// The status flags tracked for each group in growStatus.
+const (
+	// statusEvacuated means the group has been moved from old to new.
+	// Note: this is just for the elements stored in that group in old,
+	// and does not mean all elements displaced from that group have been evacuated.
+	statusEvacuated uint64 = iota
+
+	// statusChainEvacuated is similar to statusEvacuated, but means the group
+	// has been moved from old to new along with any probe chains that orginate from that group.
+	// A group that does not have any chains originating from it can have statusChainEvacuated set.
+	statusChainEvacuated
+
+	// statusCurHasDisplaced means the group in current has displaced elements.
+	// It is only tracked during grow operations, and therefore is
+	// only very rarely set. If we are mid-grow, it means current was recently
+	// doubled in size and has not yet had enough elems added to complete the grow.
+	// TODO: verify this is a performance win for range
+	// TODO: consider oldHasDisplaced, but might be less of a win
+	// (additional book keeping, likely higher mispredictions than curHasDisplaced, ...).
+	statusCurHasDisplaced
+
+	// statusFlags is the number of flags, and hence words per block of 64 groups.
+	statusFlags
+)
+
+// newGrowStatus returns a growStatus with all flags clear for the specified number of groups.
+func newGrowStatus(groups int) growStatus {
+	return make(growStatus, (groups+63)/64*int(statusFlags))
+}
+
+// word returns the word holding flag for group, along with the bit for group in that word.
+func (s growStatus) word(group uint64, flag uint64) (*uint64, uint64) {
+	return &s[group/64*statusFlags+flag], 1 << (group % 64)
 }
 
-func setEvacuated(statusByte byte) byte {
-	return statusByte | (1 << 0)
+// has reports whether flag is set for group.
+func (s growStatus) has(group uint64, flag uint64) bool {
+	w, bit := s.word(group, flag)
+	return *w&bit != 0
 }
 
-// isChainEvacuated is similar to isEvacuated, but reports whether the group
-// corresponding to statusByte has been moved from old to new
-// along with any probe chains that orginate from that group.
-// A group that does not have any chains originating from it can have isChainEvacuated true.
-func isChainEvacuated(statusByte byte) bool {
-	return statusByte&(1<<1) != 0
+// set sets flag for group.
+func (s growStatus) set(group uint64, flag uint64) {
+	w, bit := s.word(group, flag)
+	*w |= bit
 }
 
-func setChainEvacuated(statusByte byte) byte {
-	return statusByte | (1 << 1)
+// isEvacuated reports whether statusEvacuated is set for group.
+func (s growStatus) isEvacuated(group uint64) bool {
+	return s.has(group, statusEvacuated)
 }
 
-// curHasDisplaced indicates the group in current has displaced elements.
-// It is only tracked during grow operations, and therefore is
-// only very rarely set. If we are mid-grow, it means current was recently
-// doubled in size and has not yet had enough elems added to complete the grow.
-// TODO: verify this is a performance win for range
-// TODO: consider oldHasDisplaced, but might be less of a win
-// (additional book keeping, likely higher mispredictions than curHasDisplaced, ...).
-func curHasDisplaced(statusByte byte) bool {
-	return statusByte&(1<<2) != 0
+// isChainEvacuated reports whether statusChainEvacuated is set for group.
+func (s growStatus) isChainEvacuated(group uint64) bool {
+	return s.has(group, statusChainEvacuated)
 }
 
-func setCurHasDisplaced(statusByte byte) byte {
-	return statusByte | (1 << 2)
+// curHasDisplaced reports whether statusCurHasDisplaced is set for group.
+func (s growStatus) curHasDisplaced(group uint64) bool {
+	return s.has(group, statusCurHasDisplaced)
 }
 
 // Number of elements stored in Map
@@ -890,31 +1265,80 @@ func (m *Map) Len() int {
 
 // newFixedTable returns a *newFixedTable that is ready to use.
 // A fixedTable can be copied.
+// Tables larger than maxChunkGroups groups allocate their chunks lazily.
 func newFixedTable(tableSize int) *fixedTable {
+	return newFixedTableIn(tableSize, nil)
+}
+
+// newFixedTableIn is like newFixedTable, but allocates the chunks from mem
+// if mem is not nil. See offheap.go.
+func newFixedTableIn(tableSize int, mem Allocator) *fixedTable {
 	// TODO: not using capacity in our make calls. Probably reasonable for straight swisstable impl?
 
 	if tableSize&(tableSize-1) != 0 || tableSize == 0 {
 		panic(fmt.Sprintf("table size %d is not power of 2", tableSize))
 	}
 
+	if mem != nil {
+		t := newChunkedTable(tableSize)
+		t.mem = mem
+		for i := range t.chunks {
+			t.chunks[i] = lazyChunk()
+		}
+		if len(t.chunks) == 1 {
+			t.allocChunk(&t.chunks[0])
+		}
+		return t
+	}
+
+	if tableSize > maxChunkGroups*16 {
+		t := newChunkedTable(tableSize)
+		for i := range t.chunks {
+			t.chunks[i] = lazyChunk()
+		}
+		return t
+	}
+
 	slots := make([]KV, tableSize)
+	// The zeroed control bytes are all EMPTY.
 	control := make([]byte, tableSize)
-	// Initialize all control bytes to empty
-	// TODO: consider using 0x00 for empty, or unroll, or set these with unsafe, or...
-	// A simple loop here is ~15% of time to construct a large capacity empty table.
-	for i := range control {
-		control[i] = emptySentinel
+
+	return fixedTableFrom(control, slots)
+}
+
+// fixedTableFrom returns a fixedTable using existing control bytes and slots,
+// which must have the same power of 2 length. The chunks of the
+// returned table refer to control and slots without copying.
+func fixedTableFrom(control []byte, slots []KV) *fixedTable {
+	t := newChunkedTable(len(control))
+	if len(slots) != len(control) {
+		panic(fmt.Sprintf("control length %d does not match slots length %d", len(control), len(slots)))
+	}
+	for i := range t.chunks {
+		pos := i * t.chunkSize()
+		t.chunks[i] = tableChunk{control: unsafe.Pointer(&control[pos]), slots: unsafe.Pointer(&slots[pos])}
 	}
+	return t
+}
 
+// newChunkedTable returns a fixedTable of tableSize with chunks that are not yet set.
+func newChunkedTable(tableSize int) *fixedTable {
+	groups := tableSize / 16
+	// A single chunk covers the whole table for smaller tables.
+	chunkShift := bits.TrailingZeros(uint(groups))
+	if chunkShift > maxChunkShift {
+		chunkShift = maxChunkShift
+	}
 	return &fixedTable{
-		control: control,
-		slots:   slots,
+		chunks:         make([]tableChunk, groups>>chunkShift),
+		chunkShift:     uint8(chunkShift),
+		chunkGroupMask: 1<<chunkShift - 1,
 		// 16 control bytes per group, table length is power of 2
-		groupMask: (uint64(tableSize) / 16) - 1,
+		groupMask: uint64(groups) - 1,
 		// h2Shift gives h2 as the next 7 bits just above the group mask.
 		// (It is not the top 7 bits, which is what runtime map uses).
 		// TODO: small sanity of h2Shift; maybe make test: https://go.dev/play/p/DjmN7O4YrWI
-		h2Shift: uint8(bits.TrailingZeros(uint(tableSize / 16))),
+		h2Shift: uint8(bits.TrailingZeros(uint(groups))),
 	}
 }
 
@@ -924,7 +1348,7 @@ func (t *fixedTable) findFirstEmptyOrDeleted(h uint64) (group uint64, offset int
 	// Do quadratic probing.
 	var probeCount uint64
 	for {
-		bitmask := matchEmptyOrDeleted(t.control[group*16:])
+		bitmask := matchEmptyOrDeleted(t.groupControl(group))
 		if bitmask != 0 {
 			// We have at least one hit
 			offset = bits.TrailingZeros32(bitmask)
@@ -936,16 +1360,17 @@ func (t *fixedTable) findFirstEmptyOrDeleted(h uint64) (group uint64, offset int
 		// does not contain any empty or deleted positions).
 		probeCount++
 		group = (group + probeCount) & t.groupMask
-		if debug && probeCount >= uint64(len(t.slots)/16) {
-			panic(fmt.Sprintf("impossible: probeCount: %d groups: %d underlying table len: %d", probeCount, len(t.slots)/16, len(t.slots)))
+		if debug && probeCount >= t.groups() {
+			panic(fmt.Sprintf("impossible: probeCount: %d groups: %d underlying table len: %d", probeCount, t.groups(), t.size()))
 		}
 	}
 }
 
-// h2 returns the 7 bits immediately above the bits covered by the table's groupMask
+// h2 returns the 7 bits immediately above the bits covered by the table's groupMask,
+// with the high bit set. This is the control byte for a STORED position.
 func (t *fixedTable) h2(h uint64) uint8 {
 	// TODO: does an extra mask here elim a shift check in the generated code?
-	return uint8((h >> uint64(t.h2Shift)) & 0x7f)
+	return uint8((h>>uint64(t.h2Shift))&0x7f) | 0x80
 }
 
 // reconstructHash reconstructs the bits of the original hash covered by
@@ -1009,6 +1434,7 @@ func memhash64(p unsafe.Pointer, seed uintptr) uintptr
 func strhash(p unsafe.Pointer, h uintptr) uintptr
 
 // TODO: fastrand64 did not initially work
+//
 //go:linkname fastrand runtime.fastrand
 func fastrand() uint32
 
@@ -1020,4 +1446,11 @@ func init() {
 	}
 }
 
+// fatal reports unrecoverable misuse of a Map, such as concurrent writes.
+// The runtime map uses an unrecoverable throw. We panic, but the Map
+// should not be used after a fatal error is reported.
+func fatal(s string) {
+	panic("swisstable: " + s)
+}
+
 const debug = false
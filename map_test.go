@@ -6,10 +6,12 @@ import (
 	"math"
 	"math/bits"
 	"math/rand"
+	"os"
 	"sort"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/thepudds/swisstable/internal/keydist"
 )
 
 var longTestFlag = flag.Bool("long", false, "run long benchmarks")
@@ -205,7 +207,7 @@ func TestMap_Delete(t *testing.T) {
 			})
 
 			if diff := cmp.Diff(want, got); diff != "" {
-				t.Logf("slots: %v", m.current.slots)
+				t.Logf("slots: %v", tableSlots(&m.current))
 				t.Errorf("Map.Range() result mismatch (-want +got):\n%s", diff)
 			}
 			gotLen := m.Len()
@@ -506,9 +508,10 @@ func TestMap_StoredKeys(t *testing.T) {
 			panic("unexpectedly growing")
 		}
 		var keys []Key
-		for i := range m.current.control {
-			if isStored(m.current.control[i]) {
-				keys = append(keys, m.current.slots[i].Key)
+		control, slots := tableControl(&m.current), tableSlots(&m.current)
+		for i := range control {
+			if isStored(control[i]) {
+				keys = append(keys, slots[i].Key)
 			}
 		}
 		return keys
@@ -602,7 +605,7 @@ func TestMap_ForceFill(t *testing.T) {
 
 			// TODO: reach in to disable growth?
 			// We reach into the implementation to see what full means.
-			underlyingTableLen := len(m.current.slots)
+			underlyingTableLen := m.current.size()
 			t.Logf("setting %d elements in table with underlying size %d", underlyingTableLen-1, underlyingTableLen)
 
 			// Force the underlying table to fill up the map so that it only has one empty slot left,
@@ -647,60 +650,137 @@ func TestMap_ForceFill(t *testing.T) {
 				t.Errorf("Map.Len gotLen = %v, want %v", gotLen, underlyingTableLen)
 			}
 			// Reach in to the impl and to confirm that it is indeed seem to be 100% full
-			for i := 0; i < len(m.current.control); i++ {
-				if m.current.control[i] == emptySentinel {
+			control, slots := tableControl(&m.current), tableSlots(&m.current)
+			for i := 0; i < len(control); i++ {
+				if control[i] == emptySentinel {
 					t.Fatalf("control byte %d is empty", i)
 				}
 			}
-			for i := 0; i < len(m.current.slots); i++ {
-				if m.current.slots[i].Key == 0 || m.current.slots[i].Value == 0 {
+			for i := 0; i < len(slots); i++ {
+				if slots[i].Key == 0 || slots[i].Value == 0 {
 					// We set everything to non-zero values above.
 					t.Fatalf("element at index %d has key or value that is still 0: key = %d value = %d",
-						i, m.current.slots[i].Key, m.current.slots[i].Value)
+						i, slots[i].Key, slots[i].Value)
 				}
 			}
 		})
 	}
 }
 
-func Test_StatusByte(t *testing.T) {
-	// probably/hopefully overkill
-	b := byte(0)
-	if isEvacuated(b) || isChainEvacuated(b) || curHasDisplaced(b) {
-		t.Errorf("statusByte unexpectedly set")
+func TestMap_ZeroValue(t *testing.T) {
+	var s struct {
+		name string
+		m    Map
 	}
+	m := &s.m
 
-	got := setEvacuated(b)
-	if !isEvacuated(got) {
-		t.Errorf("isEvacuated() = false, got = %v", got)
+	var emitted int
+	f := func(k Key, v Value) bool {
+		emitted++
+		return true
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if v, ok := m.Get(1); ok || v != 0 {
+			t.Fatalf("Map.Get(1) = %v, %v, want 0, false", v, ok)
+		}
+		m.Range(f)
+		m.Delete(1)
+	})
+	if emitted != 0 {
+		t.Errorf("Map.Range emitted %d keys, want 0", emitted)
+	}
+	if allocs != 0 {
+		t.Errorf("reads of a zero Map allocated %v times, want 0", allocs)
 	}
-	if isChainEvacuated(got) {
-		t.Errorf("isChainEvacuated() = true")
+	if m.Len() != 0 || m.current.chunks != nil {
+		t.Fatalf("zero Map has Len %d and %d chunks after reads", m.Len(), len(m.current.chunks))
 	}
-	if curHasDisplaced(got) {
-		t.Errorf("curHasDisplaced() = true")
+	if err := m.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if fm := m.Freeze(); fm.Len() != 0 {
+		t.Errorf("FrozenMap.Len() = %d, want 0", fm.Len())
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error: %v", err)
+	}
+	if err := New(0).UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() error: %v", err)
 	}
 
-	got = setChainEvacuated(b)
-	if isEvacuated(got) {
-		t.Errorf("isEvacuated() = true")
+	want := make(map[Key]Value)
+	for k := Key(0); k < 100; k++ {
+		m.Set(k, Value(k))
+		want[k] = Value(k)
+		if err := m.CheckInvariants(); err != nil {
+			t.Fatalf("after Set(%d): %v", k, err)
+		}
 	}
-	if !isChainEvacuated(got) {
-		t.Errorf("isChainEvacuated() = false, got = %v", got)
+	if diff := cmp.Diff(want, contents(m)); diff != "" {
+		t.Errorf("contents mismatch (-want +got):\n%s", diff)
 	}
-	if curHasDisplaced(got) {
-		t.Errorf("curHasDisplaced() = true")
+
+	// Each zero Map picks a fresh seed on its first Set.
+	var other Map
+	other.Set(1, 1)
+	if m.seed == 0 || other.seed == m.seed {
+		t.Errorf("seeds = %d and %d, want different non-zero seeds", m.seed, other.seed)
 	}
+}
 
-	got = setCurHasDisplaced(b)
-	if isEvacuated(got) {
-		t.Errorf("isEvacuated() = true")
+func Test_GrowStatus(t *testing.T) {
+	// probably/hopefully overkill
+	flags := []struct {
+		name string
+		flag uint64
+		has  func(s growStatus, group uint64) bool
+	}{
+		{"isEvacuated", statusEvacuated, growStatus.isEvacuated},
+		{"isChainEvacuated", statusChainEvacuated, growStatus.isChainEvacuated},
+		{"curHasDisplaced", statusCurHasDisplaced, growStatus.curHasDisplaced},
 	}
-	if isChainEvacuated(got) {
-		t.Errorf("isChainEvacuated() = true")
+	tests := []struct {
+		groups int
+		group  uint64
+	}{
+		{1, 0},
+		{64, 0},
+		{64, 63},
+		{65, 64},
+		{200, 127},
+		{200, 128},
+		{200, 199},
 	}
-	if !curHasDisplaced(got) {
-		t.Errorf("curHasDisplaced() = false, got = %v", got)
+
+	for _, tt := range tests {
+		for _, set := range flags {
+			for _, atomicSet := range []bool{false, true} {
+				s := newGrowStatus(tt.groups)
+				if want := (tt.groups + 63) / 64 * 3; len(s) != want {
+					t.Fatalf("newGrowStatus(%d) has %d words, want %d", tt.groups, len(s), want)
+				}
+				if atomicSet {
+					s.setAtomic(tt.group, set.flag)
+				} else {
+					s.set(tt.group, set.flag)
+				}
+				// Only the flag we set for the group we set should be set.
+				for g := uint64(0); g < uint64(tt.groups); g++ {
+					for _, check := range flags {
+						want := g == tt.group && check.flag == set.flag
+						if got := check.has(s, g); got != want {
+							t.Errorf("groups %d: after setting %s for group %d, %s(%d) = %v, want %v",
+								tt.groups, set.name, tt.group, check.name, g, got, want)
+						}
+						if got := s.hasAtomic(g, check.flag); got != want {
+							t.Errorf("groups %d: after setting %s for group %d, hasAtomic(%d, %d) = %v, want %v",
+								tt.groups, set.name, tt.group, g, check.flag, got, want)
+						}
+					}
+				}
+			}
+		}
 	}
 }
 
@@ -819,6 +899,15 @@ var sinkValue Value
 var sinkBool bool
 
 func BenchmarkGetHitHot_Swiss(b *testing.B) {
+	benchmarkGetHitHot(b)
+}
+
+// BenchmarkGetHitHot_SwissPrefetch shows the cost of the PrefetchLookups option for hot lookups.
+func BenchmarkGetHitHot_SwissPrefetch(b *testing.B) {
+	benchmarkGetHitHot(b, PrefetchLookups())
+}
+
+func benchmarkGetHitHot(b *testing.B, opts ...Option) {
 	hotKeyCount := 20
 	lookupEachKey := 50
 
@@ -836,7 +925,7 @@ func BenchmarkGetHitHot_Swiss(b *testing.B) {
 	for _, bm := range bms {
 		b.Run(bm.name, func(b *testing.B) {
 			// Fill the map under test
-			m := New(bm.mapElements)
+			m := New(bm.mapElements, opts...)
 			for i := Key(0); i < Key(bm.mapElements); i++ {
 				m.Set(i, Value(i))
 			}
@@ -1098,6 +1187,16 @@ func BenchmarkGetAllStartCold_Std(b *testing.B) {
 // BenchmarkGetAllStartCold_Swiss creates many maps so that they are
 // cold at the start. It is intended to be run with -benchtime=1x.
 func BenchmarkGetAllStartCold_Swiss(b *testing.B) {
+	benchmarkGetAllStartCold(b)
+}
+
+// BenchmarkGetAllStartCold_SwissPrefetch is BenchmarkGetAllStartCold_Swiss
+// with the PrefetchLookups option.
+func BenchmarkGetAllStartCold_SwissPrefetch(b *testing.B) {
+	benchmarkGetAllStartCold(b, PrefetchLookups())
+}
+
+func benchmarkGetAllStartCold(b *testing.B, opts ...Option) {
 	bms := almostGrowPointMapSizes([]int{
 		1 << 10,
 		1 << 20,
@@ -1126,7 +1225,7 @@ func BenchmarkGetAllStartCold_Swiss(b *testing.B) {
 			b.Logf("creating %d maps with %.1f MB of data. %d total keys", mapCnt, float64(mapCnt)*mapMem/(1<<20), mapCnt*bm.mapElements)
 			maps := make([]*Map, mapCnt)
 			for i := 0; i < mapCnt; i++ {
-				m := New(bm.mapElements)
+				m := New(bm.mapElements, opts...)
 				for j := 0; j < bm.mapElements; j++ {
 					m.Set(Key(j), Value(j))
 				}
@@ -1166,6 +1265,100 @@ func BenchmarkGetAllStartCold_Swiss(b *testing.B) {
 	}
 }
 
+// benchDists returns the key distributions for the Dist benchmarks,
+// which compare the runtime map and Map.
+func benchDists() []keydist.Dist {
+	return []keydist.Dist{keydist.Sequential(0, 1), keydist.Uniform(), keydist.Clustered(64)}
+}
+
+// collidingH2 returns a distribution of keys that all have the same h2 in a Map with
+// the default hash and seed for a table sized for mapElements.
+func collidingH2(mapElements int, seed uintptr) keydist.Dist {
+	groups := calcTableSize(mapElements) / 16
+	hash := func(k int64) uint64 { return hashUint64(Key(k), seed) }
+	return keydist.Colliding("collidingH2", hash, 0x7f<<bits.TrailingZeros(uint(groups)))
+}
+
+func BenchmarkFillDist_Swiss(b *testing.B) {
+	mapElements := 1_000_000
+	const seed = 1
+	for _, dist := range append(benchDists(), collidingH2(mapElements, seed)) {
+		keys := keyList(dist, mapElements, 1)
+		b.Run(fmt.Sprintf("%s/map size %d", dist.Name, mapElements), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m := New(mapElements, WithSeed(seed))
+				for _, k := range keys {
+					m.Set(k, Value(k))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFillDist_Std(b *testing.B) {
+	mapElements := 1_000_000
+	for _, dist := range benchDists() {
+		keys := dist.Keys(mapElements, 1)
+		b.Run(fmt.Sprintf("%s/map size %d", dist.Name, mapElements), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m := make(map[int64]int64, mapElements)
+				for _, k := range keys {
+					m[k] = k
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkGetZipf_Swiss looks up keys with a Zipfian distribution,
+// where a small number of keys are hot but most keys are accessed occasionally.
+func BenchmarkGetZipf_Swiss(b *testing.B) {
+	mapElements := 1_000_000
+	const seed = 1
+	for _, dist := range append(benchDists(), collidingH2(mapElements, seed)) {
+		keys := dist.Keys(mapElements, 1)
+		gets := keydist.Zipf(keys, 1000, 1.1, 1)
+		b.Run(fmt.Sprintf("%s/map size %d", dist.Name, mapElements), func(b *testing.B) {
+			m := New(mapElements, WithSeed(seed))
+			for _, k := range keys {
+				m.Set(Key(k), Value(k))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, key := range gets {
+					v, b := m.Get(Key(key))
+					sinkInt = int64(v)
+					sinkBool = b
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetZipf_Std(b *testing.B) {
+	mapElements := 1_000_000
+	for _, dist := range benchDists() {
+		keys := dist.Keys(mapElements, 1)
+		gets := keydist.Zipf(keys, 1000, 1.1, 1)
+		b.Run(fmt.Sprintf("%s/map size %d", dist.Name, mapElements), func(b *testing.B) {
+			m := make(map[int64]int64, mapElements)
+			for _, k := range keys {
+				m[k] = k
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, key := range gets {
+					sinkInt, sinkBool = m[key]
+				}
+			}
+		})
+	}
+}
+
 //go:noinline
 func iterStd(m map[int64]int64) int64 {
 	var ret int64
@@ -1348,28 +1541,7 @@ func identityHash(k Key, seed uintptr) uint64 {
 }
 
 func dumpFixedTables(m *Map) {
-	tables := []struct {
-		name string
-		t    *fixedTable
-	}{
-		{"current", &m.current},
-		{"old", m.old},
-	}
-	for _, t := range tables {
-		fmt.Println("\n===", t.name, "===")
-		if t.t == nil {
-			fmt.Println("table is nil")
-			return
-		}
-		for i := range t.t.slots {
-			if i%16 == 0 {
-				fmt.Println()
-				fmt.Println(t.name, "group", i/16)
-				fmt.Println("-----")
-			}
-			fmt.Printf("%08b %v\n", t.t.control[i], t.t.slots[i])
-		}
-	}
+	m.DebugDump(os.Stdout)
 }
 
 // list returns a slice of of keys based on start (inclusive), end (exclusive), and stride
@@ -1381,6 +1553,15 @@ func list(start, end, stride Key) []Key {
 	return res
 }
 
+// keyList returns n distinct keys from the distribution d.
+func keyList(d keydist.Dist, n int, seed int64) []Key {
+	var res []Key
+	for _, k := range d.Keys(n, seed) {
+		res = append(res, Key(k))
+	}
+	return res
+}
+
 // keysAndValues collects keys and values from a Map into a runtime map
 // for use in testing and fuzzing.
 // It panics if the same key is observed twice while iterating over the keys.
@@ -0,0 +1,251 @@
+package swisstable
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+// Read-only memory-mapped tables.
+//
+// A Map can be built offline, written with WriteTable, and later opened with OpenMapped,
+// which maps the file into memory. Get and Range then run directly against the
+// mapped control bytes and slots. Opening only reads the control bytes (to validate them),
+// and pages of slots are loaded by the OS as they are touched.
+//
+// The file uses the layout kind of the binary format (see binary.go). The header is
+// 48 bytes and the control bytes are a multiple of 16 bytes, so the slots start
+// 16-byte aligned relative to the page-aligned start of the mapping, and on little endian
+// platforms they can be used in place as a []KV.
+//
+// The default runtime hash is only stable within a process, so the Map must
+// be created with the PortableHash option, which uses a hash function that only
+// depends on the key and the seed. The seed is stored in the file.
+
+// PortableHash returns an Option that makes the Map use a hash function
+// that gives the same result in every process for a given key and seed.
+// This is required for tables written with WriteTable.
+// It is slower than the default runtime hash on platforms with AES hardware support.
+func PortableHash() Option {
+	return func(m *Map) {
+		m.hashFunc = portableHash
+	}
+}
+
+// portableHash is a seeded hash that does not depend on per-process state.
+// mix64 is a bijection, so distinct keys never have the same 64-bit hash for a given seed.
+// TODO: consider something stronger, such as wyhash, if the seed might be known to an attacker.
+func portableHash(k Key, seed uintptr) uint64 {
+	return mix64(uint64(k) ^ mix64(uint64(seed)+0x9E3779B97F4A7C15))
+}
+
+// WriteTable writes the table layout of m to w for later use with OpenMapped.
+// m must have been created with PortableHash. If m is growing, WriteTable
+// first completes the grow, so like Set, it must not be called concurrently with other
+// uses of m. If m has rehashed due to hash flooding, WriteTable writes a copy of m
+// with a new seed instead, which temporarily uses as much memory again.
+func (m *Map) WriteTable(w io.Writer) error {
+	base := m.hashFunc
+	if m.baseHashFunc != nil {
+		base = m.baseHashFunc
+	}
+	if hashFingerprint(base, m.seed) != hashFingerprint(portableHash, m.seed) {
+		return errors.New("swisstable: WriteTable requires a Map created with PortableHash")
+	}
+	if m.rehashing || m.baseHashFunc != nil {
+		// A flood rehash replaced our hash function, which the file cannot describe. See flood.go.
+		c, err := m.portableCopy()
+		if err != nil {
+			return err
+		}
+		return c.WriteTable(w)
+	}
+	if m.old != nil {
+		m.beginWrite()
+		m.finishGrow()
+		m.endWrite()
+	}
+
+	bw := bufio.NewWriterSize(w, 64<<10)
+	var hdr [binaryHeaderSize]byte
+	h := m.layoutHeader()
+	h.put(hdr[:])
+	bw.Write(hdr[:])
+	for ci := range m.current.chunks {
+		bw.Write(m.layoutControl(ci))
+	}
+	var slot [binarySlotSize]byte
+	for ci := range m.current.chunks {
+		for i, c := range m.current.chunkControl(ci) {
+			kv := KV{}
+			if isStored(c) {
+				kv = *m.current.chunks[ci].slot(uint64(i))
+			}
+			putSlot(slot[:], kv)
+			bw.Write(slot[:])
+		}
+	}
+	// bufio.Writer remembers the first error.
+	return bw.Flush()
+}
+
+// MappedMap is a read-only Map backed by a memory-mapped file written by WriteTable.
+// It supports Get, Range and Len. Like a Map, it is safe for concurrent Gets,
+// but it must not be used after Close.
+type MappedMap struct {
+	// m uses the mapped control bytes and slots as its current table.
+	// No write operations are ever called on m, so the mapped memory
+	// is never modified (and is mapped read-only regardless).
+	m    Map
+	data []byte
+}
+
+// OpenMapped maps the file at path, which must have been written by WriteTable,
+// and returns a MappedMap using the table in place. The header and control bytes are
+// validated, but the slots are not.
+// The caller should call Close when done.
+func OpenMapped(path string) (*MappedMap, error) {
+	data, err := mmapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mm, err := newMappedMap(data)
+	if err != nil {
+		munmap(data)
+		return nil, err
+	}
+	return mm, nil
+}
+
+// newMappedMap returns a MappedMap using data in place.
+// data must be 8-byte aligned.
+func newMappedMap(data []byte) (*MappedMap, error) {
+	if !littleEndian() {
+		return nil, errors.New("swisstable: MappedMap requires a little endian platform")
+	}
+	hdr, err := parseBinaryHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.kind != binaryLayout {
+		return nil, errors.New("swisstable: mapped data does not contain a table layout")
+	}
+	if hdr.version != binaryVersion {
+		return nil, fmt.Errorf("swisstable: mapped table has binary version %d, want %d; rewrite it with WriteTable",
+			hdr.version, binaryVersion)
+	}
+	if hashFingerprint(portableHash, uintptr(hdr.seed)) != hdr.fingerprint {
+		return nil, errors.New("swisstable: mapped table was not written with PortableHash")
+	}
+	tableSize := int(hdr.tableSize)
+	control := data[binaryHeaderSize : binaryHeaderSize+tableSize]
+	if err := checkMappedControl(control, hdr); err != nil {
+		return nil, err
+	}
+	slotData := data[binaryHeaderSize+tableSize:]
+	if uintptr(unsafe.Pointer(&slotData[0]))%unsafe.Alignof(KV{}) != 0 {
+		return nil, fmt.Errorf("swisstable: mapped slots are not aligned")
+	}
+	// Our binary format for a slot matches the memory layout of KV on little endian platforms.
+	slots := unsafe.Slice((*KV)(unsafe.Pointer(&slotData[0])), tableSize)
+
+	mm := &MappedMap{data: data}
+	mm.m.hashFunc = portableHash
+	mm.m.seed = uintptr(hdr.seed)
+	mm.m.current = *fixedTableFrom(control, slots)
+	mm.m.current.deleteCount = int(hdr.deleteCount)
+	mm.m.elemCount = int(hdr.count)
+	return mm, nil
+}
+
+// maxCopySeeds is the number of seeds portableCopy tries.
+const maxCopySeeds = 8
+
+// portableCopy returns a copy of m that uses portableHash with a seed derived from m's,
+// and that has not rehashed. The keys that caused m to rehash were very likely a chance
+// long probe chain at a small table size, so a new seed avoids them.
+func (m *Map) portableCopy() (*Map, error) {
+	// Reading m for the copy is not an operation to record.
+	rec := m.rec
+	m.rec = nil
+	defer func() { m.rec = rec }()
+	for i := uint64(1); i <= maxCopySeeds; i++ {
+		seed := uintptr(mix64(uint64(m.seed) + i*0x9E3779B97F4A7C15))
+		c := New(m.elemCount, PortableHash(), WithSeed(seed))
+		m.Range(func(k Key, v Value) bool {
+			c.Set(k, v)
+			return true
+		})
+		if !c.rehashing && c.baseHashFunc == nil {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("swisstable: WriteTable with a Map whose keys flood PortableHash with %d seeds", maxCopySeeds)
+}
+
+// checkMappedControl checks that each control byte is EMPTY, DELETED or stored,
+// that the counts match hdr, and that there is an EMPTY slot to end each probe chain.
+// Otherwise Get could loop forever on a corrupt file.
+func checkMappedControl(control []byte, hdr binaryHeader) error {
+	var stored, deleted, empty uint64
+	for i, c := range control {
+		switch {
+		case c == emptySentinel:
+			empty++
+		case c == deletedSentinel:
+			deleted++
+		case isStored(c):
+			stored++
+		default:
+			return fmt.Errorf("swisstable: mapped table has invalid control byte %#x at slot %d", c, i)
+		}
+	}
+	if stored != hdr.count || deleted != hdr.deleteCount {
+		return fmt.Errorf("swisstable: mapped table has %d stored and %d deleted control bytes, but the header has %d and %d",
+			stored, deleted, hdr.count, hdr.deleteCount)
+	}
+	if empty == 0 {
+		return errors.New("swisstable: mapped table has no EMPTY control bytes")
+	}
+	return nil
+}
+
+// Get returns the value for k, and whether k was found.
+func (mm *MappedMap) Get(k Key) (v Value, ok bool) {
+	if mm.data == nil {
+		fatal("use of closed MappedMap")
+	}
+	return mm.m.Get(k)
+}
+
+// Range calls f for each key/value, in no particular order, stopping if f returns false.
+func (mm *MappedMap) Range(f func(key Key, value Value) bool) {
+	if mm.data == nil {
+		fatal("use of closed MappedMap")
+	}
+	mm.m.Range(f)
+}
+
+// Len returns the number of key/values.
+func (mm *MappedMap) Len() int {
+	return mm.m.elemCount
+}
+
+// Close unmaps the file. The MappedMap must not be used afterwards,
+// including by other goroutines.
+func (mm *MappedMap) Close() error {
+	if mm.data == nil {
+		return errors.New("swisstable: MappedMap already closed")
+	}
+	data := mm.data
+	mm.data = nil
+	mm.m = Map{}
+	return munmap(data)
+}
+
+func littleEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}
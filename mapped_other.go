@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package swisstable
+
+import "errors"
+
+// TODO: support Windows via CreateFileMapping.
+
+func mmapFile(path string) ([]byte, error) {
+	return nil, errors.New("swisstable: OpenMapped is not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
+
+func mmapAnon(size int) ([]byte, error) {
+	return nil, errors.New("swisstable: OffHeap is not supported on this platform")
+}
@@ -0,0 +1,222 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package swisstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMappedMap(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func() *Map
+	}{
+		{
+			name: "with deletes",
+			build: func() *Map {
+				m := New(0, PortableHash())
+				for k := Key(0); k < 10_000; k++ {
+					m.Set(k*3, Value(-k))
+				}
+				for k := Key(0); k < 10_000; k += 7 {
+					m.Delete(k * 3)
+				}
+				return m
+			},
+		},
+		{
+			name: "growing",
+			build: func() *Map {
+				m := New(20_000, PortableHash()) // resize threshold of 26624
+				for k := Key(0); k < 26_625; k++ {
+					m.Set(k, Value(k))
+				}
+				if m.old == nil {
+					panic("expected to be growing")
+				}
+				return m
+			},
+		},
+		{
+			name: "rehashed",
+			build: func() *Map {
+				m := New(0, PortableHash())
+				for k := Key(0); k < 1000; k++ {
+					m.Set(k, Value(k))
+				}
+				// Rehash as if the keys had flooded the table. See flood.go.
+				m.beginWrite()
+				m.startRehash()
+				m.finishGrow()
+				m.endWrite()
+				if m.baseHashFunc == nil {
+					panic("expected to have rehashed")
+				}
+				return m
+			},
+		},
+		{
+			name:  "empty",
+			build: func() *Map { return New(0, PortableHash()) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.build()
+			want := contents(m)
+
+			path := filepath.Join(t.TempDir(), "table")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.WriteTable(f); err != nil {
+				t.Fatalf("Map.WriteTable() error: %v", err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if m.old != nil {
+				t.Errorf("Map.WriteTable() did not finish growing")
+			}
+
+			mm, err := OpenMapped(path)
+			if err != nil {
+				t.Fatalf("OpenMapped() error: %v", err)
+			}
+			if mm.Len() != len(want) {
+				t.Errorf("MappedMap.Len() = %d, want %d", mm.Len(), len(want))
+			}
+			for k, v := range want {
+				got, ok := mm.Get(k)
+				if !ok || got != v {
+					t.Fatalf("MappedMap.Get(%v) = %v, %v, want %v, true", k, got, ok, v)
+				}
+			}
+			for k := Key(-1000); k < 0; k++ {
+				if got, ok := mm.Get(k); ok {
+					t.Fatalf("MappedMap.Get(%v) = %v, true, want miss", k, got)
+				}
+			}
+			got := make(map[Key]Value)
+			mm.Range(func(k Key, v Value) bool {
+				got[k] = v
+				return true
+			})
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("MappedMap.Range() mismatch (-want +got):\n%s", diff)
+			}
+
+			if err := mm.Close(); err != nil {
+				t.Errorf("MappedMap.Close() error: %v", err)
+			}
+			if err := mm.Close(); err == nil {
+				t.Errorf("second MappedMap.Close() did not return an error")
+			}
+		})
+	}
+}
+
+func TestMappedMap_Errors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	m := New(0)
+	m.Set(1, 1)
+	runtimeHash, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = New(20_000, PortableHash())
+	for k := Key(0); k < 26_625; k++ {
+		m.Set(k, Value(k))
+	}
+	entries, err := m.MarshalBinary() // growing, so entries
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = New(0, PortableHash())
+	m.Set(1, 1)
+	v1, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint16(v1[4:], binaryVersionV1)
+
+	// Corrupt control bytes of a valid single group table, where slot 15 is EMPTY.
+	var layout bytes.Buffer
+	if err := m.WriteTable(&layout); err != nil {
+		t.Fatal(err)
+	}
+	invalidControl := append([]byte(nil), layout.Bytes()...)
+	invalidControl[binaryHeaderSize+15] = 0x05
+	extraStored := append([]byte(nil), layout.Bytes()...)
+	extraStored[binaryHeaderSize+15] = 0x80
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{"missing", filepath.Join(dir, "missing"), "no such file"},
+		{"short", write("short", []byte("SWTB")), "too short"},
+		{"bad magic", write("magic", bytes.Repeat([]byte{'x'}, 100)), "bad magic"},
+		{"runtime hash", write("runtime", runtimeHash), "not written with PortableHash"},
+		{"entries", write("entries", entries), "does not contain a table layout"},
+		{"version 1", write("v1", v1), "binary version 1"},
+		{"invalid control", write("invalid", invalidControl), "invalid control byte 0x5 at slot 15"},
+		{"extra stored", write("extra", extraStored), "has 2 stored and 0 deleted control bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm, err := OpenMapped(tt.path)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("OpenMapped() error = %v, want error containing %q", err, tt.wantErr)
+			}
+			if mm != nil {
+				t.Errorf("OpenMapped() returned non-nil MappedMap with error")
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := New(0).WriteTable(&buf); err == nil || !strings.Contains(err.Error(), "PortableHash") {
+		t.Errorf("Map.WriteTable() without PortableHash error = %v, want PortableHash error", err)
+	}
+}
+
+func TestPortableHash(t *testing.T) {
+	// The hash is part of the file format for WriteTable, so it must not change.
+	tests := []struct {
+		k    Key
+		seed uintptr
+		want uint64
+	}{
+		{0, 0, 0x6393d51c06c618dc},
+		{1, 0, 0x8d82751399f55d54},
+		{1, 2, 0x25abcb5c468f3099},
+		{-1, 1 << 40, 0x82a59bc5c19a0164},
+	}
+	for _, tt := range tests {
+		if got := portableHash(tt.k, tt.seed); got != tt.want {
+			t.Errorf("portableHash(%v, %v) = %#x, want %#x", tt.k, tt.seed, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package swisstable
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the file at path read-only.
+func mmapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < binaryHeaderSize {
+		return nil, errors.New("swisstable: mapped file too short")
+	}
+	if int64(int(size)) != size {
+		return nil, errors.New("swisstable: mapped file too large")
+	}
+	// The mapping remains valid after we close the file.
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+// mmapAnon maps size bytes of anonymous, private memory. See OffHeap.
+func mmapAnon(size int) ([]byte, error) {
+	return syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+}
@@ -43,3 +43,20 @@ valid:
 	MOVL AX, mask+32(FP)
 	MOVB $0x01, ok+36(FP)
 	RET
+
+// func prefetch(addr uintptr)
+// Requires: MMX+
+TEXT ·prefetch(SB), NOSPLIT, $0-8
+	MOVQ       addr+0(FP), AX
+	PREFETCHT0 (AX)
+	RET
+
+// func prefetchGroupSlots(addr uintptr)
+// Requires: MMX+
+TEXT ·prefetchGroupSlots(SB), NOSPLIT, $0-8
+	MOVQ       addr+0(FP), AX
+	PREFETCHT0 (AX)
+	PREFETCHT0 64(AX)
+	PREFETCHT0 128(AX)
+	PREFETCHT0 192(AX)
+	RET
@@ -3,3 +3,11 @@
 package swisstable
 
 func MatchByte(c uint8, buffer []byte) (mask uint32, ok bool)
+
+// prefetch hints that the cache line containing addr will be read soon.
+// It never faults, even for an invalid addr.
+func prefetch(addr uintptr)
+
+// prefetchGroupSlots hints that the 16 slots of a group starting at addr will be read soon.
+// This is 4 cache lines. Like prefetch, it never faults.
+func prefetchGroupSlots(addr uintptr)
@@ -0,0 +1,152 @@
+package swisstable
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// MemoryUsage reports the bytes held by a Map's tables.
+// It does not include the small, fixed size Map struct itself.
+type MemoryUsage struct {
+	// Control and Slots are the bytes used by the control bytes and slots of the current table.
+	// Control also includes the headers for the table's chunks.
+	Control int
+	Slots   int
+	// OldControl, OldSlots, and GrowStatus are only non-zero while growing.
+	OldControl int
+	OldSlots   int
+	GrowStatus int
+	// Iterators is the bytes retained only by active iterators (calls to Range
+	// that have not yet returned) that started with tables the Map no longer uses.
+	// For example, an iterator that started mid-growth retains the old table
+	// even after growth completes. Iterators are only tracked once MemoryUsage
+	// has been called on the Map, so the first call does not include iterators
+	// that were already active.
+	Iterators int
+	// Total is the sum of the above.
+	Total int
+}
+
+// iterSnapshot records the tables an active Range started with. See MemoryUsage.
+type iterSnapshot struct {
+	id         uint64
+	cur        fixedTable
+	old        *fixedTable
+	growStatus growStatus
+}
+
+// Tracking iterators.
+//
+// Every Range counts itself in iterCount with an atomic add, which is all an off-heap Map
+// needs to know to retire rather than free a table that an iterator might still use.
+// Only if MemoryUsage has been called do we also record each Range's snapshot in iters
+// so that MemoryUsage can report the bytes retained by iterators. Recording takes
+// iterMu, which we keep off the iteration path of Maps that never report their usage.
+
+// startIter counts an iterator that started with the given tables, and returns an id
+// for endIter. If MemoryUsage has been called, it also records the tables.
+// Like Range, it can be called concurrently with other iterators when there is no writer.
+func (m *Map) startIter(cur fixedTable, old *fixedTable, growStatus growStatus) uint64 {
+	atomic.AddInt32(&m.iterCount, 1)
+	if atomic.LoadUint32(&m.trackIters) == 0 {
+		return 0
+	}
+	m.iterMu.Lock()
+	m.iterSeq++
+	id := m.iterSeq
+	m.iters = append(m.iters, iterSnapshot{id: id, cur: cur, old: old, growStatus: growStatus})
+	m.iterMu.Unlock()
+	return id
+}
+
+// endIter removes the iterator with id, and frees any retired tables
+// if it was the last active iterator.
+func (m *Map) endIter(id uint64) {
+	lastIter := atomic.AddInt32(&m.iterCount, -1) == 0
+	if id == 0 && !(lastIter && m.mem != nil) {
+		return
+	}
+	m.iterMu.Lock()
+	for i := range m.iters {
+		if m.iters[i].id == id {
+			last := len(m.iters) - 1
+			m.iters[i] = m.iters[last]
+			// Don't let the backing array retain the tables.
+			m.iters[last] = iterSnapshot{}
+			m.iters = m.iters[:last]
+			break
+		}
+	}
+	m.freeRetired()
+	m.iterMu.Unlock()
+}
+
+// MemoryUsage returns the bytes used by m's tables,
+// including tables retained by active iterators.
+// Like Get, it can be called concurrently with other readers, but not with a writer.
+func (m *Map) MemoryUsage() MemoryUsage {
+	if m.flags&hashWriting != 0 {
+		fatal("concurrent map read and map write")
+	}
+	// Start tracking iterators for later calls. See startIter.
+	atomic.StoreUint32(&m.trackIters, 1)
+
+	var u MemoryUsage
+	u.Control, u.Slots = tableBytes(&m.current)
+	// seen tracks the backing arrays we have already counted.
+	seen := map[unsafe.Pointer]bool{tableID(&m.current): true}
+	if m.old != nil {
+		u.OldControl, u.OldSlots = tableBytes(m.old)
+		u.GrowStatus = cap(m.growStatus) * 8
+		seen[tableID(m.old)] = true
+		seen[unsafe.Pointer(&m.growStatus[0])] = true
+	}
+
+	m.iterMu.Lock()
+	for i := range m.iters {
+		s := &m.iters[i]
+		tables := []*fixedTable{&s.cur}
+		if s.old != nil {
+			tables = append(tables, s.old)
+		}
+		for _, t := range tables {
+			if id := tableID(t); !seen[id] {
+				seen[id] = true
+				control, slots := tableBytes(t)
+				u.Iterators += control + slots
+			}
+		}
+		if len(s.growStatus) > 0 {
+			if id := unsafe.Pointer(&s.growStatus[0]); !seen[id] {
+				seen[id] = true
+				u.Iterators += cap(s.growStatus) * 8
+			}
+		}
+	}
+	m.iterMu.Unlock()
+
+	u.Total = u.Control + u.Slots + u.OldControl + u.OldSlots + u.GrowStatus + u.Iterators
+	return u
+}
+
+// tableBytes returns the bytes used by the control bytes and slots of t.
+// Chunks that are not yet allocated do not use any memory.
+// We include the small slice of chunk headers with the control bytes.
+func tableBytes(t *fixedTable) (control, slots int) {
+	control = cap(t.chunks) * int(unsafe.Sizeof(tableChunk{}))
+	for i := range t.chunks {
+		if t.chunks[i].allocated() {
+			control += t.chunkSize()
+			slots += t.chunkSize() * int(unsafe.Sizeof(KV{}))
+		}
+	}
+	return control, slots
+}
+
+// tableID identifies the chunks of t.
+func tableID(t *fixedTable) unsafe.Pointer {
+	if len(t.chunks) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(&t.chunks[0])
+}
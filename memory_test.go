@@ -0,0 +1,177 @@
+package swisstable
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// liveHeap returns the bytes of live heap objects after a GC.
+func liveHeap() int {
+	runtime.GC()
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int(ms.HeapAlloc)
+}
+
+// checkClose reports an error if got and want differ by more than 1% plus a small fixed slop,
+// which allows for size class rounding and small unrelated allocations.
+func checkClose(t *testing.T, what string, got, want int) {
+	t.Helper()
+	diff := got - want
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > want/100+16<<10 {
+		t.Errorf("%s = %d bytes, want within 1%% + 16KiB of %d bytes from runtime.MemStats", what, got, want)
+	}
+}
+
+func TestMap_MemoryUsage(t *testing.T) {
+	tests := []struct {
+		name        string
+		maps        int // create multiple maps to make small unrelated allocations less significant
+		capacity    int
+		n           int
+		wantGrowing bool
+	}{
+		{"small", 10_000, 0, 10, false},
+		{"large", 1, 1 << 20, 1 << 20, false},
+		{"growing", 10, 20_000, 26_625, true}, // resize threshold of 26624
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// MemoryUsage does not include the Map structs, so measure those separately.
+			maps := make([]*Map, tt.maps)
+			before := liveHeap()
+			for i := range maps {
+				maps[i] = new(Map)
+			}
+			structBytes := liveHeap() - before
+			for i := range maps {
+				maps[i] = nil
+			}
+
+			before = liveHeap()
+			for i := range maps {
+				m := New(tt.capacity)
+				for k := Key(0); k < Key(tt.n); k++ {
+					m.Set(k, Value(k))
+				}
+				maps[i] = m
+			}
+			after := liveHeap()
+
+			var total int
+			for _, m := range maps {
+				total += m.MemoryUsage().Total
+			}
+			checkClose(t, "sum of Map.MemoryUsage() Total", total+structBytes, after-before)
+
+			m := maps[0]
+			got := m.MemoryUsage()
+			tableSize := m.current.size()
+			if got.Control != tableSize+chunkHeaderBytes(&m.current) || got.Slots != tableSize*16 {
+				t.Errorf("Map.MemoryUsage() = %+v, want Control %d and Slots %d", got, tableSize+chunkHeaderBytes(&m.current), tableSize*16)
+			}
+			if (m.old != nil) != tt.wantGrowing {
+				t.Fatalf("growing = %v, want %v", m.old != nil, tt.wantGrowing)
+			}
+			if tt.wantGrowing {
+				oldSize := m.old.size()
+				oldControl := oldSize + chunkHeaderBytes(m.old)
+				if got.OldControl != oldControl || got.OldSlots != oldSize*16 || got.GrowStatus != len(m.growStatus)*8 {
+					t.Errorf("Map.MemoryUsage() = %+v, want OldControl %d, OldSlots %d, and GrowStatus %d",
+						got, oldControl, oldSize*16, len(m.growStatus)*8)
+				}
+			} else if got.OldControl != 0 || got.OldSlots != 0 || got.GrowStatus != 0 {
+				t.Errorf("Map.MemoryUsage() = %+v, want zero old and growth status bytes", got)
+			}
+			if got.Iterators != 0 {
+				t.Errorf("Map.MemoryUsage() Iterators = %d, want 0", got.Iterators)
+			}
+			runtime.KeepAlive(maps)
+		})
+	}
+}
+
+func TestMap_MemoryUsageIterators(t *testing.T) {
+	before := liveHeap()
+	m := New(20_000) // resize threshold of 26624
+	for k := Key(0); k < 26_625; k++ {
+		m.Set(k, Value(k))
+	}
+	if m.old == nil {
+		t.Fatal("expected to be growing")
+	}
+	oldBytes := m.old.size()*17 + chunkHeaderBytes(m.old) + len(m.growStatus)*8
+	growing := m.MemoryUsage()
+
+	started := false
+	m.Range(func(k Key, v Value) bool {
+		if started {
+			return false
+		}
+		started = true
+
+		// Finishing the grow releases old and growStatus from the Map,
+		// but this iterator still holds them.
+		m.finishGrowForTest()
+		got := m.MemoryUsage()
+		if got.OldControl != 0 || got.GrowStatus != 0 {
+			t.Errorf("Map.MemoryUsage() = %+v, want zero old bytes after growing", got)
+		}
+		if got.Iterators != oldBytes {
+			t.Errorf("Map.MemoryUsage() Iterators = %d, want %d", got.Iterators, oldBytes)
+		}
+		if got.Total != growing.Total {
+			t.Errorf("Map.MemoryUsage() Total = %d, want %d (unchanged)", got.Total, growing.Total)
+		}
+		checkClose(t, "Map.MemoryUsage() Total during iteration", got.Total, liveHeap()-before)
+
+		// A nested iterator shares the tables with the Map, so it does not add anything.
+		m.Range(func(k Key, v Value) bool {
+			if nested := m.MemoryUsage(); nested.Iterators != oldBytes {
+				t.Errorf("Map.MemoryUsage() Iterators with nested iterator = %d, want %d", nested.Iterators, oldBytes)
+			}
+			return false
+		})
+		return true
+	})
+
+	got := m.MemoryUsage()
+	if got.Iterators != 0 || got.Total != got.Control+got.Slots {
+		t.Errorf("Map.MemoryUsage() = %+v after iteration, want only current", got)
+	}
+	checkClose(t, "Map.MemoryUsage() Total after iteration", got.Total, liveHeap()-before)
+	runtime.KeepAlive(m)
+}
+
+// chunkHeaderBytes returns the bytes used by the chunk headers of t.
+func chunkHeaderBytes(t *fixedTable) int {
+	return cap(t.chunks) * int(unsafe.Sizeof(tableChunk{}))
+}
+
+// BenchmarkRange_IterTracking measures the per-Range cost of recording iterator
+// snapshots for MemoryUsage, using a small map so the fixed cost dominates.
+func BenchmarkRange_IterTracking(b *testing.B) {
+	for _, tracked := range []bool{false, true} {
+		b.Run(fmt.Sprintf("tracked=%v", tracked), func(b *testing.B) {
+			m := New(0)
+			for k := Key(0); k < 8; k++ {
+				m.Set(k, Value(k))
+			}
+			if tracked {
+				m.MemoryUsage()
+			}
+			var x int64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				x += iterSwiss(m)
+			}
+		})
+	}
+}
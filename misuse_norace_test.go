@@ -0,0 +1,118 @@
+//go:build !race
+// +build !race
+
+// These tests deliberately race goroutines, so they are excluded when the race detector is enabled.
+// See misuse_test.go for deterministic versions.
+
+package swisstable
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMap_ConcurrentMisuse(t *testing.T) {
+	if testing.Short() {
+		// Each case can take seconds to hit the race. TestMap_Misuse is quick and deterministic.
+		t.Skip("skipping racing goroutines in short mode")
+	}
+	// Make sure the goroutines can run in parallel, or at least be
+	// preempted by the OS at arbitrary points if there is only one CPU.
+	if runtime.GOMAXPROCS(0) < 4 {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	}
+
+	tests := []struct {
+		name    string
+		want    string
+		writer  func(m *Map, i int)
+		another func(m *Map, i int)
+	}{
+		{
+			name:    "concurrent writes",
+			want:    "concurrent map writes",
+			writer:  func(m *Map, i int) { m.Set(Key(i%1000), Value(i)) },
+			another: func(m *Map, i int) { m.Set(Key(i%1000), Value(i)) },
+		},
+		{
+			name:    "concurrent set and delete",
+			want:    "concurrent map writes",
+			writer:  func(m *Map, i int) { m.Set(Key(i%1000), Value(i)) },
+			another: func(m *Map, i int) { m.Delete(Key(i%1000 - 1)) },
+		},
+		{
+			name:    "concurrent read and write",
+			want:    "concurrent map read and map write",
+			writer:  func(m *Map, i int) { m.Set(Key(i%1000), Value(i)) },
+			another: func(m *Map, i int) { m.Get(Key(i % 1000)) },
+		},
+		{
+			name:   "concurrent iteration and write",
+			want:   "concurrent map iteration and map write",
+			writer: func(m *Map, i int) { m.Set(Key(i%1000), Value(i)) },
+			another: func(m *Map, i int) {
+				m.Range(func(key Key, value Value) bool { return true })
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deadline := time.Now().Add(10 * time.Second)
+			for time.Now().Before(deadline) {
+				// Keep the number of keys below the resize threshold
+				// to make it less likely that the racing goroutines corrupt the map badly.
+				m := New(2000)
+				for i := 0; i < 1000; i++ {
+					m.Set(Key(i), Value(i))
+				}
+
+				var wg sync.WaitGroup
+				var stop int32
+				msgs := make(chan string, 2)
+				wg.Add(2)
+				go func() {
+					// The writer keeps writing until the other goroutine is done.
+					defer wg.Done()
+					defer func() {
+						if r := recover(); r != nil {
+							msgs <- fmt.Sprint(r)
+						}
+					}()
+					for i := 0; atomic.LoadInt32(&stop) == 0; i++ {
+						tt.writer(m, i)
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					defer atomic.StoreInt32(&stop, 1)
+					defer func() {
+						if r := recover(); r != nil {
+							msgs <- fmt.Sprint(r)
+						}
+					}()
+					for i := 0; i < 1000; i++ {
+						tt.another(m, i)
+					}
+				}()
+				wg.Wait()
+				close(msgs)
+
+				for msg := range msgs {
+					// Detection is best effort. The racing goroutines might instead
+					// observe a corrupted map (for example, an index out of range),
+					// in which case we try again.
+					if strings.Contains(msg, tt.want) {
+						return
+					}
+				}
+			}
+			t.Fatalf("did not detect %q", tt.want)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package swisstable
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestMap_Misuse checks the detection of concurrent misuse without racing goroutines.
+// It sets hashWriting directly, as another goroutine in the middle of a write would,
+// and then calls the operation that should detect it.
+// TestMap_ConcurrentMisuse races real goroutines.
+func TestMap_Misuse(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		op   func(m *Map)
+	}{
+		{"Set", "concurrent map writes", func(m *Map) { m.Set(1, 1) }},
+		{"Delete", "concurrent map writes", func(m *Map) { m.Delete(1) }},
+		{"Free", "concurrent map writes", func(m *Map) { m.Free() }},
+		{"Get", "concurrent map read and map write", func(m *Map) { m.Get(1) }},
+		{"MemoryUsage", "concurrent map read and map write", func(m *Map) { m.MemoryUsage() }},
+		{"Range", "concurrent map iteration and map write", func(m *Map) {
+			m.Range(func(key Key, value Value) bool { return true })
+		}},
+	}
+	maps := []struct {
+		name     string
+		capacity int
+		n        int
+	}{
+		{"small", 0, 10},
+		{"hashed", 1000, 1000},
+		{"growing", 1000, 1700}, // resize threshold of 1664
+	}
+
+	for _, tt := range tests {
+		for _, mm := range maps {
+			t.Run(tt.name+"/"+mm.name, func(t *testing.T) {
+				m := New(mm.capacity)
+				for i := 0; i < mm.n; i++ {
+					m.Set(Key(i), Value(i))
+				}
+				if m.small != (mm.name == "small") || (m.old != nil) != (mm.name == "growing") {
+					t.Fatalf("small = %v, growing = %v, want %s map", m.small, m.old != nil, mm.name)
+				}
+
+				m.flags |= hashWriting
+				if got := recoverMsg(func() { tt.op(m) }); !strings.Contains(got, tt.want) {
+					t.Errorf("got panic %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestMap_MisuseDuringRange(t *testing.T) {
+	// A write that starts on another goroutine during a Range is detected
+	// when the iteration continues.
+	m := New(1000)
+	for i := 0; i < 1000; i++ {
+		m.Set(Key(i), Value(i))
+	}
+	got := recoverMsg(func() {
+		m.Range(func(key Key, value Value) bool {
+			m.flags |= hashWriting
+			return true
+		})
+	})
+	if want := "concurrent map iteration and map write"; !strings.Contains(got, want) {
+		t.Errorf("got panic %q, want %q", got, want)
+	}
+}
+
+// recoverMsg calls f, and returns the value it panicked with, or "" if it did not panic.
+func recoverMsg(f func()) (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = fmt.Sprint(r)
+		}
+	}()
+	f()
+	return ""
+}
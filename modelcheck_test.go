@@ -0,0 +1,413 @@
+package swisstable
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Exhaustive small-state model checking.
+//
+// Fuzzing explores states randomly. Here, for tiny tables under weak hash functions,
+// we enumerate every sequence of operations up to a given depth, starting from a
+// handful of prefilled states chosen to sit just below a grow, and check each step
+// against a runtime map oracle and CheckInvariants. Operations include Set and Delete
+// inside Range callbacks, which can start, continue, and finish grows mid-iteration.
+//
+// Each scenario also lists features it must reach, such as the rare case in moveGroups
+// that moves a key's displaced group, so that a change that makes the enumeration
+// stop reaching an interesting state fails rather than silently losing coverage.
+//
+// The default depth of 2 runs quickly. Each additional level multiplies the time by
+// the number of ops (32), so depth 3 takes seconds, and depth 4 takes minutes:
+//
+//	go test -run=ModelCheck -modeldepth=4
+
+var modelDepthFlag = flag.Int("modeldepth", 2, "length of operation sequences to enumerate in model checking tests")
+
+type modelOpKind byte
+
+const (
+	modelSet modelOpKind = iota
+	modelDelete
+	modelRange
+)
+
+// modelOp is an operation in a model checking sequence.
+// A modelRange op applies inner when the iteration reaches rangeIndex,
+// or after the iteration if the map has fewer keys.
+type modelOp struct {
+	kind       modelOpKind
+	key        Key
+	rangeIndex int
+	inner      *modelOp
+}
+
+func (op modelOp) String() string {
+	switch op.kind {
+	case modelSet:
+		return fmt.Sprintf("Set(%d)", op.key)
+	case modelDelete:
+		return fmt.Sprintf("Delete(%d)", op.key)
+	default:
+		return fmt.Sprintf("Range(at %d: %v)", op.rangeIndex, op.inner)
+	}
+}
+
+// modelOps returns the operations to enumerate for keys.
+func modelOps(keys []Key, rangeIndexes []int) []modelOp {
+	var writes []modelOp
+	for _, k := range keys {
+		writes = append(writes, modelOp{kind: modelSet, key: k}, modelOp{kind: modelDelete, key: k})
+	}
+	ops := append([]modelOp(nil), writes...)
+	for _, i := range rangeIndexes {
+		for j := range writes {
+			ops = append(ops, modelOp{kind: modelRange, rangeIndex: i, inner: &writes[j]})
+		}
+	}
+	return ops
+}
+
+// modelScenario is a starting state and the operations to enumerate from it.
+type modelScenario struct {
+	name     string
+	capacity int
+	hash     hashFunc
+	prefill  []Key
+	// keys are used by the enumerated operations. They should include keys from
+	// prefill in interesting positions, along with new keys.
+	keys []Key
+	// moves and window set growMoves and growSweepWindow.
+	moves  int
+	window uint64
+	// hashed forces the hashed layout for a single-group table, which otherwise starts in small mode.
+	hashed bool
+	// want lists features that some sequence must reach. See modelChecker.features.
+	want []string
+}
+
+// modelChecker runs sequences of operations against a Map and a runtime map oracle.
+type modelChecker struct {
+	sc     modelScenario
+	m      *Map
+	mirror map[Key]Value
+	// features records which interesting states were reached.
+	features map[string]int
+	// checkKeys are the keys to look up after each operation.
+	checkKeys []Key
+}
+
+func (mc *modelChecker) reset() {
+	mc.m = New(mc.sc.capacity, WithHashFunc(mc.sc.hash), WithSeed(0))
+	if mc.sc.hashed {
+		// The table is still empty, so it is also a valid hashed table.
+		mc.m.small = false
+	}
+	mc.mirror = make(map[Key]Value)
+	for _, k := range mc.sc.prefill {
+		mc.m.Set(k, Value(k))
+		mc.mirror[k] = Value(k)
+	}
+}
+
+// run resets the map and applies seq, returning an error describing the first mismatch.
+func (mc *modelChecker) run(seq []modelOp) (err error) {
+	mc.reset()
+	if err := mc.check(); err != nil {
+		return fmt.Errorf("after prefill: %v", err)
+	}
+	for i, op := range seq {
+		if err := mc.apply(op); err != nil {
+			return fmt.Errorf("op %d %v: %v", i, op, err)
+		}
+		if err := mc.check(); err != nil {
+			return fmt.Errorf("after op %d %v: %v", i, op, err)
+		}
+	}
+	return nil
+}
+
+// write applies a Set or Delete to both the Map and the oracle, and records features.
+func (mc *modelChecker) write(op modelOp, inRange bool) {
+	wasGrowing := mc.m.old != nil
+	wasSmall := mc.m.small
+	gens := mc.m.resizeGenerations
+	displacedMoves := mc.m.displacedMoves
+	switch op.kind {
+	case modelSet:
+		mc.m.Set(op.key, Value(op.key))
+		mc.mirror[op.key] = Value(op.key)
+	case modelDelete:
+		mc.m.Delete(op.key)
+		delete(mc.mirror, op.key)
+	}
+
+	if wasGrowing {
+		mc.features["write while growing"]++
+	}
+	if mc.m.displacedMoves != displacedMoves {
+		mc.features["moved displaced group"]++
+	}
+	if inRange {
+		if mc.m.resizeGenerations != gens {
+			mc.features["grow started during Range"]++
+		}
+		if wasGrowing && mc.m.old == nil {
+			mc.features["grow finished during Range"]++
+		}
+		if wasSmall && !mc.m.small {
+			mc.features["promoted during Range"]++
+		}
+	}
+}
+
+// apply applies op, validating the keys seen by a Range.
+func (mc *modelChecker) apply(op modelOp) error {
+	if op.kind != modelRange {
+		mc.write(op, false)
+		return nil
+	}
+	if mc.m.old != nil {
+		mc.features["Range while growing"]++
+	}
+
+	// As in Vmap.Range, allowed tracks start + added - deleted, mustSee tracks start - deleted,
+	// and a key deleted then re-added during the iteration may be seen again.
+	allowed, mustSee := make(map[Key]bool), make(map[Key]bool)
+	for k := range mc.mirror {
+		allowed[k], mustSee[k] = true, true
+	}
+	seen, deleted, readded := make(map[Key]bool), make(map[Key]bool), make(map[Key]bool)
+	track := func(inner modelOp) {
+		k := inner.key
+		if inner.kind == modelSet {
+			allowed[k] = true
+			if deleted[k] {
+				readded[k] = true
+				delete(deleted, k)
+			}
+			return
+		}
+		delete(allowed, k)
+		delete(mustSee, k)
+		delete(readded, k)
+		deleted[k] = true
+	}
+
+	var err error
+	var i int
+	applied := false
+	mc.m.Range(func(k Key, v Value) bool {
+		switch {
+		case !allowed[k]:
+			err = fmt.Errorf("Range saw unexpected key %d", k)
+		case seen[k] && !readded[k]:
+			err = fmt.Errorf("Range saw key %d twice", k)
+		case v != mc.mirror[k]:
+			err = fmt.Errorf("Range saw key %d with value %d, want %d", k, v, mc.mirror[k])
+		}
+		if err != nil {
+			return false
+		}
+		seen[k] = true
+		if i == op.rangeIndex {
+			mc.write(*op.inner, true)
+			track(*op.inner)
+			applied = true
+			if err = mc.check(); err != nil {
+				err = fmt.Errorf("during Range after %v: %v", op.inner, err)
+				return false
+			}
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for k := range mustSee {
+		if !seen[k] {
+			return fmt.Errorf("Range did not see key %d", k)
+		}
+	}
+	if !applied {
+		mc.write(*op.inner, false)
+	}
+	return nil
+}
+
+// check compares the Map with the oracle, and checks the Map's invariants.
+func (mc *modelChecker) check() error {
+	if err := mc.m.CheckInvariants(); err != nil {
+		return err
+	}
+	if mc.m.Len() != len(mc.mirror) {
+		return fmt.Errorf("Len() = %d, want %d", mc.m.Len(), len(mc.mirror))
+	}
+	for _, k := range mc.checkKeys {
+		got, gotOk := mc.m.Get(k)
+		want, wantOk := mc.mirror[k]
+		if got != want || gotOk != wantOk {
+			return fmt.Errorf("Get(%d) = %d, %v, want %d, %v", k, got, gotOk, want, wantOk)
+		}
+	}
+	if mc.m.old != nil {
+		mc.features["growing"]++
+	}
+	switch {
+	case mc.m.small:
+		mc.features["small"]++
+	case mc.m.current.groups() == 1:
+		mc.features["hashed single group"]++
+	}
+	return nil
+}
+
+// enumerate runs every sequence of ops of length depth, and calls f for any failure.
+func (mc *modelChecker) enumerate(ops []modelOp, depth int, f func(seq []modelOp, err error)) (sequences int) {
+	seq := make([]modelOp, depth)
+	var walk func(n int)
+	walk = func(n int) {
+		if n == depth {
+			sequences++
+			if err := mc.run(seq); err != nil {
+				f(append([]modelOp(nil), seq...), err)
+			}
+			return
+		}
+		for _, op := range ops {
+			seq[n] = op
+			walk(n + 1)
+		}
+	}
+	walk(0)
+	return sequences
+}
+
+// keyRange returns keys from start up to end by stride.
+func keyRange(start, end, stride Key) []Key {
+	var keys []Key
+	for k := start; k < end; k += stride {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestMap_ModelCheck(t *testing.T) {
+	// With identityHash, a table of 4 groups puts key k in group k%4.
+	// displaced fills group 0 with 16 keys that are 0 mod 4, so that 64 through 76
+	// are displaced to group 1, then fills the rest up to the resize threshold of 52.
+	displaced := append(keyRange(0, 80, 4), keyRange(1, 64, 4)...)
+	displaced = append(displaced, keyRange(2, 64, 4)...)
+	// With zeroHash, every key has natural group 0 and the same h2, so the 52 keys
+	// form one probe chain through groups 0, 1, 3 and 2.
+	chain := keyRange(0, 52, 1)
+
+	scenarios := []modelScenario{
+		{
+			name:     "identity, 1 group",
+			capacity: 0,
+			hashed:   true,
+			hash:     identityHash,
+			prefill:  keyRange(0, 12, 1),
+			keys:     []Key{0, 16, 17, 32},
+			moves:    2, window: 1000,
+			want: []string{"hashed single group", "grow started during Range"},
+		},
+		{
+			name:     "identity, small",
+			capacity: 0,
+			hash:     identityHash,
+			prefill:  keyRange(0, 12, 1),
+			keys:     []Key{0, 16, 17, 32},
+			moves:    2, window: 1000,
+			want: []string{"small", "promoted during Range"},
+		},
+		{
+			name:     "identity, displaced",
+			capacity: 50,
+			hash:     identityHash,
+			prefill:  displaced,
+			keys:     []Key{0, 64, 80, 1},
+			moves:    2, window: 1000,
+			want: []string{"growing", "write while growing", "Range while growing", "grow started during Range"},
+		},
+		{
+			// The prefill's last key starts a grow.
+			name:     "identity, displaced, mid-grow",
+			capacity: 50,
+			hash:     identityHash,
+			prefill:  append(displaced[:len(displaced):len(displaced)], 80),
+			keys:     []Key{0, 64, 84, 1},
+			moves:    2, window: 1000,
+			want: []string{"growing", "write while growing", "Range while growing", "grow finished during Range"},
+		},
+		{
+			name:     "identity, displaced, minimal moves",
+			capacity: 50,
+			hash:     identityHash,
+			prefill:  displaced,
+			keys:     []Key{0, 64, 80, 1},
+			moves:    1, window: 1,
+			want: []string{"growing", "write while growing", "Range while growing", "grow started during Range"},
+		},
+		{
+			name:     "zero hash, chain",
+			capacity: 50,
+			hash:     zeroHash,
+			prefill:  chain,
+			keys:     []Key{0, 20, 40, 100},
+			moves:    2, window: 1000,
+			want: []string{"growing", "write while growing", "Range while growing", "grow started during Range"},
+		},
+		{
+			name:     "zero hash, chain, minimal moves",
+			capacity: 50,
+			hash:     zeroHash,
+			prefill:  chain,
+			keys:     []Key{0, 20, 40, 100},
+			moves:    1, window: 1,
+			want: []string{"growing", "write while growing", "Range while growing", "moved displaced group"},
+		},
+	}
+
+	depth := *modelDepthFlag
+	for _, sc := range scenarios {
+		t.Run(sc.name, func(t *testing.T) {
+			defer func(moves int, window uint64) {
+				growMoves, growSweepWindow = moves, window
+			}(growMoves, growSweepWindow)
+			growMoves, growSweepWindow = sc.moves, sc.window
+
+			mc := &modelChecker{sc: sc, features: make(map[string]int)}
+			mc.checkKeys = append(append([]Key(nil), sc.prefill...), sc.keys...)
+			ops := modelOps(sc.keys, []int{0, 1, 40})
+
+			var failures int
+			sequences := mc.enumerate(ops, depth, func(seq []modelOp, err error) {
+				failures++
+				if failures <= 5 {
+					t.Errorf("sequence %v: %v", seq, err)
+				}
+			})
+			if failures > 5 {
+				t.Errorf("%d more failing sequences", failures-5)
+			}
+
+			var reached []string
+			for f, n := range mc.features {
+				reached = append(reached, fmt.Sprintf("%s: %d", f, n))
+			}
+			sort.Strings(reached)
+			t.Logf("%d sequences of depth %d over %d ops. reached: %s", sequences, depth, len(ops), strings.Join(reached, ", "))
+			for _, f := range sc.want {
+				if mc.features[f] == 0 {
+					t.Errorf("no sequence reached %q", f)
+				}
+			}
+		})
+	}
+}
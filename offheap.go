@@ -0,0 +1,207 @@
+package swisstable
+
+import (
+	"reflect"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Off-heap storage.
+//
+// With the OffHeap or Arena options, a Map allocates the control bytes and slots
+// of its tables from memory that is not managed by the Go garbage collector.
+// For huge maps of pointer-free key/values, this means the tables are not scanned by the GC
+// and do not count towards the GC heap goal. The small chunk headers and growth status bits
+// stay on the Go heap.
+//
+// Each chunk (see chunk.go) is a single allocation holding its slots followed by
+// its control bytes, which keeps the slots aligned. Tables are released when the Map no
+// longer uses them: old when growth finishes, and all tables when the Map is reset
+// (such as by UnmarshalBinary). If an active iterator still uses a table, it is retired instead,
+// and freed once the last iterator finishes. Free releases everything else.
+//
+// Because the GC never looks inside off-heap memory, KV must not contain pointers.
+// SWMR mode (see swmr.go) is not supported, because readers can still be using a table
+// when the writer releases it.
+// TODO: SWMR could defer frees with an epoch scheme for readers.
+
+// Allocator provides memory for the tables of a Map, such as from an arena or
+// from memory mapped outside of the Go heap. See Arena.
+type Allocator interface {
+	// Alloc returns size bytes of memory that is aligned to at least 8 bytes.
+	// The contents do not need to be zeroed.
+	Alloc(size int) []byte
+	// Free releases memory returned by Alloc.
+	Free(b []byte)
+}
+
+// OffHeap returns an Option that stores the control bytes and slots of the Map
+// in anonymous memory mappings rather than on the Go heap. The memory is only
+// released by the Map as it grows, or by Free. Each mapping costs a system call and
+// whole pages, so tables of up to 2048 slots (about 34 KiB) stay on the Go heap,
+// where the GC still does not scan them.
+// OffHeap panics if KV contains pointers, and it cannot be combined with SingleWriter.
+func OffHeap() Option {
+	return Arena(mmapAllocator{})
+}
+
+// Arena returns an Option that stores the control bytes and slots of the Map
+// in memory from a. The memory is only released by the Map as it grows, or by Free.
+// Arena panics if KV contains pointers, and it cannot be combined with SingleWriter.
+func Arena(a Allocator) Option {
+	if hasPointers(reflect.TypeOf(KV{})) {
+		panic("swisstable: off-heap storage requires key and value types without pointers")
+	}
+	return func(m *Map) {
+		m.mem = a
+	}
+}
+
+// hasPointers reports whether values of type t contain pointers that the GC must see.
+func hasPointers(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Array:
+		return t.Len() > 0 && hasPointers(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasPointers(t.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	case reflect.Ptr, reflect.UnsafePointer, reflect.Map, reflect.Chan, reflect.Func,
+		reflect.Interface, reflect.Slice, reflect.String:
+		return true
+	default:
+		return false
+	}
+}
+
+// mmapAllocator allocates from anonymous memory mappings. See OffHeap.
+// Each allocation is its own mapping, which costs a system call and rounds up to whole pages.
+// That is a poor trade for small tables, whose single chunk is sized to the table
+// (272 bytes for 16 slots), so allocations below mmapMinBytes come from the Go heap instead.
+// Those hold no pointers, so the GC does not scan them, and they are small enough that
+// counting towards the GC heap goal does not matter.
+type mmapAllocator struct{}
+
+// mmapMinBytes is the smallest allocation that mmapAllocator maps, which is 16 pages.
+// Tables of up to 2048 slots use the Go heap.
+const mmapMinBytes = 64 << 10
+
+func (mmapAllocator) Alloc(size int) []byte {
+	if size < mmapMinBytes {
+		// Use a []uint64 to get 8-byte alignment.
+		return unsafe.Slice((*byte)(unsafe.Pointer(&make([]uint64, (size+7)/8)[0])), size)
+	}
+	b, err := mmapAnon(size)
+	if err != nil {
+		panic("swisstable: off-heap allocation failed: " + err.Error())
+	}
+	return b
+}
+
+func (mmapAllocator) Free(b []byte) {
+	if len(b) < mmapMinBytes {
+		// From the Go heap, so the GC frees it once the chunk no longer refers to it.
+		return
+	}
+	if err := munmap(b); err != nil {
+		panic("swisstable: off-heap free failed: " + err.Error())
+	}
+}
+
+// chunkBytes returns the size of the single allocation used by an off-heap chunk with chunkSize slots.
+func chunkBytes(chunkSize int) int {
+	return chunkSize * (int(unsafe.Sizeof(KV{})) + 1)
+}
+
+// allocIn allocates the slots and control bytes for c from mem.
+func (c *tableChunk) allocIn(chunkSize int, mem Allocator) {
+	b := mem.Alloc(chunkBytes(chunkSize))
+	if len(b) < chunkBytes(chunkSize) || uintptr(unsafe.Pointer(&b[0]))%8 != 0 {
+		panic("swisstable: Allocator returned short or misaligned memory")
+	}
+	slots := unsafe.Pointer(&b[0])
+	control := unsafe.Slice((*byte)(unsafe.Add(slots, chunkSize*int(unsafe.Sizeof(KV{})))), chunkSize)
+	for i := range control {
+		control[i] = emptySentinel
+	}
+	*c = tableChunk{control: unsafe.Pointer(&control[0]), slots: slots}
+}
+
+// free releases the off-heap memory of t. t must not be used afterwards.
+func (t *fixedTable) free() {
+	if t.mem == nil {
+		return
+	}
+	for i := range t.chunks {
+		if c := &t.chunks[i]; c.allocated() {
+			t.mem.Free(unsafe.Slice((*byte)(c.slots), chunkBytes(t.chunkSize())))
+			*c = lazyChunk()
+		}
+	}
+}
+
+// release frees the off-heap memory of t, which m no longer uses.
+// If an active iterator might still use t, t is retired until the last iterator finishes.
+func (m *Map) release(t *fixedTable) {
+	if t.mem == nil {
+		return
+	}
+	m.iterMu.Lock()
+	if atomic.LoadInt32(&m.iterCount) > 0 {
+		m.retired = append(m.retired, *t)
+	} else {
+		t.free()
+	}
+	m.iterMu.Unlock()
+}
+
+// freeRetired frees the retired tables once there are no active iterators.
+// m.iterMu must be held.
+func (m *Map) freeRetired() {
+	if atomic.LoadInt32(&m.iterCount) > 0 {
+		return
+	}
+	for i := range m.retired {
+		m.retired[i].free()
+	}
+	m.retired = nil
+}
+
+// Free releases the memory of m's tables, which is required to release off-heap
+// memory from the OffHeap and Arena options. For other Maps, Free only drops m's
+// references to its tables. After Free, m is empty like a zero Map, and allocates
+// new tables if it is used again. Free must not be called during Range.
+func (m *Map) Free() {
+	if m.rec != nil {
+		m.rec.free()
+	}
+	if m.flags&hashWriting != 0 {
+		fatal("concurrent map writes")
+	}
+	m.iterMu.Lock()
+	if atomic.LoadInt32(&m.iterCount) > 0 {
+		m.iterMu.Unlock()
+		panic("swisstable: Free called during Range")
+	}
+	m.current.free()
+	if m.old != nil {
+		m.old.free()
+	}
+	m.freeRetired()
+	m.iterMu.Unlock()
+
+	m.current = fixedTable{}
+	m.old = nil
+	m.growStatus = nil
+	m.elemCount = 0
+	// Leave small mode so that m acts like an empty zero Map.
+	m.small = false
+	m.resizeThreshold = 0
+	if m.swmr {
+		// Readers must not keep seeing the freed tables.
+		m.publish()
+	}
+}
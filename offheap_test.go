@@ -0,0 +1,169 @@
+package swisstable
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// countingArena is an Allocator backed by the Go heap that tracks live allocations.
+type countingArena struct {
+	live map[unsafe.Pointer]int
+}
+
+func newCountingArena() *countingArena {
+	return &countingArena{live: make(map[unsafe.Pointer]int)}
+}
+
+func (a *countingArena) Alloc(size int) []byte {
+	// Use a []uint64 to get 8-byte alignment.
+	b := unsafe.Slice((*byte)(unsafe.Pointer(&make([]uint64, (size+7)/8)[0])), size)
+	a.live[unsafe.Pointer(&b[0])] = size
+	return b
+}
+
+func (a *countingArena) Free(b []byte) {
+	p := unsafe.Pointer(&b[0])
+	if a.live[p] != len(b) {
+		panic("Free of unknown allocation")
+	}
+	delete(a.live, p)
+}
+
+func TestMap_OffHeap(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "js" || runtime.GOOS == "plan9" {
+		t.Skip("OffHeap is not supported on this platform")
+	}
+	for _, capacity := range []int{0, 1000, maxChunkGroups * 16 * 2} {
+		m := New(capacity, OffHeap())
+		want := make(map[Key]Value)
+		for i := 0; i < 200_000; i++ {
+			k := Key(i * 7)
+			m.Set(k, Value(i))
+			want[k] = Value(i)
+			if i%3 == 0 {
+				m.Delete(k)
+				delete(want, k)
+			}
+		}
+		if m.Len() != len(want) {
+			t.Fatalf("capacity %d: Map.Len() = %d, want %d", capacity, m.Len(), len(want))
+		}
+		for k, v := range want {
+			if got, ok := m.Get(k); !ok || got != v {
+				t.Fatalf("capacity %d: Map.Get(%d) = %d, %v, want %d, true", capacity, k, got, ok, v)
+			}
+		}
+		m.Free()
+	}
+}
+
+func TestMap_ArenaFree(t *testing.T) {
+	// Growing during Range retires old while the iterator uses it.
+	// All memory must be freed, whether or not it is retired.
+	a := newCountingArena()
+	m := New(0, Arena(a))
+	for i := 0; i < 10; i++ {
+		m.Set(Key(i), Value(i))
+	}
+	next := 10
+	sawRetired := false
+	m.Range(func(k Key, v Value) bool {
+		for i := 0; i < 100; i++ {
+			m.Set(Key(next), Value(next))
+			next++
+		}
+		sawRetired = sawRetired || len(m.retired) > 0
+		return true
+	})
+	if !sawRetired {
+		t.Errorf("no tables were retired during Range")
+	}
+	if len(m.retired) != 0 {
+		t.Errorf("got %d retired tables after Range, want 0", len(m.retired))
+	}
+	for i := 0; i < next; i++ {
+		if v, ok := m.Get(Key(i)); !ok || v != Value(i) {
+			t.Fatalf("Map.Get(%d) = %d, %v, want %d, true", i, v, ok, i)
+		}
+	}
+
+	// Only the current and old tables are live.
+	want := allocatedChunks(&m.current)
+	if m.old != nil {
+		want += allocatedChunks(m.old)
+	}
+	if len(a.live) != want {
+		t.Errorf("got %d live allocations, want %d", len(a.live), want)
+	}
+
+	// Resetting releases the tables too.
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Map.MarshalBinary() error: %v", err)
+	}
+	if err := m.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Map.UnmarshalBinary() error: %v", err)
+	}
+	if m.Len() != next {
+		t.Errorf("Map.Len() = %d after UnmarshalBinary, want %d", m.Len(), next)
+	}
+
+	m.Free()
+	if len(a.live) != 0 {
+		t.Errorf("got %d live allocations after Free, want 0", len(a.live))
+	}
+}
+
+func TestMmapAllocator(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "js" || runtime.GOOS == "plan9" {
+		t.Skip("OffHeap is not supported on this platform")
+	}
+	// Tables of up to 2048 slots come from the Go heap, as the OffHeap doc says, and larger ones are mapped.
+	if chunkBytes(2048) >= mmapMinBytes || chunkBytes(4096) < mmapMinBytes {
+		t.Errorf("mmapMinBytes %d does not fall between the chunks of 2048 and 4096 slot tables", mmapMinBytes)
+	}
+	for _, slots := range []int{16, 2048, 4096} {
+		var a mmapAllocator
+		size := chunkBytes(slots)
+		b := a.Alloc(size)
+		if len(b) != size || uintptr(unsafe.Pointer(&b[0]))%8 != 0 {
+			t.Fatalf("mmapAllocator.Alloc(%d) returned %d bytes at %p", size, len(b), &b[0])
+		}
+		for i := range b {
+			b[i] = byte(i)
+		}
+		a.Free(b)
+	}
+}
+
+func TestArena_SingleWriter(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("New with Arena and SingleWriter did not panic")
+		}
+	}()
+	New(0, Arena(newCountingArena()), SingleWriter())
+}
+
+func TestHasPointers(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want bool
+	}{
+		{KV{}, false},
+		{[4]int64{}, false},
+		{[0]*int{}, false},
+		{struct{ a, b uint32 }{}, false},
+		{struct{ s string }{}, true},
+		{[2]struct{ p *int }{}, true},
+		{[]byte{}, true},
+		{unsafe.Pointer(nil), true},
+	}
+	for _, tt := range tests {
+		if got := hasPointers(reflect.TypeOf(tt.v)); got != tt.want {
+			t.Errorf("hasPointers(%T) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
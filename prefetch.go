@@ -0,0 +1,106 @@
+package swisstable
+
+import (
+	"fmt"
+	"math/bits"
+	"unsafe"
+)
+
+// Software prefetching for cold lookups.
+//
+// For a table much larger than the CPU caches, a lookup typically has two cache misses
+// one after the other: the control bytes of the key's natural group, and then the slot for
+// the matching h2. The runtime map keeps its tophash bytes next to its keys in a bucket,
+// so it often pays for only one miss, which is why Get can be slower than the runtime map
+// for cold lookups in large maps.
+//
+// With the PrefetchLookups option, find starts loading all 16 slots of the natural group
+// (4 cache lines) while it loads the control bytes, so the two misses overlap.
+// When probing continues past the natural group, it also prefetches the slot for the
+// first h2 match and the control bytes of the next probe group before comparing keys.
+//
+// Plain Go cannot express a prefetch, so we use small assembly helpers (see avo/asm.go).
+// Each call costs a few ns even when the slots are already cached, which slows hot
+// lookups, so this is not the default.
+
+// PrefetchLookups returns an Option that makes lookups prefetch slots to reduce
+// the time spent waiting on memory when the Map is much larger than the CPU caches
+// and lookups are spread across it. It makes lookups of recently used keys slower.
+// It does not affect Get in SingleWriter mode.
+func PrefetchLookups() Option {
+	return func(m *Map) {
+		m.prefetch = true
+	}
+}
+
+// findPrefetch is find for the PrefetchLookups option.
+func (m *Map) findPrefetch(t *fixedTable, k Key, h uint64) (kv *KV, group uint64, offset int) {
+	group = h & t.groupMask
+	h2 := t.h2(h)
+
+	var probeCount uint64
+	if statsEnabled {
+		m.lookups.inc()
+	}
+
+	// Start loading the natural group's slots before we load its control bytes.
+	// A chunk that is not yet allocated has no slots, and only EMPTY control bytes.
+	chunk, pos := t.locate(group)
+	if chunk.allocated() {
+		prefetchGroupSlots(uintptr(unsafe.Pointer(chunk.slot(pos))))
+	}
+
+	for {
+		controlBytes := chunk.groupControl(pos)
+		bitmask, ok := MatchByte(h2, controlBytes)
+		if debug && !ok {
+			panic("short control byte slice")
+		}
+		// Unlike find, check for EMPTY before comparing keys so that the loads of
+		// the slot for the first h2 match and the next probe group overlap.
+		emptyBitmask, ok := MatchByte(emptySentinel, controlBytes)
+		if debug && !ok {
+			panic("short control byte slice")
+		}
+		if bitmask != 0 && probeCount != 0 && chunk.allocated() {
+			// We already prefetched the natural group's slots.
+			prefetch(uintptr(unsafe.Pointer(chunk.slot(pos + uint64(bits.TrailingZeros32(bitmask))))))
+		}
+		if emptyBitmask == 0 {
+			// We will need the next probe group unless the key is in this group.
+			next := (group + probeCount + 1) & t.groupMask
+			prefetch(uintptr(unsafe.Pointer(&t.groupControl(next)[0])))
+		}
+
+		for bitmask != 0 {
+			offset = bits.TrailingZeros32(bitmask)
+			kv := chunk.slot(pos + uint64(offset))
+			if statsEnabled {
+				m.getH2Matches.inc()
+			}
+			if kv.Key == k {
+				return kv, group, offset
+			}
+			if statsEnabled {
+				m.getH2FalsePositives.inc()
+			}
+			bitmask &^= 1 << offset
+		}
+
+		// If we have any EMPTY positions, the key was never displaced beyond this group.
+		if emptyBitmask != 0 {
+			return nil, group, offset
+		}
+
+		// Continue our quadratic probing across groups. See find.
+		if statsEnabled {
+			m.getExtraGroups.inc()
+		}
+		probeCount++
+		group = (group + probeCount) & t.groupMask
+		if debug && probeCount >= t.groups() {
+			panic(fmt.Sprintf("impossible: probeCount: %d groups: %d underlying table len: %d", probeCount, t.groups(), t.size()))
+		}
+		chunk, pos = t.locate(group)
+	}
+}
@@ -0,0 +1,67 @@
+package swisstable
+
+import (
+	"testing"
+)
+
+func TestMap_PrefetchLookups(t *testing.T) {
+	tests := []struct {
+		name     string
+		hashFunc hashFunc
+		count    int
+	}{
+		{"default hash", nil, 100_000},
+		// A weak hash gives long probe chains.
+		{"identity hash", identityHash, 5000},
+		{"zero hash", zeroHash, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{PrefetchLookups()}
+			if tt.hashFunc != nil {
+				opts = append(opts, WithHashFunc(tt.hashFunc))
+			}
+			m := New(0, opts...)
+			want := make(map[Key]Value)
+			for i := 0; i < tt.count; i++ {
+				k := Key(i * 16)
+				m.Set(k, Value(i))
+				want[k] = Value(i)
+				if i%4 == 0 {
+					m.Delete(Key(i * 8))
+					delete(want, Key(i*8))
+				}
+			}
+			for i := 0; i < tt.count*2; i++ {
+				k := Key(i * 8)
+				wantV, wantOk := want[k]
+				if v, ok := m.Get(k); v != wantV || ok != wantOk {
+					t.Fatalf("Map.Get(%d) = %d, %v, want %d, %v", k, v, ok, wantV, wantOk)
+				}
+			}
+		})
+	}
+}
+
+func TestMap_PrefetchLookupsUnallocatedChunks(t *testing.T) {
+	// A presized table allocates its chunks on first write, so most lookups here
+	// are in chunks without slots. Run with -race, which enables checkptr and rejects
+	// pointer arithmetic on the nil slots of an unallocated chunk.
+	m := New(1<<20, PrefetchLookups())
+	m.Set(1, 1)
+	for k := Key(0); k < 100_000; k++ {
+		v, ok := m.Get(k)
+		if ok != (k == 1) || (ok && v != 1) {
+			t.Fatalf("Map.Get(%d) = %d, %v", k, v, ok)
+		}
+	}
+	var allocated int
+	for i := range m.current.chunks {
+		if m.current.chunks[i].allocated() {
+			allocated++
+		}
+	}
+	if allocated != 1 || len(m.current.chunks) < 2 {
+		t.Errorf("%d of %d chunks allocated, want 1 of several", allocated, len(m.current.chunks))
+	}
+}
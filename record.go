@@ -0,0 +1,179 @@
+package swisstable
+
+import (
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/thepudds/swisstable/internal/trace"
+)
+
+// Recorder records the operations on a Map to a compact binary trace, which can
+// be replayed offline with cmd/swissreplay to reproduce a problem.
+// It records each Get with its result, each Set, Delete and Free, and the start and end of
+// each Range, along with which Range callback any nested operations happened in.
+// The trace starts with the seed, hash function and initial table size of the Map.
+//
+// A Recorder is attached to a single Map with the Record option.
+// Operations that replace the contents of the Map, such as UnmarshalBinary, are not recorded.
+//
+// Each Range is given an id when it starts, which tags its events in the trace.
+// An operation is attributed to the callback that most recently started among the callbacks
+// still running. With a single goroutine, that is the callback the operation ran in.
+// Concurrent readers can each be in a Range, and their events interleave in the trace,
+// with reads from one goroutine possibly attributed to another goroutine's callback.
+// That does not change what a replay sees, because nothing may write to the Map
+// during concurrent Ranges.
+type Recorder struct {
+	mu      sync.Mutex
+	w       *trace.Writer
+	started bool
+	// lastRange is the id of the most recently started Range.
+	lastRange uint64
+	// active holds the Ranges that are running a callback, in the order the callbacks started.
+	active []*recordedRange
+}
+
+// recordedRange tracks a Range call in progress.
+type recordedRange struct {
+	id uint64
+	// n is the number of callbacks so far.
+	n uint64
+	// marked is one more than the index of the last callback we wrote OpRangeAt for, or 0.
+	marked  uint64
+	stopped bool
+}
+
+// NewRecorder returns a Recorder that writes a trace to w.
+// Call Flush once done to write any buffered data.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: trace.NewWriter(w)}
+}
+
+// Flush writes any buffered data, and returns the first error encountered while writing the trace.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Flush()
+}
+
+// Record returns an Option that records the operations on the Map with r.
+// Recording serializes operations, including Gets and Ranges from concurrent readers,
+// and is intended for debugging.
+// It cannot be combined with SingleWriter.
+func Record(r *Recorder) Option {
+	return func(m *Map) {
+		m.rec = r
+	}
+}
+
+// getRecorded is Get when recording.
+func (m *Map) getRecorded(k Key) (v Value, ok bool) {
+	v, ok = m.get(k)
+	m.rec.get(k, v, ok)
+	return v, ok
+}
+
+// start writes the header for m. It is called by New once m is ready to use.
+func (r *Recorder) start(m *Map) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started {
+		panic("swisstable: Recorder used with more than one Map")
+	}
+	r.started = true
+
+	mode := trace.HashCustom
+	switch reflect.ValueOf(m.hashFunc).Pointer() {
+	case reflect.ValueOf(hashUint64).Pointer():
+		mode = trace.HashRuntime
+	case reflect.ValueOf(portableHash).Pointer():
+		mode = trace.HashPortable
+	}
+	r.w.WriteHeader(trace.Header{Seed: uint64(m.seed), Hash: mode, TableSize: uint64(m.current.size())})
+}
+
+// event writes e. If a Range callback is running, e is preceded by OpRangeAt
+// if it is the first event in that callback. r.mu must be held.
+func (r *Recorder) event(e trace.Event) {
+	if len(r.active) > 0 {
+		rr := r.active[len(r.active)-1]
+		if rr.marked != rr.n {
+			r.w.WriteEvent(trace.Event{Op: trace.OpRangeAt, Range: rr.id, N: rr.n - 1})
+			rr.marked = rr.n
+		}
+	}
+	r.w.WriteEvent(e)
+}
+
+func (r *Recorder) get(k Key, v Value, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ok {
+		r.event(trace.Event{Op: trace.OpGetHit, Key: int64(k), Value: int64(v)})
+	} else {
+		r.event(trace.Event{Op: trace.OpGet, Key: int64(k)})
+	}
+}
+
+func (r *Recorder) set(k Key, v Value) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event(trace.Event{Op: trace.OpSet, Key: int64(k), Value: int64(v)})
+}
+
+func (r *Recorder) delete(k Key) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event(trace.Event{Op: trace.OpDelete, Key: int64(k)})
+}
+
+func (r *Recorder) free() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event(trace.Event{Op: trace.OpFree})
+}
+
+// rangeStart records the start of a Range with a new id. It returns a handle for rangeEnd,
+// and f wrapped to track its callbacks.
+func (r *Recorder) rangeStart(f func(key Key, value Value) bool) (*recordedRange, func(key Key, value Value) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastRange++
+	rr := &recordedRange{id: r.lastRange}
+	r.event(trace.Event{Op: trace.OpRangeStart, Range: rr.id})
+	return rr, func(key Key, value Value) (cont bool) {
+		r.mu.Lock()
+		rr.n++
+		r.active = append(r.active, rr)
+		r.mu.Unlock()
+		defer func() {
+			r.mu.Lock()
+			r.removeActive(rr)
+			rr.stopped = !cont
+			r.mu.Unlock()
+		}()
+		return f(key, value)
+	}
+}
+
+// removeActive removes rr from the running callbacks. r.mu must be held.
+func (r *Recorder) removeActive(rr *recordedRange) {
+	for i := len(r.active) - 1; i >= 0; i-- {
+		if r.active[i] == rr {
+			r.active = append(r.active[:i], r.active[i+1:]...)
+			return
+		}
+	}
+}
+
+// rangeEnd records the end of the Range started by the rangeStart that returned rr.
+func (r *Recorder) rangeEnd(rr *recordedRange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	op := trace.OpRangeEnd
+	if rr.stopped {
+		op = trace.OpRangeStop
+	}
+	r.event(trace.Event{Op: op, Range: rr.id, N: rr.n})
+}
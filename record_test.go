@@ -0,0 +1,248 @@
+package swisstable
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/thepudds/swisstable/internal/trace"
+)
+
+// readTrace decodes a recorded trace.
+func readTrace(t *testing.T, data []byte) (trace.Header, []trace.Event) {
+	t.Helper()
+	r := trace.NewReader(bytes.NewReader(data))
+	hdr, err := r.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	var events []trace.Event
+	for {
+		e, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return hdr, events
+		}
+		if err != nil {
+			t.Fatalf("Next() error: %v", err)
+		}
+		events = append(events, e)
+	}
+}
+
+func TestMap_Record(t *testing.T) {
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+	m := New(100, Record(rec), WithSeed(7), PortableHash())
+	for k := Key(1); k <= 3; k++ {
+		m.Set(k, Value(k*10))
+	}
+	m.Get(1)
+	m.Get(4)
+	m.Delete(2)
+	var i int
+	m.Range(func(k Key, v Value) bool {
+		switch i {
+		case 0:
+			// A nested Range, with no operations in its callbacks.
+			m.Range(func(k Key, v Value) bool { return true })
+		case 1:
+			m.Set(10, 100)
+			m.Get(10)
+		}
+		i++
+		return true
+	})
+	m.Range(func(k Key, v Value) bool {
+		m.Delete(k)
+		return false
+	})
+	m.Free()
+	m.Set(5, 50)
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("Recorder.Flush() error: %v", err)
+	}
+
+	hdr, events := readTrace(t, buf.Bytes())
+	wantHdr := trace.Header{Seed: 7, Hash: trace.HashPortable, TableSize: 128}
+	if hdr != wantHdr {
+		t.Errorf("header = %+v, want %+v", hdr, wantHdr)
+	}
+
+	// The key deleted by the last Range depends on the iteration order.
+	last := events[len(events)-4]
+	want := []trace.Event{
+		{Op: trace.OpSet, Key: 1, Value: 10},
+		{Op: trace.OpSet, Key: 2, Value: 20},
+		{Op: trace.OpSet, Key: 3, Value: 30},
+		{Op: trace.OpGetHit, Key: 1, Value: 10},
+		{Op: trace.OpGet, Key: 4},
+		{Op: trace.OpDelete, Key: 2},
+		{Op: trace.OpRangeStart, Range: 1},
+		{Op: trace.OpRangeAt, Range: 1, N: 0},
+		{Op: trace.OpRangeStart, Range: 2},
+		{Op: trace.OpRangeEnd, Range: 2, N: 2},
+		{Op: trace.OpRangeAt, Range: 1, N: 1},
+		{Op: trace.OpSet, Key: 10, Value: 100},
+		{Op: trace.OpGetHit, Key: 10, Value: 100},
+		{Op: trace.OpRangeEnd, Range: 1, N: uint64(i)},
+		{Op: trace.OpRangeStart, Range: 3},
+		{Op: trace.OpRangeAt, Range: 3, N: 0},
+		{Op: trace.OpDelete, Key: last.Key},
+		{Op: trace.OpRangeStop, Range: 3, N: 1},
+		{Op: trace.OpFree},
+		{Op: trace.OpSet, Key: 5, Value: 50},
+	}
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Errorf("recorded events mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestMap_RecordConcurrentRanges(t *testing.T) {
+	// Two readers are in a Range at the same time, and a third does a Get.
+	// The events are written as they happen, tagged with the id of their Range,
+	// and the Get is attributed to the callback that is still running.
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+	m := New(0, Record(rec))
+	for k := Key(0); k < 3; k++ {
+		m.Set(k, Value(k))
+	}
+	aInRange, bDone, release := make(chan bool), make(chan bool), make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		first := true
+		m.Range(func(k Key, v Value) bool {
+			if first {
+				first = false
+				close(aInRange)
+				<-release
+			}
+			m.Get(1000)
+			return true
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		<-aInRange
+		m.Range(func(k Key, v Value) bool {
+			m.Get(2000)
+			return true
+		})
+		close(bDone)
+	}()
+	<-bDone
+	m.Get(3000)
+	close(release)
+	wg.Wait()
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("Recorder.Flush() error: %v", err)
+	}
+
+	want := []trace.Event{
+		{Op: trace.OpSet, Key: 0, Value: 0},
+		{Op: trace.OpSet, Key: 1, Value: 1},
+		{Op: trace.OpSet, Key: 2, Value: 2},
+	}
+	// Range 2 runs while Range 1 is blocked in its first callback,
+	// so it is recorded as if it were nested in that callback.
+	want = append(want,
+		trace.Event{Op: trace.OpRangeStart, Range: 1},
+		trace.Event{Op: trace.OpRangeAt, Range: 1, N: 0},
+		trace.Event{Op: trace.OpRangeStart, Range: 2})
+	for i := uint64(0); i < 3; i++ {
+		want = append(want, trace.Event{Op: trace.OpRangeAt, Range: 2, N: i}, trace.Event{Op: trace.OpGet, Key: 2000})
+	}
+	want = append(want,
+		trace.Event{Op: trace.OpRangeEnd, Range: 2, N: 3},
+		trace.Event{Op: trace.OpGet, Key: 3000},
+		trace.Event{Op: trace.OpGet, Key: 1000})
+	for i := uint64(1); i < 3; i++ {
+		want = append(want, trace.Event{Op: trace.OpRangeAt, Range: 1, N: i}, trace.Event{Op: trace.OpGet, Key: 1000})
+	}
+	want = append(want, trace.Event{Op: trace.OpRangeEnd, Range: 1, N: 3})
+	_, events := readTrace(t, buf.Bytes())
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Errorf("recorded events mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestMap_RecordRangeDuringGrow(t *testing.T) {
+	// After a grow starts during a Range, Range looks up keys internally,
+	// which must not be recorded as Gets.
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+	m := New(0, Record(rec))
+	for k := Key(0); k < 10; k++ {
+		m.Set(k, Value(k))
+	}
+	var i int
+	m.Range(func(k Key, v Value) bool {
+		if i == 0 {
+			for k := Key(100); k < 200; k++ {
+				m.Set(k, Value(k))
+			}
+		}
+		i++
+		return true
+	})
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("Recorder.Flush() error: %v", err)
+	}
+	_, events := readTrace(t, buf.Bytes())
+	for _, e := range events {
+		if e.Op == trace.OpGet || e.Op == trace.OpGetHit {
+			t.Fatalf("recorded %v, but there were no calls to Get", e)
+		}
+	}
+	if m.resizeGenerations < 2 {
+		t.Errorf("resizeGenerations = %d, want at least 2", m.resizeGenerations)
+	}
+}
+
+func TestMap_RecordHashMode(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want trace.HashMode
+	}{
+		{"runtime", nil, trace.HashRuntime},
+		{"portable", []Option{PortableHash()}, trace.HashPortable},
+		{"custom", []Option{WithHashFunc(identityHash)}, trace.HashCustom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			rec := NewRecorder(&buf)
+			m := New(0, append(tt.opts, Record(rec))...)
+			if err := rec.Flush(); err != nil {
+				t.Fatalf("Recorder.Flush() error: %v", err)
+			}
+			hdr, _ := readTrace(t, buf.Bytes())
+			if hdr.Hash != tt.want || hdr.Seed != uint64(m.seed) || hdr.TableSize != 16 {
+				t.Errorf("header = %+v, want hash %v, seed %d, table size 16", hdr, tt.want, m.seed)
+			}
+		})
+	}
+}
+
+func TestRecord_Misuse(t *testing.T) {
+	rec := NewRecorder(io.Discard)
+	New(0, Record(rec))
+	assertPanics(t, "Recorder used with two maps", func() { New(0, Record(rec)) })
+	assertPanics(t, "Record with SingleWriter", func() { New(0, Record(NewRecorder(io.Discard)), SingleWriter()) })
+}
+
+func assertPanics(t *testing.T, name string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s: did not panic", name)
+		}
+	}()
+	f()
+}
@@ -0,0 +1,184 @@
+package swisstable
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Small maps.
+//
+// Most maps hold only a few entries. A map whose table is a single group (16 slots)
+// starts in small mode, where it does not hash keys at all. Each key is stored in any free
+// position of the group with the control byte smallStored, so a lookup is a single MatchByte
+// on the control bytes followed by comparing the keys of the stored positions,
+// with no probing and no growth machinery.
+//
+// A Delete sets the control byte back to EMPTY rather than DELETED, because there are no
+// probe chains to preserve. Keys do not move within the group, so Range works unchanged:
+// an iterator walks its snapshot of the group, and emits from the live table.
+//
+// When a Set would take the map past the resize threshold of a single group (13 entries),
+// the map is promoted: we rehash the small group into a new, regular table of
+// twice the size, and stay out of small mode from then on. This is done all at once
+// rather than incrementally because it moves at most 13 keys. An iterator that started before
+// the promotion continues over its snapshot of the small group, and looks up each key in the
+// live table, as it does after any grow.
+//
+// A single-group table is a valid regular table if each control byte is instead the key's h2,
+// because every key has group 0 as its natural group. Code that depends on the hashed
+// layout, such as MarshalBinary, uses layoutControl to get those control bytes.
+// Small mode is not used in single-writer mode, whose lock-free readers expect the hashed layout.
+
+// smallStored is the control byte of a stored position in small mode.
+const smallStored = 0b1000_0000
+
+// useSmall reports whether a new table of tableSize should start in small mode.
+func (m *Map) useSmall(tableSize int) bool {
+	return tableSize == 16 && !m.swmr
+}
+
+// getSmall is get in small mode.
+func (m *Map) getSmall(k Key) (v Value, ok bool) {
+	chunk := &m.current.chunks[0]
+	bitmask, _ := MatchByte(smallStored, chunk.groupControl(0))
+	for bitmask != 0 {
+		offset := bits.TrailingZeros32(bitmask)
+		kv := chunk.slot(uint64(offset))
+		if kv.Key == k {
+			return kv.Value, true
+		}
+		bitmask &^= 1 << offset
+	}
+	return zeroValue(), false
+}
+
+// setSmall is set in small mode. If the key is new and the group is at the resize threshold,
+// setSmall promotes the map and reports false, and the caller must continue with the regular set.
+func (m *Map) setSmall(k Key, v Value, elemIncr int) bool {
+	chunk := &m.current.chunks[0]
+	controlBytes := chunk.groupControl(0)
+	bitmask, _ := MatchByte(smallStored, controlBytes)
+	for bitmask != 0 {
+		offset := bits.TrailingZeros32(bitmask)
+		if chunk.slot(uint64(offset)).Key == k {
+			chunk.slot(uint64(offset)).Value = v
+			return true
+		}
+		bitmask &^= 1 << offset
+	}
+
+	if m.elemCount >= m.resizeThreshold {
+		// With disableResizing (used by some tests to fill tables), we keep the same size.
+		tableSize := 32
+		if m.disableResizing {
+			tableSize = 16
+		}
+		m.promote(tableSize)
+		return false
+	}
+	offset := bits.TrailingZeros32(matchEmpty(controlBytes))
+	*chunk.controlAt(uint64(offset)) = smallStored
+	*chunk.slot(uint64(offset)) = KV{Key: k, Value: v}
+	m.elemCount += elemIncr
+	return true
+}
+
+// deleteSmall is delete in small mode.
+func (m *Map) deleteSmall(k Key) {
+	chunk := &m.current.chunks[0]
+	bitmask, _ := MatchByte(smallStored, chunk.groupControl(0))
+	for bitmask != 0 {
+		offset := bits.TrailingZeros32(bitmask)
+		if chunk.slot(uint64(offset)).Key == k {
+			*chunk.controlAt(uint64(offset)) = emptySentinel
+			*chunk.slot(uint64(offset)) = KV{}
+			m.elemCount--
+			return
+		}
+		bitmask &^= 1 << offset
+	}
+}
+
+// promote leaves small mode, moving the key/values into a new regular table of tableSize.
+func (m *Map) promote(tableSize int) {
+	small := m.current
+	m.small = false
+	m.current = *newFixedTableIn(tableSize, m.mem)
+	m.resizeThreshold = (tableSize * 13) / 16
+	m.elemCount = 0
+	m.resizeGenerations++
+
+	controlBytes := small.groupControl(0)
+	for offset, c := range controlBytes {
+		if c == smallStored {
+			kv := small.slot(0, offset)
+			m.set(kv.Key, kv.Value, 1, false)
+		}
+	}
+	m.release(&small)
+}
+
+// layoutControl returns the control bytes of chunk ci of current as they would be in the
+// hashed layout. For a small map, this is a copy with the h2 of each stored key.
+func (m *Map) layoutControl(ci int) []byte {
+	control := m.current.chunkControl(ci)
+	if !m.small {
+		return control
+	}
+	hashed := make([]byte, len(control))
+	for i, c := range control {
+		if c == smallStored {
+			hashed[i] = m.current.h2(m.hashFunc(m.current.slot(0, i).Key, m.seed))
+		}
+	}
+	return hashed
+}
+
+// fromLayout converts current, which was loaded with the hashed layout, to small mode.
+// If it holds too many keys for small mode, it stays in the hashed layout.
+func (m *Map) fromLayout() {
+	if m.elemCount > m.resizeThreshold {
+		m.small = false
+		return
+	}
+	controlBytes := m.current.groupControl(0)
+	for offset, c := range controlBytes {
+		switch {
+		case isStored(c):
+			m.current.setControl(0, offset, smallStored)
+		case c == deletedSentinel:
+			m.current.setControl(0, offset, emptySentinel)
+			*m.current.slot(0, offset) = KV{}
+		}
+	}
+	m.current.deleteCount = 0
+}
+
+// checkSmall is CheckInvariants in small mode.
+func (m *Map) checkSmall() error {
+	if m.old != nil || m.current.groups() != 1 {
+		return fmt.Errorf("swisstable: small, but growing is %v with %d groups in current", m.old != nil, m.current.groups())
+	}
+	if m.current.deleteCount != 0 {
+		return fmt.Errorf("swisstable: small, but current deleteCount is %d", m.current.deleteCount)
+	}
+	stored := make(map[Key]int)
+	for offset, c := range m.current.groupControl(0) {
+		switch c {
+		case emptySentinel:
+		case smallStored:
+			k := m.current.slot(0, offset).Key
+			if prev, ok := stored[k]; ok {
+				return fmt.Errorf("swisstable: small map has key %d at offsets %d and %d", k, prev, offset)
+			}
+			stored[k] = offset
+		default:
+			return fmt.Errorf("swisstable: small map offset %d has invalid control byte %#x", offset, c)
+		}
+	}
+	if len(stored) != m.elemCount || m.elemCount > m.resizeThreshold {
+		return fmt.Errorf("swisstable: element count %d with resize threshold %d, but small map has %d stored slots",
+			m.elemCount, m.resizeThreshold, len(stored))
+	}
+	return nil
+}
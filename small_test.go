@@ -0,0 +1,278 @@
+package swisstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMap_SmallPromote(t *testing.T) {
+	m := New(0)
+	want := make(map[Key]Value)
+	for k := Key(0); k < 40; k++ {
+		if m.small != (len(want) <= 13) {
+			t.Fatalf("with %d keys, small = %v", len(want), m.small)
+		}
+		m.Set(k, Value(-k))
+		want[k] = Value(-k)
+		if err := m.CheckInvariants(); err != nil {
+			t.Fatalf("after Set(%d): %v", k, err)
+		}
+		if diff := cmp.Diff(want, contents(m)); diff != "" {
+			t.Fatalf("after Set(%d), contents mismatch (-want +got):\n%s", k, diff)
+		}
+	}
+	if m.current.size() != 64 {
+		t.Errorf("table size = %d, want 64", m.current.size())
+	}
+}
+
+func TestMap_SmallDelete(t *testing.T) {
+	// Deleting and re-inserting in a small map reuses positions, so it never
+	// needs tombstones or a promotion.
+	m := New(0)
+	for k := Key(0); k < 13; k++ {
+		m.Set(k, Value(k))
+	}
+	for k := Key(0); k < 1000; k++ {
+		m.Delete(k)
+		m.Set(k+13, Value(k))
+		if err := m.CheckInvariants(); err != nil {
+			t.Fatalf("after Delete(%d): %v", k, err)
+		}
+	}
+	if !m.small || m.Len() != 13 || m.resizeGenerations != 0 {
+		t.Errorf("small = %v, Len = %d, resizeGenerations = %d, want small, 13, 0", m.small, m.Len(), m.resizeGenerations)
+	}
+	for k := Key(1000); k < 1013; k++ {
+		if v, ok := m.Get(k); !ok || v != Value(k-13) {
+			t.Errorf("Get(%d) = %v, %v, want %v, true", k, v, ok, k-13)
+		}
+	}
+	if _, ok := m.Get(999); ok {
+		t.Errorf("Get(999) found a deleted key")
+	}
+}
+
+func TestMap_SmallPromoteDuringRange(t *testing.T) {
+	m := New(0, OffHeap())
+	defer m.Free()
+	for k := Key(0); k < 10; k++ {
+		m.Set(k, Value(k))
+	}
+	seen := make(map[Key]Value)
+	m.Range(func(k Key, v Value) bool {
+		if len(seen) == 0 {
+			// Promote the map, and update the keys that are still to come.
+			for j := Key(0); j < 10; j++ {
+				m.Set(j, Value(-j))
+			}
+			for j := Key(100); j < 200; j++ {
+				m.Set(j, Value(j))
+			}
+			m.Delete(k)
+		}
+		if _, ok := seen[k]; ok {
+			t.Fatalf("Range emitted %d twice", k)
+		}
+		seen[k] = v
+		return true
+	})
+	if m.small {
+		t.Fatal("map is still small")
+	}
+	for k := Key(0); k < 10; k++ {
+		v, ok := seen[k]
+		if !ok {
+			t.Errorf("Range did not emit %d", k)
+		} else if v != Value(k) && v != Value(-k) {
+			t.Errorf("Range emitted %d with value %d", k, v)
+		}
+	}
+}
+
+func TestMap_SmallBinary(t *testing.T) {
+	m := New(0, WithSeed(3))
+	for k := Key(0); k < 12; k++ {
+		m.Set(k, Value(k))
+	}
+	m.Delete(4)
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		m     *Map
+		small bool
+	}{
+		{"small", New(0), true},
+		{"single writer", New(0, SingleWriter()), false},
+		{"zero", &Map{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The layout must be valid for a hashed single-group table,
+			// which is what a SingleWriter Map loads.
+			if err := tt.m.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary() error: %v", err)
+			}
+			if tt.m.small != tt.small {
+				t.Errorf("small = %v, want %v", tt.m.small, tt.small)
+			}
+			if err := tt.m.CheckInvariants(); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(contents(m), contents(tt.m)); diff != "" {
+				t.Errorf("contents mismatch (-want +got):\n%s", diff)
+			}
+			for k := Key(0); k < 12; k++ {
+				if v, ok := tt.m.Get(k); ok != (k != 4) || (ok && v != Value(k)) {
+					t.Errorf("Get(%d) = %v, %v", k, v, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestMap_SmallFree(t *testing.T) {
+	// After Free, a small map acts like an empty zero Map.
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"heap", nil},
+		{"off-heap", []Option{OffHeap()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(0, tt.opts...)
+			for k := Key(0); k < 5; k++ {
+				m.Set(k, Value(k))
+			}
+			m.Free()
+			if v, ok := m.Get(1); ok {
+				t.Errorf("Map.Get(1) after Free = %v, true, want miss", v)
+			}
+			m.Delete(1)
+			if got := contents(m); len(got) != 0 || m.Len() != 0 {
+				t.Errorf("after Free, Range emitted %v and Len = %d", got, m.Len())
+			}
+			if err := m.CheckInvariants(); err != nil {
+				t.Fatal(err)
+			}
+
+			m.Set(7, 70)
+			if v, ok := m.Get(7); !ok || v != 70 || m.Len() != 1 {
+				t.Errorf("Map.Get(7) after Free and Set = %v, %v with Len %d, want 70, true with Len 1", v, ok, m.Len())
+			}
+			if err := m.CheckInvariants(); err != nil {
+				t.Fatal(err)
+			}
+			m.Free()
+		})
+	}
+}
+
+// smallSizes are the map sizes for the small map benchmarks.
+var smallSizes = []int{0, 1, 2, 4, 8, 12, 13, 16, 24, 32}
+
+func BenchmarkSmallFill_Swiss(b *testing.B) {
+	for _, n := range smallSizes {
+		b.Run(fmt.Sprintf("map size %d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m := New(0)
+				for k := Key(0); k < Key(n); k++ {
+					m.Set(k, Value(k))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSmallFill_Std(b *testing.B) {
+	for _, n := range smallSizes {
+		b.Run(fmt.Sprintf("map size %d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m := make(map[int64]int64)
+				for k := int64(0); k < int64(n); k++ {
+					m[k] = k
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSmallGetHit_Swiss(b *testing.B) {
+	for _, n := range smallSizes {
+		if n == 0 {
+			continue
+		}
+		b.Run(fmt.Sprintf("map size %d", n), func(b *testing.B) {
+			m := New(0)
+			for k := Key(0); k < Key(n); k++ {
+				m.Set(k, Value(k))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				v, ok := m.Get(Key(i % n))
+				sinkInt = int64(v)
+				sinkBool = ok
+			}
+		})
+	}
+}
+
+func BenchmarkSmallGetHit_Std(b *testing.B) {
+	for _, n := range smallSizes {
+		if n == 0 {
+			continue
+		}
+		b.Run(fmt.Sprintf("map size %d", n), func(b *testing.B) {
+			m := make(map[int64]int64)
+			for k := int64(0); k < int64(n); k++ {
+				m[k] = k
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sinkInt, sinkBool = m[int64(i%n)]
+			}
+		})
+	}
+}
+
+func BenchmarkSmallGetMiss_Swiss(b *testing.B) {
+	for _, n := range smallSizes {
+		b.Run(fmt.Sprintf("map size %d", n), func(b *testing.B) {
+			m := New(0)
+			for k := Key(0); k < Key(n); k++ {
+				m.Set(k, Value(k))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				v, ok := m.Get(Key(i&15 + 1<<40))
+				sinkInt = int64(v)
+				sinkBool = ok
+			}
+		})
+	}
+}
+
+func BenchmarkSmallGetMiss_Std(b *testing.B) {
+	for _, n := range smallSizes {
+		b.Run(fmt.Sprintf("map size %d", n), func(b *testing.B) {
+			m := make(map[int64]int64)
+			for k := int64(0); k < int64(n); k++ {
+				m[k] = k
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sinkInt, sinkBool = m[int64(i&15+1<<40)]
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package swisstable
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the internal state of a Map, intended to help
+// diagnose performance problems such as pathological key distributions.
+type Stats struct {
+	// Len is the number of live key/values.
+	Len int
+	// TableSize is the number of slots in the current table.
+	TableSize int
+	// LoadFactor is Len / TableSize.
+	LoadFactor float64
+	// DeleteCount is the number of DELETED tombstones in the current table.
+	DeleteCount int
+
+	// Growing reports whether an incremental grow is in progress.
+	Growing bool
+	// OldTableSize is the number of slots in the old table if Growing, and otherwise zero.
+	OldTableSize int
+	// GrowProgress is the fraction of groups in the old table that have been evacuated
+	// if Growing, and otherwise zero.
+	GrowProgress float64
+	// ResizeGenerations is the number of times the Map has started growing,
+	// including FloodRehashes.
+	ResizeGenerations int
+	// FloodRehashes is the number of times the Map has detected
+	// an unusually long probe chain and rehashed with a new hash function.
+	FloodRehashes int
+
+	// ProbeLengths is a histogram of probe chain lengths for the elements in the current table.
+	// ProbeLengths[i] is the count of elements that are stored i probes beyond their natural group.
+	// In a healthy table, nearly all elements are counted in ProbeLengths[0].
+	ProbeLengths []int
+
+	// CountersEnabled reports whether the counters below are being tracked,
+	// which requires building with -tags swisstablestats.
+	// Counting is not done by concurrent readers in single-writer mode.
+	CountersEnabled bool
+	// Gets is the number of calls to Get.
+	Gets int
+	// Lookups is the number of lookups in a table, including lookups done internally
+	// by Get, Delete, Range and while growing.
+	Lookups int
+	// ExtraGroups is the number of groups probed during lookups beyond the first group.
+	ExtraGroups int
+	// H2Matches is the number of slots examined during lookups because the h2 in the control byte matched.
+	H2Matches int
+	// H2FalsePositives is the number of H2Matches where the key did not match.
+	H2FalsePositives int
+	// H2FalsePositiveRate is H2FalsePositives / H2Matches.
+	H2FalsePositiveRate float64
+}
+
+// counter is a hot path counter reported by Stats. Because Get increments counters,
+// and Gets can run concurrently with each other, counters are updated atomically.
+type counter int64
+
+func (c *counter) inc() {
+	atomic.AddInt64((*int64)(c), 1)
+}
+
+func (c *counter) load() int {
+	return int(atomic.LoadInt64((*int64)(c)))
+}
+
+// Stats returns a snapshot of statistics about m.
+// It walks the entire table and rehashes every key, so it is intended for diagnostics
+// rather than frequent use. It counts as a read operation.
+func (m *Map) Stats() Stats {
+	s := Stats{
+		Len:               m.elemCount,
+		TableSize:         m.current.size(),
+		DeleteCount:       m.current.deleteCount,
+		Growing:           m.old != nil,
+		ResizeGenerations: m.resizeGenerations,
+		FloodRehashes:     m.floodRehashes,
+		CountersEnabled:   statsEnabled,
+		Gets:              m.gets.load(),
+		Lookups:           m.lookups.load(),
+		ExtraGroups:       m.getExtraGroups.load(),
+		H2Matches:         m.getH2Matches.load(),
+		H2FalsePositives:  m.getH2FalsePositives.load(),
+	}
+	if s.TableSize > 0 {
+		s.LoadFactor = float64(s.Len) / float64(s.TableSize)
+	}
+	if s.H2Matches > 0 {
+		s.H2FalsePositiveRate = float64(s.H2FalsePositives) / float64(s.H2Matches)
+	}
+
+	if m.old != nil {
+		s.OldTableSize = m.old.size()
+		oldGroups := int(m.old.groups())
+		// Count the evacuated bits, which are in every statusFlags word.
+		evacuated := 0
+		for i := int(statusEvacuated); i < len(m.growStatus); i += int(statusFlags) {
+			evacuated += bits.OnesCount64(m.growStatus[i])
+		}
+		s.GrowProgress = float64(evacuated) / float64(oldGroups)
+	}
+
+	for g := uint64(0); g < m.current.groups(); g++ {
+		for offset, b := range m.current.groupControl(g)[:16] {
+			if !isStored(b) {
+				continue
+			}
+			h := m.hashFunc(m.current.slot(g, offset).Key, m.seed)
+			n := m.current.probeLength(h, g)
+			for len(s.ProbeLengths) <= n {
+				s.ProbeLengths = append(s.ProbeLengths, 0)
+			}
+			s.ProbeLengths[n]++
+		}
+	}
+	return s
+}
+
+// probeLength returns the number of probes needed to reach group
+// when starting from the natural group for hash h.
+func (t *fixedTable) probeLength(h uint64, group uint64) int {
+	g := h & t.groupMask
+	var probeCount uint64
+	for g != group {
+		probeCount++
+		g = (g + probeCount) & t.groupMask
+		if probeCount > t.groupMask {
+			panic("impossible: group not in probe sequence")
+		}
+	}
+	return int(probeCount)
+}
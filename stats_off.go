@@ -0,0 +1,8 @@
+//go:build !swisstablestats
+// +build !swisstablestats
+
+package swisstable
+
+// statsEnabled controls whether the hot path counters reported by Stats are tracked.
+// Build with -tags swisstablestats to enable them.
+const statsEnabled = false
@@ -0,0 +1,7 @@
+//go:build swisstablestats
+// +build swisstablestats
+
+package swisstable
+
+// statsEnabled controls whether the hot path counters reported by Stats are tracked.
+const statsEnabled = true
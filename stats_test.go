@@ -0,0 +1,86 @@
+package swisstable
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMap_Stats(t *testing.T) {
+	m := New(16) // 32 slots, 2 groups
+	m.hashFunc = zeroHash
+	for k := Key(0); k < 20; k++ {
+		m.Set(k, Value(k))
+	}
+	m.Delete(0) // the first group is full, so this leaves a DELETED tombstone
+	for k := Key(0); k < 10; k++ {
+		m.Get(k)
+	}
+
+	got := m.Stats()
+	if got.Len != 19 || got.TableSize != 32 || got.DeleteCount != 1 || got.Growing {
+		t.Errorf("Map.Stats() = %+v, want Len 19, TableSize 32, DeleteCount 1, not Growing", got)
+	}
+	if got.LoadFactor != 19.0/32 {
+		t.Errorf("Map.Stats() LoadFactor = %v, want %v", got.LoadFactor, 19.0/32)
+	}
+	// With zeroHash, 15 remaining elements in the first group are in their natural group,
+	// and the 4 others are one probe away.
+	if diff := cmp.Diff([]int{15, 4}, got.ProbeLengths); diff != "" {
+		t.Errorf("Map.Stats() ProbeLengths mismatch (-want +got):\n%s", diff)
+	}
+
+	if got.CountersEnabled != statsEnabled {
+		t.Errorf("Map.Stats() CountersEnabled = %v, want %v", got.CountersEnabled, statsEnabled)
+	}
+	if statsEnabled {
+		if got.Gets != 10 {
+			t.Errorf("Map.Stats() Gets = %v, want 10", got.Gets)
+		}
+		if got.H2FalsePositives == 0 || got.H2FalsePositiveRate <= 0 || got.ExtraGroups == 0 {
+			t.Errorf("Map.Stats() = %+v, want non-zero H2FalsePositives and ExtraGroups with zeroHash", got)
+		}
+	} else if got.Gets != 0 || got.Lookups != 0 {
+		t.Errorf("Map.Stats() = %+v, want zero counters when not enabled", got)
+	}
+}
+
+func TestMap_StatsGrowing(t *testing.T) {
+	m := New(20_000) // 32768 slots, resize threshold of 26624
+	for k := Key(0); k < 26_625; k++ {
+		m.Set(k, Value(k))
+	}
+
+	got := m.Stats()
+	if !got.Growing || got.OldTableSize != 32768 || got.TableSize != 65536 || got.ResizeGenerations != 1 {
+		t.Errorf("Map.Stats() = %+v, want Growing from 32768 to 65536 slots", got)
+	}
+	if got.GrowProgress <= 0 || got.GrowProgress >= 1 {
+		t.Errorf("Map.Stats() GrowProgress = %v, want (0, 1)", got.GrowProgress)
+	}
+}
+
+func TestMap_StatsConcurrentGets(t *testing.T) {
+	// Concurrent Gets are allowed, so the counters must not race.
+	// Run with -race -tags swisstablestats.
+	m := New(0)
+	for k := Key(0); k < 100; k++ {
+		m.Set(k, Value(k))
+	}
+	const readers, gets = 4, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := Key(0); k < gets; k++ {
+				m.Get(k)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := m.Stats(); statsEnabled && got.Gets != readers*gets {
+		t.Errorf("Map.Stats() Gets = %d, want %d", got.Gets, readers*gets)
+	}
+}
@@ -0,0 +1,118 @@
+package swisstabletest
+
+import (
+	"testing"
+
+	"github.com/thepudds/fzgen/fuzzer"
+	"github.com/thepudds/swisstable"
+)
+
+// Chain uses data to build a Map with newMap and run a chain of Vmap operations on it,
+// with the count, sequence and arguments of the operations controlled by data.
+// After the chain completes, it checks the full contents of the Map against the mirror.
+// Any mismatch panics. Chain is intended to be called from a fuzz target:
+//
+//	func FuzzCache(f *testing.F) {
+//		f.Fuzz(func(t *testing.T, data []byte) {
+//			swisstabletest.Chain(t, data, func(capacity byte) swisstabletest.Map {
+//				return NewCache(int(capacity))
+//			})
+//		})
+//	}
+//
+// To turn a failing input into a regression test, see DecodeChain and cmd/swissrepro.
+func Chain(t *testing.T, data []byte, newMap func(capacity byte) Map) {
+	t.Helper()
+	target := runChain(data, newMap, nil)
+
+	// Final validation.
+	target.Check()
+}
+
+// runChain runs the chain encoded in data, and returns the Vmap it ran against.
+// If r is not nil, runChain records the capacity in r, and appends each operation
+// to r.Steps before running it, expanding bulk operations into individual steps.
+func runChain(data []byte, newMap func(capacity byte) Map, r *Repro) *Vmap {
+	var capacity byte
+	fz := fuzzer.NewFuzzer(data)
+	fz.Fill(&capacity)
+
+	target := New(newMap(capacity))
+	if r != nil {
+		r.Capacity = capacity
+	}
+	record := func(s Step) {
+		if r != nil {
+			r.Steps = append(r.Steps, s)
+		}
+	}
+	do := func(s Step) (swisstable.Value, bool) {
+		record(s)
+		return s.apply(target)
+	}
+
+	// The names and signatures of the steps determine how fzgen decodes data,
+	// so changing them changes the meaning of existing corpus entries.
+	steps := []fuzzer.Step{
+		{
+			Name: "Fuzz_ValidatingMap_Delete",
+			Func: func(k swisstable.Key) {
+				do(Step{OpType: DeleteOp, Key: k})
+			},
+		},
+		{
+			Name: "Fuzz_ValidatingMap_DeleteBulk",
+			Func: func(list Keys) {
+				for _, k := range keySlice(list) {
+					do(Step{OpType: DeleteOp, Key: k})
+				}
+			},
+		},
+		{
+			Name: "Fuzz_ValidatingMap_Get",
+			Func: func(k swisstable.Key) (swisstable.Value, bool) {
+				return do(Step{OpType: GetOp, Key: k})
+			},
+		},
+		{
+			Name: "Fuzz_ValidatingMap_GetBulk",
+			Func: func(list Keys) ([]swisstable.Value, []bool) {
+				for _, k := range keySlice(list) {
+					do(Step{OpType: GetOp, Key: k})
+				}
+				return nil, nil
+			},
+		},
+		{
+			Name: "Fuzz_ValidatingMap_Len",
+			Func: func() int {
+				record(Step{OpType: LenOp})
+				return target.Len()
+			},
+		},
+		{
+			Name: "Fuzz_ValidatingMap_Range",
+			Func: func(ops []Op) {
+				do(Step{OpType: RangeOp, Ops: expandOps(ops)})
+			},
+		},
+		{
+			Name: "Fuzz_ValidatingMap_Set",
+			Func: func(k swisstable.Key, v swisstable.Value) {
+				do(Step{OpType: SetOp, Key: k, Value: v})
+			},
+		},
+		{
+			Name: "Fuzz_ValidatingMap_SetBulk",
+			Func: func(list Keys) {
+				for _, k := range keySlice(list) {
+					do(Step{OpType: SetOp, Key: k, Value: swisstable.Value(k)})
+				}
+			},
+		},
+	}
+
+	// Execute a specific chain of steps, with the count, sequence and arguments controlled by fz.Chain
+	fz.Chain(steps)
+	return target
+}
@@ -0,0 +1,198 @@
+package swisstabletest
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/thepudds/swisstable"
+)
+
+// Step is a single operation on a Vmap, such as one operation of a chain decoded by DecodeChain.
+// Bulk operations are expanded into individual steps, which are easier to read and minimize.
+type Step struct {
+	// OpType is GetOp, SetOp, DeleteOp, LenOp or RangeOp.
+	OpType OpType
+
+	// used by GetOp, SetOp and DeleteOp
+	Key swisstable.Key
+
+	// used by SetOp
+	Value swisstable.Value
+
+	// used by RangeOp. Ops are sorted by RangeIndex, and contain no bulk ops or RangeOps.
+	Ops []Op
+}
+
+func (s Step) String() string {
+	switch s.OpType {
+	case GetOp:
+		return fmt.Sprintf("Get(%v)", s.Key)
+	case SetOp:
+		return fmt.Sprintf("Set(%v, %v)", s.Key, s.Value)
+	case DeleteOp:
+		return fmt.Sprintf("Delete(%v)", s.Key)
+	case LenOp:
+		return "Len()"
+	case RangeOp:
+		return fmt.Sprintf("Range(%v)", s.Ops)
+	default:
+		return fmt.Sprintf("{Op: unknown %v}", s.OpType)
+	}
+}
+
+// Apply applies s to vm.
+func (s Step) Apply(vm *Vmap) {
+	s.apply(vm)
+}
+
+// apply applies s to vm, and returns the result of a GetOp.
+func (s Step) apply(vm *Vmap) (swisstable.Value, bool) {
+	switch s.OpType {
+	case GetOp:
+		return vm.Get(s.Key)
+	case SetOp:
+		vm.Set(s.Key, s.Value)
+	case DeleteOp:
+		vm.Delete(s.Key)
+	case LenOp:
+		vm.Len()
+	case RangeOp:
+		// Range sorts and fixes up its ops in place.
+		vm.Range(append([]Op(nil), s.Ops...))
+	default:
+		panic("unexpected OpType")
+	}
+	return 0, false
+}
+
+// expandOps returns ops as Range would apply them, with the RangeIndex fixups and
+// sorting done by Range, bulk ops expanded into individual ops, and ignored ops dropped.
+func expandOps(ops []Op) []Op {
+	sorted := append([]Op(nil), ops...)
+	for i := range sorted {
+		if sorted[i].RangeIndex > MaxRangeIndex {
+			sorted[i].RangeIndex = 0
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].RangeIndex < sorted[j].RangeIndex
+	})
+
+	var res []Op
+	for _, op := range sorted {
+		t := op.OpType % OpTypeCount
+		switch t {
+		case GetOp, SetOp, DeleteOp:
+			res = append(res, Op{OpType: t, Key: op.Key, RangeIndex: op.RangeIndex})
+		case LenOp:
+			res = append(res, Op{OpType: t, RangeIndex: op.RangeIndex})
+		case RangeOp:
+			// Ignored by Range.
+		default:
+			for _, k := range keySlice(op.Keys) {
+				res = append(res, Op{OpType: t - BulkGetOp + GetOp, Key: k, RangeIndex: op.RangeIndex})
+			}
+		}
+	}
+	return res
+}
+
+// Repro is a sequence of steps that reproduces a failure, such as a chain decoded from
+// a fuzzing input by DecodeChain.
+type Repro struct {
+	// Capacity is passed to newMap to create the Map under test.
+	Capacity byte
+	Steps    []Step
+	// Failure is the panic value from the failing step or the final Check,
+	// or nil if the steps did not fail.
+	Failure interface{}
+}
+
+// DecodeChain decodes the chain of operations that Chain would run for data,
+// and runs it against a Map from newMap. If a step or the final Check panics,
+// Failure holds the panic value, and the failing step is the last of Steps.
+func DecodeChain(data []byte, newMap func(capacity byte) Map) *Repro {
+	r := &Repro{}
+	r.Failure = catch(func() {
+		runChain(data, newMap, r).Check()
+	})
+	return r
+}
+
+// Run runs the steps against a new Vmap wrapping a Map from newMap, followed by Check,
+// and returns the panic value if any of them fail.
+func (r *Repro) Run(newMap func(capacity byte) Map) (failure interface{}) {
+	return catch(func() {
+		vm := New(newMap(r.Capacity))
+		for _, s := range r.Steps {
+			s.Apply(vm)
+		}
+		vm.Check()
+	})
+}
+
+// Minimize removes steps, and operations within Range steps, while the steps still fail,
+// and then tries a capacity of 0. It updates Failure to the failure from the minimized steps,
+// which might differ from the original failure if the removals uncovered a different failure.
+// Minimize does nothing if the steps do not fail.
+func (r *Repro) Minimize(newMap func(capacity byte) Map) {
+	try := func(c Repro) bool {
+		failure := c.Run(newMap)
+		if failure == nil {
+			return false
+		}
+		c.Failure = failure
+		*r = c
+		return true
+	}
+	if !try(*r) {
+		return
+	}
+
+	for changed := true; changed; {
+		changed = false
+
+		// Remove runs of steps, from all of them down to single steps.
+		for n := len(r.Steps); n >= 1; n /= 2 {
+			for i := 0; i+n <= len(r.Steps); {
+				c := *r
+				c.Steps = append(append([]Step(nil), r.Steps[:i]...), r.Steps[i+n:]...)
+				if try(c) {
+					changed = true
+				} else {
+					i += n
+				}
+			}
+		}
+
+		// Remove operations within each Range.
+		for i := range r.Steps {
+			for j := 0; j < len(r.Steps[i].Ops); {
+				c := *r
+				c.Steps = append([]Step(nil), r.Steps...)
+				ops := r.Steps[i].Ops
+				c.Steps[i].Ops = append(append([]Op(nil), ops[:j]...), ops[j+1:]...)
+				if try(c) {
+					changed = true
+				} else {
+					j++
+				}
+			}
+		}
+	}
+
+	if r.Capacity != 0 {
+		c := *r
+		c.Capacity = 0
+		try(c)
+	}
+}
+
+// catch calls f, and returns the value of any panic.
+func catch(f func()) (failure interface{}) {
+	defer func() {
+		failure = recover()
+	}()
+	f()
+	return nil
+}
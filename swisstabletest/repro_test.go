@@ -0,0 +1,102 @@
+package swisstabletest
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/thepudds/swisstable"
+)
+
+func newTestVmap(capacity byte) Map {
+	return NewVmap(capacity, nil).Map()
+}
+
+func newLossyMap(capacity byte) Map {
+	return lossyMap{swisstable.New(int(capacity))}
+}
+
+// randomData returns fuzzing inputs of varying lengths.
+func randomData(n int) [][]byte {
+	rng := rand.New(rand.NewSource(1))
+	var res [][]byte
+	for i := 0; i < n; i++ {
+		data := make([]byte, rng.Intn(400))
+		rng.Read(data)
+		res = append(res, data)
+	}
+	return res
+}
+
+func TestDecodeChain(t *testing.T) {
+	var steps, ranges int
+	for i, data := range randomData(500) {
+		r := DecodeChain(data, newTestVmap)
+		if r.Failure != nil {
+			t.Fatalf("DecodeChain for input %d failed: %v", i, r.Failure)
+		}
+		// The decoded steps must do what Chain did, so replaying them must also pass.
+		if failure := r.Run(newTestVmap); failure != nil {
+			t.Fatalf("Run for input %d failed: %v", i, failure)
+		}
+		for _, s := range r.Steps {
+			steps++
+			if s.OpType != RangeOp {
+				continue
+			}
+			ranges++
+			for j, op := range s.Ops {
+				if op.OpType > LenOp || op.OpType == RangeOp {
+					t.Fatalf("DecodeChain for input %d: Range step has op %v", i, op)
+				}
+				if j > 0 && op.RangeIndex < s.Ops[j-1].RangeIndex {
+					t.Fatalf("DecodeChain for input %d: Range step ops not sorted: %v", i, s.Ops)
+				}
+			}
+		}
+	}
+	if steps == 0 || ranges == 0 {
+		t.Errorf("decoded %d steps with %d Ranges, want some of each", steps, ranges)
+	}
+}
+
+func TestRepro_Minimize(t *testing.T) {
+	var found int
+	for i, data := range randomData(500) {
+		r := DecodeChain(data, newLossyMap)
+		if r.Failure == nil {
+			continue
+		}
+		found++
+		if failure := r.Run(newLossyMap); failure == nil {
+			t.Fatalf("DecodeChain for input %d failed with %v, but Run passed", i, r.Failure)
+		}
+
+		r.Minimize(newLossyMap)
+		if r.Failure == nil || r.Run(newLossyMap) == nil {
+			t.Fatalf("minimized steps for input %d do not fail: %v", i, r.Steps)
+		}
+		// lossyMap drops a Set of a multiple of 7, which is detected by the Set itself,
+		// or by a Set inside a Range, which also needs a key for the Range to reach.
+		last := r.Steps[len(r.Steps)-1]
+		if last.OpType == RangeOp && len(last.Ops) == 1 {
+			last = Step{OpType: last.Ops[0].OpType, Key: last.Ops[0].Key}
+		}
+		if len(r.Steps) > 2 || last.OpType != SetOp || last.Key%7 != 0 {
+			t.Errorf("minimized steps for input %d = %v, want a Set of a multiple of 7", i, r.Steps)
+		}
+		if r.Capacity != 0 {
+			t.Errorf("minimized capacity for input %d = %d, want 0", i, r.Capacity)
+		}
+	}
+	if found == 0 {
+		t.Fatal("no failing inputs found")
+	}
+}
+
+func TestRepro_MinimizePassing(t *testing.T) {
+	r := &Repro{Capacity: 10, Steps: []Step{{OpType: SetOp, Key: 1, Value: 1}, {OpType: GetOp, Key: 1}}}
+	r.Minimize(newTestVmap)
+	if len(r.Steps) != 2 || r.Capacity != 10 || r.Failure != nil {
+		t.Errorf("Minimize changed passing steps to %+v", r)
+	}
+}
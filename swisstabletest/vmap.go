@@ -0,0 +1,428 @@
+// Package swisstabletest implements support for testing swisstable.Map
+// and types built on top of it, such as caches or sharded maps.
+//
+// Vmap is a self validating map. It wraps a Map and repeats each operation
+// against a mirrored runtime map, and panics if the results differ. This includes
+// during iteration, where it validates whether or not a key is allowed to be seen
+// zero times, exactly once, or multiple times due to adds and deletes during the iteration.
+//
+// It is intended to work well with fuzzing. See Chain.
+package swisstabletest
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/thepudds/swisstable"
+)
+
+// Map is the set of operations Vmap validates.
+// *swisstable.Map implements Map, and wrappers around it can too.
+// If a Map also has a CheckInvariants() error method, Vmap calls it after each operation
+// and panics if it returns an error.
+type Map interface {
+	Get(k swisstable.Key) (v swisstable.Value, ok bool)
+	Set(k swisstable.Key, v swisstable.Value)
+	Delete(k swisstable.Key)
+	Len() int
+	Range(f func(key swisstable.Key, value swisstable.Value) bool)
+}
+
+// invariantChecker is implemented by *swisstable.Map, and can be implemented by wrappers.
+// If the Map under test implements it, Vmap calls CheckInvariants after each operation.
+type invariantChecker interface {
+	CheckInvariants() error
+}
+
+type OpType byte
+
+const (
+	GetOp OpType = iota
+	SetOp
+	DeleteOp
+	LenOp
+	RangeOp
+
+	BulkGetOp // must be first bulk op, after non-bulk ops
+	BulkSetOp
+	BulkDeleteOp
+
+	OpTypeCount
+)
+
+// Op is an operation to apply during a Range. OpType is taken modulo OpTypeCount,
+// so that any value from a fuzzer is a valid operation.
+type Op struct {
+	OpType OpType
+
+	// used only if Op is not bulk Op
+	Key swisstable.Key
+
+	// used only if Op is bulk op
+	Keys Keys
+
+	// used during a Range to specify when to do this op,
+	// not used if this Op is not used in a Range.
+	// Range treats a RangeIndex above MaxRangeIndex as 0.
+	RangeIndex uint16
+}
+
+// MaxRangeIndex is the largest RangeIndex that Vmap.Range uses as is.
+// Larger values are treated as 0, so that more of the ops from a fuzzer
+// run during the iteration rather than after it ends.
+const MaxRangeIndex = 5001
+
+func (o Op) String() string {
+	t := o.OpType % OpTypeCount
+	switch {
+	case t < BulkGetOp:
+		return fmt.Sprintf("{Op: %v Key: %v}", t, o.Key)
+	case t < OpTypeCount:
+		return fmt.Sprintf("{Op: %v Keys: %v RangeIndex: %v}", t, o.Keys, o.RangeIndex)
+	default:
+		return fmt.Sprintf("{Op: unknown %v}", o.OpType)
+	}
+}
+
+// Keys is a compact list of keys for bulk operations.
+type Keys struct {
+	Start, End, Stride uint8 // [Start, End) - start inclusive, end exclusive
+}
+
+// Vmap is a self-validating wrapper around a Map.
+type Vmap struct {
+	// Map under test
+	m Map
+
+	// repeat any operations on our Map to a mirrored runtime map
+	mirror map[swisstable.Key]swisstable.Value
+}
+
+// New returns a Vmap that validates m. The mirror starts with the current contents of m.
+func New(m Map) *Vmap {
+	vm := &Vmap{m: m, mirror: make(map[swisstable.Key]swisstable.Value)}
+	m.Range(func(k swisstable.Key, v swisstable.Value) bool {
+		vm.mirror[k] = v
+		return true
+	})
+	return vm
+}
+
+// NewVmap returns a Vmap that validates a new swisstable.Map with the given capacity,
+// holding the keys in start. The Map uses a fixed seed and IdentityHash to make
+// failures more reproducible, and also lumpier with a worse hash.
+func NewVmap(capacity byte, start []swisstable.Key) *Vmap {
+	m := swisstable.New(int(capacity), swisstable.WithSeed(42), swisstable.WithHashFunc(IdentityHash))
+	vm := New(m)
+	for _, k := range start {
+		vm.Set(k, swisstable.Value(k))
+	}
+	return vm
+}
+
+// IdentityHash is a weak hash function that returns the key.
+// It is useful with swisstable.WithHashFunc to make the placement of keys predictable.
+func IdentityHash(k swisstable.Key, seed uintptr) uint64 {
+	return uint64(k)
+}
+
+// Map returns the Map under test.
+func (vm *Vmap) Map() Map {
+	return vm.m
+}
+
+// Mirror returns the runtime map that mirrors the expected contents of the Map.
+// It must not be modified.
+func (vm *Vmap) Mirror() map[swisstable.Key]swisstable.Value {
+	return vm.mirror
+}
+
+// Get returns the result of Get on the Map under test, after validating it against the mirror.
+func (vm *Vmap) Get(k swisstable.Key) (v swisstable.Value, ok bool) {
+	// TODO: consolidate or remove the debugVmap printlns
+	if debugVmap {
+		println("Get key:", k)
+	}
+	got, gotOk := vm.m.Get(k)
+	want, wantOk := vm.mirror[k]
+	if want != got || gotOk != wantOk {
+		panic(fmt.Sprintf("Map.Get(%v) = %v, %v. want = %v, %v", k, got, gotOk, want, wantOk))
+	}
+	vm.checkInvariants("Get", k)
+	return got, gotOk
+}
+
+func (vm *Vmap) Set(k swisstable.Key, v swisstable.Value) {
+	// TODO: could validate presence/absence vs. mirror in Set and Delete,
+	// but eventually Get hopefully will evacuate, so probably better not to call here.
+	if debugVmap {
+		println("Set key:", k)
+	}
+	vm.m.Set(k, v)
+	vm.mirror[k] = v
+	vm.checkInvariants("Set", k)
+}
+
+func (vm *Vmap) Delete(k swisstable.Key) {
+	if debugVmap {
+		println("Delete key:", k)
+	}
+	vm.m.Delete(k)
+	delete(vm.mirror, k)
+	vm.checkInvariants("Delete", k)
+}
+
+// checkInvariants calls CheckInvariants if the Map under test has it, and panics if it fails.
+func (vm *Vmap) checkInvariants(op string, k swisstable.Key) {
+	if c, ok := vm.m.(invariantChecker); ok {
+		if err := c.CheckInvariants(); err != nil {
+			panic(fmt.Sprintf("Map.CheckInvariants() after %s(%v): %v", op, k, err))
+		}
+	}
+}
+
+func (vm *Vmap) Len() int {
+	got := vm.m.Len()
+	want := len(vm.mirror)
+	if want != got {
+		panic(fmt.Sprintf("Map.Len() = %v, want %v", got, want))
+	}
+
+	return vm.m.Len()
+}
+
+// Check validates the full contents of the Map against the mirror, using Range.
+func (vm *Vmap) Check() {
+	got := make(map[swisstable.Key]swisstable.Value)
+	vm.m.Range(func(k swisstable.Key, v swisstable.Value) bool {
+		if _, ok := got[k]; ok {
+			panic(fmt.Sprintf("Map.Range() key %v seen twice", k))
+		}
+		got[k] = v
+		return true
+	})
+	for k, want := range vm.mirror {
+		v, ok := got[k]
+		if !ok || v != want {
+			panic(fmt.Sprintf("Map.Range() key %v = %v, %v, want %v, true", k, v, ok, want))
+		}
+	}
+	if len(got) != len(vm.mirror) {
+		panic(fmt.Sprintf("Map.Range() saw %d keys, want %d", len(got), len(vm.mirror)))
+	}
+	vm.Len()
+}
+
+// Bulk operations
+
+func (vm *Vmap) GetBulk(list Keys) (values []swisstable.Value, oks []bool) {
+	for _, key := range keySlice(list) {
+		vm.Get(key)
+	}
+	return nil, nil
+}
+
+func (vm *Vmap) SetBulk(list Keys) {
+	for _, key := range keySlice(list) {
+		vm.Set(key, swisstable.Value(key))
+	}
+}
+
+func (vm *Vmap) DeleteBulk(list Keys) {
+	for _, key := range keySlice(list) {
+		vm.Delete(key)
+	}
+}
+
+// Range iterates over the Map, applying each op once the iteration reaches its RangeIndex.
+func (vm *Vmap) Range(ops []Op) {
+	// we fix up RangeIndex to make the values useful more often
+	for i := range ops {
+		if ops[i].RangeIndex > MaxRangeIndex {
+			ops[i].RangeIndex = 0
+		}
+	}
+
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].RangeIndex < ops[j].RangeIndex
+	})
+
+	// Create somes sets to dynamically track validity of keys that appear in a range.
+	// allowed tracks start + added - deleted; these keys allowed but not required.
+	allowed := newKeySet()
+	// mustSee tracks start - deleted; these are keys we are required to see at some point.
+	mustSee := newKeySet()
+	// add the starting keys
+	for k := range vm.mirror {
+		allowed.add(k)
+		mustSee.add(k)
+	}
+
+	// seen is used to verify no unexpected dups, and at end, to verify mustSee.
+	seen := newKeySet()
+
+	// Also dynamically track if key X is added, deleted, and then re-added during iteration,
+	// which means it is legal per Go spec to be seen again in the iteration.
+	// Example with stdlib map repeating keys during iter: https://go.dev/play/p/RN-v8rmQmeE
+	deleted := newKeySet()
+	addedAfterDeleted := newKeySet()
+
+	trackSet := func(k swisstable.Key) {
+		// update our trackers for a Set op during the range.
+		allowed.add(k)
+		if deleted.contains(k) {
+			addedAfterDeleted.add(k)
+			deleted.remove(k)
+		}
+	}
+
+	trackDelete := func(k swisstable.Key) {
+		// update our trackers for a Delete op during the range.
+		allowed.remove(k)
+		mustSee.remove(k) // we are no longer required to see this. Fine if we saw it earlier.
+		deleted.add(k)
+		if addedAfterDeleted.contains(k) {
+			addedAfterDeleted.remove(k)
+		}
+	}
+
+	var rangeIndex uint16
+	vm.m.Range(func(key swisstable.Key, value swisstable.Value) bool {
+		if !allowed.contains(key) {
+			panic(fmt.Sprintf("Map.Range() unexpected key %v", key))
+		}
+		if seen.contains(key) && !addedAfterDeleted.contains(key) {
+			panic(fmt.Sprintf("Map.Range() key %v seen twice", key))
+		}
+		seen.add(key)
+
+		for len(ops) > 0 {
+			op := ops[0]
+			if op.RangeIndex != rangeIndex {
+				break
+			}
+
+			switch op.OpType % OpTypeCount {
+			case GetOp:
+				if debugVmap {
+					println("range case GetOp key:", op.Key)
+				}
+				vm.Get(op.Key)
+			case SetOp:
+				if debugVmap {
+					println("range case SetOp key:", op.Key)
+				}
+				vm.Set(op.Key, swisstable.Value(op.Key))
+				trackSet(op.Key)
+			case DeleteOp:
+				if debugVmap {
+					println("range case DeleteOp key:", op.Key)
+				}
+				vm.Delete(op.Key)
+				trackDelete(op.Key)
+			case LenOp:
+				vm.Len()
+			case RangeOp:
+				// Ignore.
+				// We could allow this, but naive approach might allow O(n^2) or worse behavior
+			case BulkGetOp:
+				for _, key := range keySlice(op.Keys) {
+					if debugVmap {
+						println("range case BulkGetOp key:", key)
+					}
+					vm.Get(key)
+				}
+			case BulkSetOp:
+				for _, key := range keySlice(op.Keys) {
+					if debugVmap {
+						println("range case BulkSetOp key:", key)
+					}
+					vm.Set(key, swisstable.Value(key))
+					trackSet(key)
+				}
+			case BulkDeleteOp:
+				for _, key := range keySlice(op.Keys) {
+					if debugVmap {
+						println("range case BulkDeleteOp key:", key)
+					}
+					vm.Delete(key)
+					trackDelete(key)
+				}
+			default:
+				panic("unexpected OpType")
+			}
+
+			ops = ops[1:]
+		}
+		rangeIndex++
+		return true // keep iterating
+	})
+
+	for _, key := range mustSee.elems() {
+		if !seen.contains(key) {
+			panic(fmt.Sprintf("Map.Range() expected key %v not seen", key))
+		}
+	}
+}
+
+// keySlice converts from start/end/stride to a []Key
+func keySlice(list Keys) []swisstable.Key {
+	// we fix up start/end to make the values useful more often
+	start, end := int(list.Start), int(list.End)
+	switch {
+	case start > end:
+		start, end = end, start
+	case start == end:
+		return nil
+	}
+
+	var stride int
+	switch {
+	case list.Stride < 128:
+		// prefer stride of 1
+		stride = 1
+	default:
+		stride = int(list.Stride%8) + 1
+	}
+
+	var res []swisstable.Key
+	for i := start; i < end; i += stride {
+		res = append(res, swisstable.Key(i))
+	}
+	return res
+}
+
+const debugVmap = false
+
+// keySet is a simple set to aid with validation
+type keySet struct {
+	m map[swisstable.Key]struct{}
+}
+
+func newKeySet() *keySet {
+	return &keySet{m: make(map[swisstable.Key]struct{})}
+}
+
+func (s *keySet) add(k swisstable.Key) {
+	s.m[k] = struct{}{}
+}
+
+func (s *keySet) remove(k swisstable.Key) {
+	delete(s.m, k)
+}
+
+func (s *keySet) contains(k swisstable.Key) bool {
+	_, ok := s.m[k]
+	return ok
+}
+
+func (s *keySet) elems() []swisstable.Key {
+	var keys []swisstable.Key
+	for key := range s.m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	return keys
+}
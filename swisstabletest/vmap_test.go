@@ -0,0 +1,184 @@
+package swisstabletest
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/thepudds/swisstable"
+	"github.com/thepudds/swisstable/internal/keydist"
+)
+
+func Fuzz_NewVmap_Chain(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Chain(t, data, func(capacity byte) Map {
+			return NewVmap(capacity, nil).Map()
+		})
+	})
+}
+
+func TestValidatingMap_Range(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []Op
+	}{
+		{
+			name: "",
+			ops: []Op{
+				{
+					OpType:     GetOp,
+					Key:        1,
+					Keys:       Keys{},
+					RangeIndex: 0,
+				},
+				{
+					OpType:     GetOp,
+					Key:        2,
+					Keys:       Keys{},
+					RangeIndex: 0,
+				},
+				{
+					OpType:     SetOp,
+					Key:        3,
+					Keys:       Keys{},
+					RangeIndex: 2, // should happen last
+				},
+				{
+					OpType:     55,
+					Key:        4,
+					Keys:       Keys{},
+					RangeIndex: 0,
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Logf("ops: %v", tt.ops)
+			vm := NewVmap(100, []swisstable.Key{100, 101, 102})
+			vm.Range(tt.ops)
+			vm.Check()
+		})
+	}
+}
+
+// TestVmap_KeyDists runs a Vmap with keys from several distributions,
+// including keys that collide on h1 or h2 with the IdentityHash used by NewVmap.
+func TestVmap_KeyDists(t *testing.T) {
+	identity := func(k int64) uint64 { return IdentityHash(swisstable.Key(k), 0) }
+	dists := []keydist.Dist{
+		keydist.Sequential(0, 1),
+		keydist.Sequential(0, 1<<20),
+		keydist.Uniform(),
+		keydist.Clustered(20),
+		// The same group in tables with up to 64 groups.
+		keydist.Colliding("collidingH1", identity, 63),
+		// The same h2 in tables with 16 groups.
+		keydist.Colliding("collidingH2", identity, 0x7f<<4),
+	}
+	for _, dist := range dists {
+		t.Run(dist.Name, func(t *testing.T) {
+			var keys []swisstable.Key
+			for _, k := range dist.Keys(600, 1) {
+				keys = append(keys, swisstable.Key(k))
+			}
+			start, added := keys[:400], keys[400:]
+			vm := NewVmap(0, start)
+
+			// While iterating, delete some of the starting keys and add the rest.
+			var ops []Op
+			for i, k := range added {
+				ops = append(ops, Op{OpType: DeleteOp, Key: start[i], RangeIndex: uint16(i)})
+				ops = append(ops, Op{OpType: SetOp, Key: k, RangeIndex: uint16(i)})
+			}
+			vm.Range(ops)
+
+			for _, k := range keys {
+				vm.Get(k)
+			}
+			if vm.Len() != len(keys)-len(added) {
+				t.Errorf("Vmap.Len() = %d, want %d", vm.Len(), len(keys)-len(added))
+			}
+			vm.Check()
+		})
+	}
+}
+
+// lockedMap is an example of a wrapper around swisstable.Map.
+type lockedMap struct {
+	mu sync.Mutex
+	m  *swisstable.Map
+}
+
+func (l *lockedMap) Get(k swisstable.Key) (swisstable.Value, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.m.Get(k)
+}
+
+func (l *lockedMap) Set(k swisstable.Key, v swisstable.Value) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.m.Set(k, v)
+}
+
+func (l *lockedMap) Delete(k swisstable.Key) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.m.Delete(k)
+}
+
+func (l *lockedMap) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.m.Len()
+}
+
+// Range does not hold the lock while calling f, so that f can modify the map.
+func (l *lockedMap) Range(f func(key swisstable.Key, value swisstable.Value) bool) {
+	l.m.Range(f)
+}
+
+// lossyMap is a wrapper with a bug: it drops Sets of keys that are multiples of 7.
+type lossyMap struct {
+	*swisstable.Map
+}
+
+func (l lossyMap) Set(k swisstable.Key, v swisstable.Value) {
+	if k%7 != 0 {
+		l.Map.Set(k, v)
+	}
+}
+
+func TestVmap_Wrapper(t *testing.T) {
+	m := swisstable.New(0)
+	for k := swisstable.Key(0); k < 50; k++ {
+		m.Set(k, swisstable.Value(k))
+	}
+	vm := New(&lockedMap{m: m})
+	if vm.Len() != 50 {
+		t.Errorf("Vmap.Len() = %d, want 50", vm.Len())
+	}
+	vm.SetBulk(Keys{Start: 40, End: 200})
+	vm.Range([]Op{
+		{OpType: BulkDeleteOp, Keys: Keys{Start: 0, End: 100, Stride: 130}, RangeIndex: 10},
+		{OpType: BulkSetOp, Keys: Keys{Start: 200, End: 255}, RangeIndex: 20},
+	})
+	vm.GetBulk(Keys{Start: 0, End: 255})
+	vm.Check()
+}
+
+func TestVmap_WrapperBug(t *testing.T) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("Vmap did not detect lossyMap dropping a Set")
+		}
+		if msg, _ := r.(string); !strings.Contains(msg, "Map.Get(7)") {
+			t.Errorf("Vmap panic = %v, want Map.Get(7) mismatch", r)
+		}
+	}()
+	vm := New(lossyMap{swisstable.New(0)})
+	vm.SetBulk(Keys{Start: 1, End: 10})
+	vm.GetBulk(Keys{Start: 1, End: 10})
+}
@@ -0,0 +1,218 @@
+package swisstable
+
+import (
+	"math/bits"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Single-writer, multi-reader (SWMR) mode.
+//
+// In SWMR mode, one goroutine (the writer) may call Set, Delete, Range and Len
+// while any number of other goroutines (readers) concurrently call Get, without locks.
+//
+// The writer brackets each write operation by incrementing a sequence counter,
+// which is odd while a write is in progress (a seqlock). A reader records the counter,
+// does a lookup, and then checks the counter again. If the counter was odd or changed,
+// the reader might have observed a torn state and it retries.
+//
+// To make sure a reader never follows a torn slice header, the writer publishes an
+// immutable swmrView of the tables via an atomic pointer whenever the tables
+// change (when the map is created, and when growth starts or finishes).
+// The immutable old table during growth means most of a view stays stable
+// for the duration of a grow.
+//
+// Within the tables, slots and growth status bytes are written by the writer with atomic stores
+// and read by readers with atomic loads. Control bytes are written with plain stores
+// and read by readers only via MatchByte. A torn read of any of these is caught
+// by the sequence counter check.
+// TODO: consider per-group version counters so that readers only retry
+// if the groups they examined were modified.
+
+// SingleWriter returns an Option that enables single-writer, multi-reader mode.
+// In this mode, Get may be called concurrently from any number of goroutines
+// while a single goroutine calls Set, Delete, Range and Len.
+func SingleWriter() Option {
+	return func(m *Map) {
+		m.swmr = true
+	}
+}
+
+// swmrView is an immutable snapshot of the tables and hashing
+// configuration used by lock-free readers.
+type swmrView struct {
+	current    *fixedTable
+	old        *fixedTable
+	growStatus growStatus
+	hashFunc   hashFunc
+	seed       uintptr
+
+	// oldHashFunc is only used if rehashing. See Map.oldHash.
+	oldHashFunc hashFunc
+	rehashing   bool
+}
+
+// publish makes the current tables visible to readers.
+// It must be called by the writer whenever the tables change.
+func (m *Map) publish() {
+	// Readers cannot safely observe a chunk being allocated, so allocate
+	// any lazy chunks now. (Lazy chunks only exist for large tables).
+	m.current.allocChunks()
+	// Take a copy of current so that later updates by the writer
+	// to m.current (such as replacing it when growing) are not observed by readers.
+	// The copy shares the control and slots backing arrays.
+	cur := m.current
+	v := &swmrView{
+		current:    &cur,
+		old:        m.old,
+		growStatus: m.growStatus,
+		hashFunc:   m.hashFunc,
+		seed:       m.seed,
+
+		oldHashFunc: m.oldHashFunc,
+		rehashing:   m.rehashing,
+	}
+	atomic.StorePointer(&m.view, unsafe.Pointer(v))
+}
+
+// storeSlot stores kv in chunk of m.current at i.
+func (m *Map) storeSlot(chunk *tableChunk, i uint64, kv KV) {
+	s := chunk.slot(i)
+	if m.swmr {
+		atomic.StoreInt64((*int64)(unsafe.Pointer(&s.Key)), int64(kv.Key))
+		atomic.StoreInt64((*int64)(unsafe.Pointer(&s.Value)), int64(kv.Value))
+		return
+	}
+	*s = kv
+}
+
+// setGrowStatus sets flag in the growth status for group in old.
+func (m *Map) setGrowStatus(group uint64, flag uint64) {
+	if m.swmr {
+		m.growStatus.setAtomic(group, flag)
+		return
+	}
+	m.growStatus.set(group, flag)
+}
+
+// getConcurrent is Get for SWMR mode. It can run concurrently with the writer.
+func (m *Map) getConcurrent(k Key) (v Value, ok bool) {
+	for spins := 0; ; spins++ {
+		seq := atomic.LoadUint64(&m.seq)
+		if seq&1 == 0 {
+			view := (*swmrView)(atomic.LoadPointer(&m.view))
+			v, ok, valid := view.get(k)
+			if valid && atomic.LoadUint64(&m.seq) == seq {
+				return v, ok
+			}
+		}
+		// A write is in progress or completed while we were looking.
+		if spins > 16 {
+			runtime.Gosched()
+		}
+	}
+}
+
+// get follows the same logic as Map.Get, but uses atomic loads where needed,
+// and reports valid as false if it detects an inconsistency that is only possible
+// with a torn read. (The caller must still validate the sequence counter).
+func (view *swmrView) get(k Key) (v Value, ok bool, valid bool) {
+	if view.current.chunks == nil {
+		// A freed Map.
+		return zeroValue(), false, true
+	}
+	h := view.hashFunc(k, view.seed)
+	oldH := h
+	if view.rehashing {
+		oldH = view.oldHashFunc(k, view.seed)
+	}
+
+	if view.old == nil || view.growStatus.hasAtomic(oldH&view.old.groupMask, statusChainEvacuated) {
+		// Not growing, or any keys with this natural group are in current.
+		kv, _, found, valid := view.find(view.current, k, h)
+		return kv.Value, found, valid
+	}
+
+	// We are growing. See Map.Get for details on each of these cases.
+	oldNatGroup := oldH & view.old.groupMask
+	oldNatGroupEvac := view.growStatus.hasAtomic(oldNatGroup, statusEvacuated)
+	table, tableH := view.current, h
+	if !oldNatGroupEvac {
+		table, tableH = view.old, oldH
+	}
+	kv, _, found, valid := view.find(table, k, tableH)
+	if !valid {
+		return zeroValue(), false, false
+	}
+	if found {
+		return kv.Value, true, true
+	}
+	if !oldNatGroupEvac {
+		return zeroValue(), false, true
+	}
+
+	oldKv, oldDisplGroup, found, valid := view.find(view.old, k, oldH)
+	if !valid {
+		return zeroValue(), false, false
+	}
+	if oldNatGroup == oldDisplGroup {
+		return zeroValue(), false, true
+	}
+	if found && !view.growStatus.hasAtomic(oldDisplGroup, statusEvacuated) {
+		return oldKv.Value, true, true
+	}
+	return zeroValue(), false, true
+}
+
+// find is similar to Map.find, but uses atomic loads for slots, and returns a copy
+// of the key/value rather than a pointer. Unlike Map.find, it does not panic if
+// it probes every group (which can happen with a torn read), but instead reports valid as false.
+func (view *swmrView) find(t *fixedTable, k Key, h uint64) (kv KV, group uint64, found bool, valid bool) {
+	group = h & t.groupMask
+	h2 := t.h2(h)
+
+	var probeCount uint64
+	for {
+		chunk, pos := t.locate(group)
+		controlBytes := chunk.groupControl(pos)
+		bitmask, ok := MatchByte(h2, controlBytes)
+		if debug && !ok {
+			panic("short control byte slice")
+		}
+		for bitmask != 0 {
+			offset := bits.TrailingZeros32(bitmask)
+			s := chunk.slot(pos + uint64(offset))
+			if Key(atomic.LoadInt64((*int64)(unsafe.Pointer(&s.Key)))) == k {
+				kv.Key = k
+				kv.Value = Value(atomic.LoadInt64((*int64)(unsafe.Pointer(&s.Value))))
+				return kv, group, true, true
+			}
+			bitmask &^= 1 << offset
+		}
+
+		if matchEmpty(controlBytes) != 0 {
+			return KV{}, group, false, true
+		}
+
+		probeCount++
+		if probeCount >= t.groups() {
+			// Only possible with a torn read.
+			return KV{}, group, false, false
+		}
+		group = (group + probeCount) & t.groupMask
+	}
+}
+
+// hasAtomic is like has, but atomically loads the word for group.
+func (s growStatus) hasAtomic(group uint64, flag uint64) bool {
+	w, bit := s.word(group, flag)
+	return atomic.LoadUint64(w)&bit != 0
+}
+
+// setAtomic is like set, but atomically stores the word for group.
+// It only supports a single writer.
+func (s growStatus) setAtomic(group uint64, flag uint64) {
+	w, bit := s.word(group, flag)
+	atomic.StoreUint64(w, atomic.LoadUint64(w)|bit)
+}
@@ -0,0 +1,197 @@
+package swisstable
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestSWMR_Sequential is a model-based test that checks that the SWMR code paths
+// preserve the normal map semantics, using a runtime map as the model.
+func TestSWMR_Sequential(t *testing.T) {
+	hashFuncs := []struct {
+		name string
+		f    hashFunc
+	}{
+		{"identityHash", identityHash},
+		{"zeroHash", zeroHash},
+		{"hashUint64", hashUint64},
+	}
+	for _, hf := range hashFuncs {
+		t.Run(hf.name, func(t *testing.T) {
+			for rep := 0; rep < 20; rep++ {
+				rng := rand.New(rand.NewSource(int64(rep)))
+				m := New(10, SingleWriter())
+				m.hashFunc = hf.f
+				m.publish()
+				mirror := make(map[Key]Value)
+
+				for i := 0; i < 2000; i++ {
+					k := Key(rng.Intn(300))
+					switch rng.Intn(4) {
+					case 0, 1:
+						v := Value(rng.Int63())
+						m.Set(k, v)
+						mirror[k] = v
+					case 2:
+						m.Delete(k)
+						delete(mirror, k)
+					case 3:
+						got, gotOk := m.Get(k)
+						want, wantOk := mirror[k]
+						if got != want || gotOk != wantOk {
+							t.Fatalf("rep %d op %d: Map.Get(%v) = %v, %v. want = %v, %v", rep, i, k, got, gotOk, want, wantOk)
+						}
+					}
+				}
+
+				if got := keysAndValues(m); len(got) != len(mirror) {
+					t.Fatalf("rep %d: Map.Range() returned %d elements, want %d", rep, len(got), len(mirror))
+				}
+				for k, want := range mirror {
+					got, ok := m.Get(k)
+					if !ok || got != want {
+						t.Fatalf("rep %d: Map.Get(%v) = %v, %v. want = %v, true", rep, k, got, ok, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestSWMR_ConcurrentReaders races one writer against several readers.
+// It is intended to be run with -race.
+//
+// The writer repeatedly updates a set of stable keys that are never deleted,
+// while also adding and deleting churn keys to force many grows.
+// Each value encodes its key and the writer's generation when it was written.
+// The readers check a simple model of the writer:
+//   - stable keys are always present.
+//   - a value always matches its key (no torn key/value pairs).
+//   - for a given stable key, a reader never observes the generation going backwards,
+//     and never observes a generation the writer has not yet started.
+func TestSWMR_ConcurrentReaders(t *testing.T) {
+	const (
+		stableKeys = 200
+		churnKeys  = 2000
+		readers    = 4
+	)
+	gens := 200
+	if testing.Short() {
+		gens = 20
+	}
+
+	encode := func(k Key, gen int) Value { return Value(int64(k)<<20 | int64(gen)) }
+	decode := func(v Value) (Key, int) { return Key(int64(v) >> 20), int(int64(v) & (1<<20 - 1)) }
+
+	for _, hf := range []struct {
+		name string
+		f    hashFunc
+	}{
+		{"identityHash", identityHash},
+		{"hashUint64", hashUint64},
+	} {
+		t.Run(hf.name, func(t *testing.T) {
+			m := New(10, SingleWriter())
+			m.hashFunc = hf.f
+			m.publish()
+			for k := Key(0); k < stableKeys; k++ {
+				m.Set(k, encode(k, 0))
+			}
+
+			var writerGen int64
+			var done int32
+			var wg sync.WaitGroup
+			errs := make(chan error, readers)
+
+			for r := 0; r < readers; r++ {
+				wg.Add(1)
+				go func(r int) {
+					defer wg.Done()
+					lastGen := make([]int, stableKeys)
+					rng := rand.New(rand.NewSource(int64(r)))
+					for atomic.LoadInt32(&done) == 0 {
+						k := Key(rng.Intn(stableKeys + churnKeys))
+						v, ok := m.Get(k)
+						maxGen := int(atomic.LoadInt64(&writerGen))
+						if k < stableKeys && !ok {
+							errs <- fmt.Errorf("reader %d: stable key %v not found", r, k)
+							return
+						}
+						if !ok {
+							continue
+						}
+						gotK, gotGen := decode(v)
+						if gotK != k {
+							errs <- fmt.Errorf("reader %d: Map.Get(%v) returned value for key %v", r, k, gotK)
+							return
+						}
+						if k >= stableKeys {
+							continue
+						}
+						if gotGen < lastGen[k] || gotGen > maxGen {
+							errs <- fmt.Errorf("reader %d: Map.Get(%v) generation %d, last seen %d, writer at %d",
+								r, k, gotGen, lastGen[k], maxGen)
+							return
+						}
+						lastGen[k] = gotGen
+					}
+				}(r)
+			}
+
+			for gen := 1; gen < gens; gen++ {
+				atomic.StoreInt64(&writerGen, int64(gen))
+				for k := Key(0); k < stableKeys; k++ {
+					m.Set(k, encode(k, gen))
+					if gen%2 == 1 {
+						ck := stableKeys + Key(rand.Intn(churnKeys))
+						m.Set(ck, encode(ck, gen))
+					} else {
+						m.Delete(stableKeys + Key(rand.Intn(churnKeys)))
+					}
+				}
+				if gen%10 == 0 {
+					// Drop the churn keys, which leaves DELETED tombstones that help force more grows.
+					for k := Key(stableKeys); k < stableKeys+churnKeys; k++ {
+						m.Delete(k)
+					}
+				}
+			}
+			atomic.StoreInt32(&done, 1)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// TestSWMR_FreeAndReuse checks that readers do not keep seeing the tables
+// of a Map in SWMR mode after Free.
+func TestSWMR_FreeAndReuse(t *testing.T) {
+	m := New(0, SingleWriter())
+	for k := Key(0); k < 100; k++ {
+		m.Set(k, Value(k))
+	}
+	m.Free()
+	if v, ok := m.Get(1); ok {
+		t.Fatalf("after Free: Map.Get(1) = %v, true. want = 0, false", v)
+	}
+
+	m.Set(200, 200)
+	if v, ok := m.Get(200); !ok || v != 200 {
+		t.Fatalf("after reuse: Map.Get(200) = %v, %v. want = 200, true", v, ok)
+	}
+	if v, ok := m.Get(1); ok {
+		t.Fatalf("after reuse: Map.Get(1) = %v, true. want = 0, false", v)
+	}
+	if got := m.Len(); got != 1 {
+		t.Fatalf("after reuse: Map.Len() = %d, want 1", got)
+	}
+	if got := len(keysAndValues(m)); got != 1 {
+		t.Fatalf("after reuse: Map.Range() returned %d elements, want 1", got)
+	}
+}